@@ -8,10 +8,12 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/companyzero/multus/storage"
 	"github.com/jrick/ss/stream"
 	"github.com/silvasur/golibrsync/librsync"
 )
@@ -28,7 +30,7 @@ func lookupGroup(groupName string) (int, error) {
 	return int(gid), nil
 }
 
-func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
+func backup(ctx context.Context, pubKeys []*stream.PublicKey, cfg *config) error {
 	destDir := filepath.Clean(cfg.BackupPath)
 	destDirAbs, err := filepath.Abs(destDir)
 	if err != nil {
@@ -55,17 +57,70 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 	if err != nil {
 		return err
 	}
+	reason := cfg.Backup.Rotation.due(sc, time.Now())
+	if sc.Len() != 0 && sc.differential != cfg.Backup.Differential {
+		reason = "backup mode changed"
+	}
+	if reason != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		id, err := newChainID()
+		if err != nil {
+			return err
+		}
+		log.Printf("starting a new chain: %s", reason)
+		sc = NewSignatureCache(id, hostname, time.Now(), cfg.Backup.Differential)
+	}
 	if sc.Len() != 0 {
 		sc.instance++
+	} else {
+		sc.differential = cfg.Backup.Differential
 	}
 	pathsToCheck := sc.Paths()
 
-	log.Printf("----------  RUNNING LEVEL %d (%v) -----------", sc.instance, sc.timeStamp)
+	// Differential levels are all computed against level 0, so only level
+	// 0 updates the cache entries.
+	updateCache := !sc.differential || sc.instance == 0
 
-	snap, err := NewSnapshot(pubKey, uid, gid, cfg.Backup.GZLevel, destDir, sc.hostname, sc.timeStamp, sc.instance, sc.version)
+	mode := "incremental"
+	if sc.differential {
+		mode = "differential"
+	}
+	log.Printf("----------  RUNNING %s LEVEL %d (%v %v) -----------", mode, sc.instance, sc.timeStamp, sc.chainID)
+
+	// Level 0 runs carry the bulk of the data, so only they are
+	// compressed with multiple threads.
+	threads := 1
+	if sc.instance == 0 {
+		threads = cfg.Backup.CompressionThreads
+	}
+	hostKey, err := LoadHostKey(cfg.Backup.HostKeyFile)
+	if err != nil {
+		return err
+	}
+	store, err := storage.Open(&cfg.Backup.Storage, destDir, uid, gid)
 	if err != nil {
 		return err
 	}
+	defer store.Close()
+	log.Printf("writing to %v", store.Location())
+	snap, err := NewSnapshot(pubKeys, store, cfg.Backup.compression, cfg.Backup.GZLevel, threads,
+		sc.chainID, sc.hostname, sc.timeStamp, sc.instance, sc.differential, sc.version)
+	if err != nil {
+		return err
+	}
+
+	var chunks *ChunkStore
+	if cfg.Backup.Dedup {
+		chunkKey, err := LoadChunkKey(cfg.Backup.ChunkKeyFile)
+		if err != nil {
+			snap.Abort()
+			return err
+		}
+		chunks = NewChunkStore(store, pubKeys, chunkKey, cfg.Backup.compression, cfg.Backup.GZLevel)
+	}
 
 	delta := new(bytes.Buffer)
 	delta.Grow(1024 * 1024 * 10)
@@ -110,7 +165,7 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 			}
 
 			fileMode := os.FileMode(MD.Attribs.Mode)
-			currentSig := sc.Get(srcPath)
+			cached := sc.Get(srcPath)
 
 			switch {
 			case isSocket(fileMode):
@@ -123,21 +178,22 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 			case isNamedPipe(fileMode):
 				fallthrough
 			case isDir(fileMode):
-				thisSig, err := GenSignature(MD, nil)
+				fingerprint, err := GenFingerprint(MD, nil)
 				if err != nil {
 					return err
 				}
-				if !bytes.Equal(currentSig, thisSig) {
-					if !currentSig.IsEmpty() {
+				if cached == nil || cached.fingerprint != fingerprint {
+					if cached != nil {
 						log.Printf("%q changed", srcPath)
 					} else {
 						log.Printf("%q new file", srcPath)
 					}
-					thisSig, err = snap.Add(MD, nil, 0)
-					if err != nil {
+					if err = snap.Add(MD, 0, nil, 0); err != nil {
 						return err
 					}
-					sc.Add(srcPath, thisSig)
+					if updateCache {
+						sc.Add(srcPath, fingerprint, nil)
+					}
 				} else {
 					log.Printf("%q no change", srcPath)
 				}
@@ -149,28 +205,36 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 					return err
 				}
 				dataReader := bytes.NewReader([]byte(dest))
-				thisSig, err := GenSignature(MD, dataReader)
+				fingerprint, err := GenFingerprint(MD, dataReader)
 				if err != nil {
 					return err
 				}
-				if !bytes.Equal(currentSig, thisSig) {
-					if !currentSig.IsEmpty() {
+				if cached == nil || cached.fingerprint != fingerprint {
+					thisSig, err := signatureFromReader(dataReader)
+					if err != nil {
+						return err
+					}
+					var flags byte
+					if cached != nil && !cached.signature.IsEmpty() {
 						log.Printf("%q changed", srcPath)
 
 						delta.Reset()
-						err = librsync.CreateDelta(currentSig.NewReader(), dataReader, delta)
+						err = librsync.CreateDelta(cached.signature.NewReader(), dataReader, delta)
 						if err != nil {
 							return err
 						}
 						dataReader.Reset(delta.Bytes())
+						flags |= entryDelta
 					} else {
 						log.Printf("%q new file", srcPath)
 					}
-					thisSig, err = snap.Add(MD, dataReader, int64(dataReader.Len()))
+					err = snap.Add(MD, flags, dataReader, int64(dataReader.Len()))
 					if err != nil {
 						return err
 					}
-					sc.Add(srcPath, thisSig)
+					if updateCache {
+						sc.Add(srcPath, fingerprint, thisSig)
+					}
 				} else {
 					log.Printf("%q: no change", srcPath)
 				}
@@ -182,37 +246,59 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 					fmt.Fprintf(os.Stderr, "Open: %v\n", err)
 					return nil
 				}
-				thisSig, err := GenSignature(MD, srcFD)
+				fingerprint, err := GenFingerprint(MD, srcFD)
 				if err != nil {
 					srcFD.Close()
 					return err
 				}
-				if !bytes.Equal(currentSig, thisSig) {
-					if !currentSig.IsEmpty() {
+				if (cached == nil || cached.fingerprint != fingerprint) && chunks != nil {
+					if cached != nil {
+						log.Printf("%q: changed", srcPath)
+					} else {
+						log.Printf("%q new file", srcPath)
+					}
+					refs, err := chunks.Store(srcFD)
+					if err == nil {
+						err = snap.Add(MD, entryChunked, bytes.NewReader(refs), int64(len(refs)))
+					}
+					if err != nil {
+						srcFD.Close()
+						return err
+					}
+					if updateCache {
+						sc.Add(srcPath, fingerprint, nil)
+					}
+				} else if cached == nil || cached.fingerprint != fingerprint {
+					thisSig, err := signatureFromReader(srcFD)
+					if err != nil {
+						srcFD.Close()
+						return err
+					}
+					if cached != nil && !cached.signature.IsEmpty() {
 						log.Printf("%q: changed", srcPath)
 						delta.Reset()
-						err = librsync.CreateDelta(currentSig.NewReader(), srcFD, delta)
+						err = librsync.CreateDelta(cached.signature.NewReader(), srcFD, delta)
 						if err != nil {
+							srcFD.Close()
 							return err
 						}
-						thisSig, err = snap.Add(MD, bytes.NewReader(delta.Bytes()),
+						err = snap.Add(MD, entryDelta, bytes.NewReader(delta.Bytes()),
 							int64(len(delta.Bytes())))
 					} else {
 						log.Printf("%q new file", srcPath)
-						st, err := srcFD.Stat()
-						if err != nil {
-							return err
-						}
-						thisSig, err = snap.Add(MD, srcFD, st.Size())
-						if err != nil {
-							return err
+						var st os.FileInfo
+						st, err = srcFD.Stat()
+						if err == nil {
+							err = snap.Add(MD, 0, srcFD, st.Size())
 						}
 					}
 					if err != nil {
 						srcFD.Close()
 						return err
 					}
-					sc.Add(srcPath, thisSig)
+					if updateCache {
+						sc.Add(srcPath, fingerprint, thisSig)
+					}
 				} else {
 					log.Printf("%q: no change", srcPath)
 				}
@@ -222,46 +308,72 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 			}
 		})
 		if err != nil {
-			snap.Close()
-			os.Remove(snap.Name())
+			snap.Abort()
 			return fmt.Errorf("error walking the path %q: %v", sourceDir, err)
 		}
 	}
 
-	// handle deleted files
+	// handle deleted files, children before their parent directories
+	deletedPaths := make([]string, 0, len(pathsToCheck))
 	for deletedFilePath := range pathsToCheck {
+		deletedPaths = append(deletedPaths, deletedFilePath)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(deletedPaths)))
+	for _, deletedFilePath := range deletedPaths {
 		log.Printf("%q: deleted", deletedFilePath)
-		sc.Delete(deletedFilePath)
-		_, err = snap.Add(&Metadata{Path: deletedFilePath, Attribs: FileAttributes{}}, nil, 0)
+		if updateCache {
+			sc.Delete(deletedFilePath)
+		}
+		err = snap.Add(&Metadata{Path: deletedFilePath, Attribs: FileAttributes{}}, 0, nil, 0)
 		if err != nil {
-			snap.Close()
-			os.Remove(snap.Name())
+			snap.Abort()
 			return err
 		}
 	}
 
 	if err = snap.Close(); err != nil {
-		os.Remove(snap.Name())
 		return err
 	}
-
-	sigFD, err := os.OpenFile(sigFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o0640)
-	if err != nil {
-		return err
+	bytesWritten := snap.BytesWritten()
+	if chunks != nil {
+		if err = chunks.WriteRefs(refsFileName(snap.Name())); err != nil {
+			store.Remove(snap.Name())
+			return err
+		}
+		bytesWritten += chunks.BytesWritten()
 	}
-	if err = sc.Write(sigFD); err != nil {
-		sigFD.Close()
+	if err = writeManifest(store, snap, hostKey); err != nil {
+		store.Remove(snap.Name())
+		if chunks != nil {
+			store.Remove(refsFileName(snap.Name()))
+		}
 		return err
 	}
-	if err = sigFD.Close(); err != nil {
+	if sc.instance == 0 {
+		sc.baseSize = uint64(bytesWritten)
+		sc.incrementSize = 0
+	} else if sc.differential {
+		sc.incrementSize = uint64(bytesWritten)
+	} else {
+		sc.incrementSize += uint64(bytesWritten)
+	}
+
+	if err = sc.WriteFile(sigFile); err != nil {
 		return err
 	}
 	err = os.Chown(sigFile, uid, gid)
 	if err != nil {
 		log.Printf("%v", err)
 	}
+	// Remote stores get a copy of the cache so agents can account for the
+	// chain.  The local copy drives the next run.
+	if !cfg.Backup.Storage.IsLocal() {
+		if err = sc.Upload(store); err != nil {
+			return err
+		}
+	}
 
 	log.Printf("completed: duration:%v bytes written:%d files-skipped:%d",
-		time.Since(startTime), snap.BytesWritten(), filesExcluded)
+		time.Since(startTime), bytesWritten, filesExcluded)
 	return nil
 }
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/companyzero/multus/storage"
+	"github.com/jrick/ss/keyfile"
+	"github.com/jrick/ss/stream"
+	"github.com/silvasur/golibrsync/librsync"
+)
+
+func testKeys(t *testing.T) (*stream.PublicKey, *stream.SecretKey) {
+	t.Helper()
+
+	passphrase := []byte("test")
+	pkBuf, skBuf := new(bytes.Buffer), new(bytes.Buffer)
+	kdfp := &keyfile.Argon2idParams{Time: 1, Memory: 64}
+	_, err := keyfile.GenerateKeys(rand.Reader, pkBuf, skBuf, passphrase, kdfp, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := keyfile.ReadPublicKey(pkBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, _, err := keyfile.OpenSecretKey(skBuf, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk, sk
+}
+
+func testRepo(t *testing.T, dir string) *repository {
+	t.Helper()
+
+	repo, err := openRepository(&storage.Config{}, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func testConfig(t *testing.T, backupPath string, paths ...string) *config {
+	t.Helper()
+
+	group, err := user.LookupGroupId(strconv.Itoa(os.Getegid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config{
+		BackupPath: backupPath,
+		Backup: BackupConfig{
+			Group:              group.Name,
+			MaxIntervals:       10,
+			GZLevel:            1,
+			CompressionThreads: 2,
+			Paths:              paths,
+			compression:        CompressionZstd,
+			HostKeyFile:        filepath.Join(filepath.Dir(filepath.Clean(backupPath)), "host.key"),
+		},
+	}
+}
+
+// testData returns n bytes that are unlikely to produce matching blocks by
+// accident.
+func testData(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSignatureCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basis := testData(t, 1<<16)
+	md := &Metadata{Path: "/a", Attribs: FileAttributes{Size: int64(len(basis)), Mode: 0644}}
+	fingerprint, err := GenFingerprint(md, bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signatureFromReader(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigFile := filepath.Join(dir, "sig.cache")
+	sc, err := LoadSignatureCache(sigFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Add(md.Path, fingerprint, signature)
+	sc.Add("/dir", Fingerprint{1}, nil)
+	fd, err := os.Create(sigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Write(fd); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	sc, err = LoadSignatureCache(sigFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := sc.Get(md.Path)
+	if entry == nil {
+		t.Fatalf("%q missing from cache", md.Path)
+	}
+	if entry.fingerprint != fingerprint {
+		t.Fatalf("fingerprint mismatch")
+	}
+	if !entry.signature.IsEqual(signature) {
+		t.Fatalf("signature mismatch")
+	}
+	if dir := sc.Get("/dir"); dir == nil || !dir.signature.IsEmpty() {
+		t.Fatalf("unexpected directory entry %v", dir)
+	}
+
+	// The cached signature must be usable as a delta basis.
+	newData := append(append([]byte{}, basis[:1<<15]...), testData(t, 100)...)
+	newData = append(newData, basis[1<<15:]...)
+	delta := new(bytes.Buffer)
+	err = librsync.CreateDelta(entry.signature.NewReader(), bytes.NewReader(newData), delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := new(bytes.Buffer)
+	err = librsync.Patch(bytes.NewReader(basis), delta, patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patched.Bytes(), newData) {
+		t.Fatalf("patched data mismatch")
+	}
+	if delta.Len() >= len(newData) {
+		t.Fatalf("delta not smaller than data: %d >= %d", delta.Len(), len(newData))
+	}
+}
+
+func TestBackupRestoreDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	backupDir := filepath.Join(dir, "backup")
+	if err = os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pk, sk := testKeys(t)
+	cfg := testConfig(t, backupDir, srcDir)
+
+	changed := filepath.Join(srcDir, "changed")
+	unchanged := filepath.Join(srcDir, "unchanged")
+	link := filepath.Join(srcDir, "link")
+	deleted := filepath.Join(srcDir, "deleted")
+	text := filepath.Join(srcDir, "text")
+	textData := bytes.Repeat([]byte("compressible text\n"), 1<<14)
+	basis := testData(t, 1<<17)
+	if err = ioutil.WriteFile(changed, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(unchanged, []byte("unchanged"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(deleted, []byte("deleted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(text, textData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("unchanged", link); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	newData := append(append([]byte{}, basis[:1<<16]...), []byte("inserted")...)
+	newData = append(newData, basis[1<<16:]...)
+	if err = ioutil.WriteFile(changed, newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("changed", link); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDir := filepath.Join(dir, "restore")
+	if err = restore(ctx, sk, testRepo(t, backupDir), restoreDir, nil, -1); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(restoreDir, srcDir)
+
+	b, err := ioutil.ReadFile(filepath.Join(restored, "changed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, newData) {
+		t.Fatalf("changed file content mismatch")
+	}
+	b, err = ioutil.ReadFile(filepath.Join(restored, "unchanged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "unchanged" {
+		t.Fatalf("unchanged file content mismatch: %q", b)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(restored, "text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, textData) {
+		t.Fatalf("compressed file content mismatch")
+	}
+	dest, err := os.Readlink(filepath.Join(restored, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != "changed" {
+		t.Fatalf("symlink mismatch: %q", dest)
+	}
+	if _, err = os.Lstat(filepath.Join(restored, "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("deleted file restored: %v", err)
+	}
+}
+
+func TestBackupRestoreDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	backupDir := filepath.Join(dir, "backup")
+	if err = os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pk, sk := testKeys(t)
+	cfg := testConfig(t, backupDir, srcDir)
+	cfg.Backup.Dedup = true
+	cfg.Backup.ChunkKeyFile = filepath.Join(dir, "chunk.key")
+
+	data := testData(t, 1<<20)
+	for _, name := range []string{"a", "b"} {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = backup(context.Background(), []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunkFiles int
+	err = filepath.Walk(filepath.Join(backupDir, ChunkDir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			chunkFiles++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both files share the same chunks.
+	if want := len(chunkIDs(t, data)); chunkFiles != want {
+		t.Fatalf("expected %d chunk files, got %d", want, chunkFiles)
+	}
+	refs, err := filepath.Glob(filepath.Join(backupDir, "*.refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("expected 1 refs file, got %d", len(refs))
+	}
+
+	restoreDir := filepath.Join(dir, "restore")
+	if err = restore(context.Background(), sk, testRepo(t, backupDir), restoreDir, nil, -1); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(restoreDir, srcDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("%v: content mismatch", name)
+		}
+	}
+}
+
+func TestBackupRestoreDifferential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	backupDir := filepath.Join(dir, "backup")
+	if err = os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pk, sk := testKeys(t)
+	cfg := testConfig(t, backupDir, srcDir)
+	cfg.Backup.Differential = true
+
+	changed := filepath.Join(srcDir, "changed")
+	deleted := filepath.Join(srcDir, "deleted")
+	added := filepath.Join(srcDir, "added")
+	basis := testData(t, 1<<17)
+	if err = ioutil.WriteFile(changed, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(deleted, []byte("deleted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	level1 := append(append([]byte{}, basis...), []byte("level 1")...)
+	if err = ioutil.WriteFile(changed, level1, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	level2 := append(append([]byte{}, []byte("level 2")...), basis...)
+	if err = ioutil.WriteFile(changed, level2, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(added, []byte("added"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Level 2 must not depend on level 1.
+	sc, err := LoadSignatureCache(filepath.Join(backupDir, "sig.cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Instance() != 2 {
+		t.Fatalf("expected level 2, got %d", sc.Instance())
+	}
+	if err = os.Remove(filepath.Join(backupDir, snapshotFileName(sc.chainID, sc.hostname, sc.timeStamp, 1, cfg.Backup.compression))); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDir := filepath.Join(dir, "restore")
+	if err = restore(ctx, sk, testRepo(t, backupDir), restoreDir, nil, -1); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(restoreDir, srcDir)
+	b, err := ioutil.ReadFile(filepath.Join(restored, "changed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, level2) {
+		t.Fatalf("changed file content mismatch")
+	}
+	b, err = ioutil.ReadFile(filepath.Join(restored, "added"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "added" {
+		t.Fatalf("added file content mismatch: %q", b)
+	}
+	if _, err = os.Lstat(filepath.Join(restored, "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("deleted file restored: %v", err)
+	}
+}
+
+func TestLoadSignatureCacheTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, err := newChainID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSignatureCache(id, "host", time.Now(), false)
+	sc.Add("/a", Fingerprint{1}, Signature("signature"))
+	sc.Add("/b", Fingerprint{2}, nil)
+	sigfile := filepath.Join(dir, "sig.cache")
+	if err = sc.WriteFile(sigfile); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(sigfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadSignatureCache(sigfile, 0); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < len(buf); n++ {
+		if err = ioutil.WriteFile(sigfile, buf[:n], 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadSignatureCache(sigfile, 0); err == nil {
+			t.Fatalf("cache truncated to %d bytes loaded", n)
+		}
+	}
+}
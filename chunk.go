@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/companyzero/multus/format"
+	"github.com/companyzero/multus/storage"
+	"github.com/jrick/ss/stream"
+)
+
+// Content-defined chunk boundaries are found with a gear rolling hash.  The
+// hash is checked against a stricter mask before the average size and a
+// looser one after it, which keeps chunk sizes close to the average.
+const (
+	chunkMinSize = 256 << 10
+	chunkAvgSize = 1 << 20
+	chunkMaxSize = 4 << 20
+
+	chunkMaskS = uint64(1<<22-1) << (64 - 22)
+	chunkMaskL = uint64(1<<18-1) << (64 - 18)
+
+	// chunkRefSize is the serialized size of a ChunkRef.
+	chunkRefSize = sha256.Size + 4
+
+	// ChunkDir is the directory below the backup path holding the chunk
+	// repository.
+	ChunkDir = "chunks"
+)
+
+var gear [256]uint64
+
+func init() {
+	// The table must be identical on every host for chunks to dedup
+	// across hosts, so it is derived instead of randomly generated.
+	for i := range gear {
+		h := sha256.Sum256([]byte{'m', 'u', 'l', 't', 'u', 's', byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(h[:8])
+	}
+}
+
+// cutPoint returns the length of the first chunk in data.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	normal := chunkAvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var h uint64
+	i := chunkMinSize - 64
+	for ; i < chunkMinSize; i++ {
+		h = (h << 1) + gear[data[i]]
+	}
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a reader into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, chunkMaxSize),
+	}
+}
+
+// Reset makes the chunker read from r, reusing its buffer.
+func (c *chunker) Reset(r io.Reader) {
+	c.r = r
+	c.n = 0
+	c.eof = false
+}
+
+// Next returns a copy of the next chunk or io.EOF.
+func (c *chunker) Next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			c.eof = true
+		case err != nil:
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	cut := cutPoint(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	copy(c.buf, c.buf[cut:c.n])
+	c.n -= cut
+	return chunk, nil
+}
+
+// ChunkID identifies a chunk by the keyed hash of its plaintext.
+type ChunkID [sha256.Size]byte
+
+func (id ChunkID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseChunkID parses the hex encoding of a chunk id.
+func ParseChunkID(s string) (ChunkID, error) {
+	var id ChunkID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("invalid chunk id length %d", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// chunkName returns the name of a chunk in a storage backend.
+func chunkName(id ChunkID) string {
+	s := id.String()
+	return path.Join(ChunkDir, s[:2], s+".enc")
+}
+
+// ChunkRef is a reference to a chunk as stored in a snapshot entry.
+type ChunkRef struct {
+	ID  ChunkID
+	Len uint32
+}
+
+func (c ChunkRef) Serialize() []byte {
+	var b [chunkRefSize]byte
+	copy(b[:], c.ID[:])
+	binary.LittleEndian.PutUint32(b[sha256.Size:], c.Len)
+	return b[:]
+}
+
+// ParseChunkRefs parses the data of a chunked snapshot entry.
+func ParseChunkRefs(b []byte) ([]ChunkRef, error) {
+	if len(b)%chunkRefSize != 0 {
+		return nil, fmt.Errorf("invalid chunk reference length %d", len(b))
+	}
+	refs := make([]ChunkRef, 0, len(b)/chunkRefSize)
+	for offset := 0; offset < len(b); offset += chunkRefSize {
+		var ref ChunkRef
+		copy(ref.ID[:], b[offset:offset+sha256.Size])
+		ref.Len = binary.LittleEndian.Uint32(b[offset+sha256.Size:])
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// LoadChunkKey reads the key used to derive chunk ids, generating it when
+// the file does not exist.  Hosts sharing the key dedup against each other.
+func LoadChunkKey(keyFile string) ([]byte, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		if len(key) != sha256.Size {
+			return nil, fmt.Errorf("%q: invalid key length %d", keyFile, len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, sha256.Size)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ChunkStore writes encrypted chunks below ChunkDir of a repository, storing
+// every distinct chunk only once.
+type ChunkStore struct {
+	store        storage.Backend
+	pubKeys      []*stream.PublicKey
+	key          []byte
+	compression  Compression
+	level        int
+	chunker      *chunker
+	known        map[ChunkID]struct{}
+	referenced   map[ChunkID]struct{}
+	bytesWritten int64
+}
+
+func NewChunkStore(store storage.Backend, pubKeys []*stream.PublicKey, key []byte, compression Compression,
+	level int) *ChunkStore {
+
+	return &ChunkStore{
+		store:       store,
+		pubKeys:     pubKeys,
+		key:         key,
+		compression: compression,
+		level:       level,
+		chunker:     newChunker(nil),
+		known:       make(map[ChunkID]struct{}),
+		referenced:  make(map[ChunkID]struct{}),
+	}
+}
+
+// Store splits r into chunks, writes the chunks missing from the repository
+// and returns the serialized references.
+func (cs *ChunkStore) Store(r io.Reader) ([]byte, error) {
+	refs := new(bytes.Buffer)
+	cs.chunker.Reset(r)
+	for {
+		chunk, err := cs.chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ref, err := cs.put(chunk)
+		if err != nil {
+			return nil, err
+		}
+		refs.Write(ref.Serialize())
+	}
+	return refs.Bytes(), nil
+}
+
+func (cs *ChunkStore) put(chunk []byte) (ChunkRef, error) {
+	mac := hmac.New(sha256.New, cs.key)
+	mac.Write(chunk)
+	ref := ChunkRef{Len: uint32(len(chunk))}
+	copy(ref.ID[:], mac.Sum(nil))
+	cs.referenced[ref.ID] = struct{}{}
+
+	if _, ok := cs.known[ref.ID]; ok {
+		return ref, nil
+	}
+	name := chunkName(ref.ID)
+	_, err := cs.store.Stat(name)
+	if err == nil {
+		cs.known[ref.ID] = struct{}{}
+		return ref, nil
+	}
+	if !storage.IsNotExist(err) {
+		return ref, err
+	}
+
+	// A chunk is stored as a codec byte followed by the possibly
+	// compressed data.
+	plaintext := new(bytes.Buffer)
+	plaintext.Grow(1 + len(chunk))
+	sample := chunk
+	if len(sample) > probeSize {
+		sample = sample[:probeSize]
+	}
+	if cs.compression != CompressionNone && isCompressible("", sample) {
+		plaintext.WriteByte(byte(cs.compression))
+		cw, err := newCompressor(plaintext, cs.compression, cs.level, 1)
+		if err != nil {
+			return ref, err
+		}
+		if _, err = cw.Write(chunk); err != nil {
+			return ref, err
+		}
+		if err = cw.Close(); err != nil {
+			return ref, err
+		}
+	} else {
+		plaintext.WriteByte(byte(CompressionNone))
+		plaintext.Write(chunk)
+	}
+
+	header, symKey, err := encapsulate(cs.pubKeys)
+	if err != nil {
+		return ref, err
+	}
+	w, err := cs.store.Create(name)
+	if err != nil {
+		return ref, err
+	}
+	cw := &countWriter{w: w}
+	if err = header.encrypt(cw, plaintext, symKey); err != nil {
+		w.Abort()
+		return ref, err
+	}
+	if err = w.Close(); err != nil {
+		return ref, err
+	}
+	cs.known[ref.ID] = struct{}{}
+	cs.bytesWritten += cw.n
+
+	return ref, nil
+}
+
+// BytesWritten returns the size of the chunks written to the repository.
+func (cs *ChunkStore) BytesWritten() int64 {
+	return cs.bytesWritten
+}
+
+// WriteRefs writes the ids of every chunk referenced since the store was
+// created, one per line.  The list lets cleanup find unreferenced chunks
+// without the secret key.
+func (cs *ChunkStore) WriteRefs(refsFile string) error {
+	buf := new(bytes.Buffer)
+	for id := range cs.referenced {
+		fmt.Fprintln(buf, id.String())
+	}
+	w, err := cs.store.Create(refsFile)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// refsFileName returns the name of the chunk reference list belonging to a
+// snapshot file.
+func refsFileName(snapshotFile string) string {
+	base, _ := format.TrimIncrementExt(snapshotFile)
+	return base + ".refs"
+}
+
+// chunkReader reads chunks from the first repository holding them.
+type chunkReader struct {
+	stores    []storage.Backend
+	secretKey *stream.SecretKey
+}
+
+func newChunkReader(secretKey *stream.SecretKey, stores ...storage.Backend) *chunkReader {
+	return &chunkReader{
+		stores:    stores,
+		secretKey: secretKey,
+	}
+}
+
+// WriteTo writes the data of ref to w.
+func (cr *chunkReader) WriteTo(w io.Writer, ref ChunkRef) error {
+	var fd io.ReadCloser
+	var err error
+	for _, store := range cr.stores {
+		fd, err = store.Open(chunkName(ref.ID))
+		if err == nil {
+			break
+		}
+		if !storage.IsNotExist(err) {
+			return err
+		}
+	}
+	if fd == nil {
+		return fmt.Errorf("chunk %v: not found", ref.ID)
+	}
+	defer fd.Close()
+
+	header, err := readStreamHeader(fd)
+	if err != nil {
+		return err
+	}
+	symKey, err := header.key(cr.secretKey)
+	if err != nil {
+		return err
+	}
+	plaintext := new(bytes.Buffer)
+	plaintext.Grow(int(ref.Len) + 1)
+	if err = stream.Decrypt(plaintext, fd, header.Bytes, symKey); err != nil {
+		return fmt.Errorf("chunk %v: %v", ref.ID, err)
+	}
+	codec, err := plaintext.ReadByte()
+	if err != nil {
+		return fmt.Errorf("chunk %v: %v", ref.ID, err)
+	}
+	dec, err := newDecompressor(plaintext, Compression(codec))
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	n, err := io.CopyN(w, dec, int64(ref.Len))
+	if err != nil {
+		return fmt.Errorf("chunk %v: %v", ref.ID, err)
+	}
+	if n != int64(ref.Len) {
+		return fmt.Errorf("chunk %v: short chunk %d != %d", ref.ID, n, ref.Len)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/companyzero/multus/storage"
+	"github.com/jrick/ss/stream"
+)
+
+func chunkIDs(t *testing.T, data []byte) map[string]int {
+	t.Helper()
+
+	ids := make(map[string]int)
+	c := newChunker(bytes.NewReader(data))
+	var total int
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > chunkMaxSize {
+			t.Fatalf("chunk too large: %d", len(chunk))
+		}
+		total += len(chunk)
+		ids[string(chunk[:64])+string(chunk[len(chunk)-64:])] = len(chunk)
+	}
+	if total != len(data) {
+		t.Fatalf("chunks cover %d of %d bytes", total, len(data))
+	}
+	return ids
+}
+
+func TestChunkerInsertion(t *testing.T) {
+	data := testData(t, 24<<20)
+	edited := append(append(append([]byte{}, data[:5<<20]...), []byte("inserted")...), data[5<<20:]...)
+
+	before := chunkIDs(t, data)
+	after := chunkIDs(t, edited)
+	var shared int
+	for id := range after {
+		if _, ok := before[id]; ok {
+			shared++
+		}
+	}
+	// An insertion only disturbs the chunks around it.
+	if shared < len(after)-2 {
+		t.Fatalf("only %d of %d chunks survived an insertion", shared, len(after))
+	}
+}
+
+func TestChunkStoreDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pk, sk := testKeys(t)
+	key, err := LoadChunkKey(filepath.Join(dir, "chunk.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewLocal(dir, os.Geteuid(), os.Getegid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := NewChunkStore(store, []*stream.PublicKey{pk}, key, CompressionZstd, 0)
+
+	data := append(testData(t, 3<<20), bytes.Repeat([]byte("text"), 1<<20)...)
+	refs, err := cs.Store(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := cs.BytesWritten()
+	again, err := cs.Store(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(refs, again) {
+		t.Fatal("identical data produced different references")
+	}
+	if cs.BytesWritten() != written {
+		t.Fatalf("identical data stored twice")
+	}
+
+	parsed, err := ParseChunkRefs(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := storage.NewLocal(filepath.Join(dir, "missing"), -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := newChunkReader(sk, missing, store)
+	got := new(bytes.Buffer)
+	for _, ref := range parsed {
+		if err = cr.WriteTo(got, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("chunked data mismatch")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression identifies the codec used for compressed snapshot entries.  It is
+// recorded in the snapshot header so readers can pick the matching decoder.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+	CompressionLZ4
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone: "none",
+	CompressionGzip: "gzip",
+	CompressionZstd: "zstd",
+	CompressionLZ4:  "lz4",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// compressionExts are the file extensions of the codecs.
+var compressionExts = map[Compression]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+	CompressionLZ4:  ".lz4",
+}
+
+// Ext returns the file extension of the codec, empty for none.
+func (c Compression) Ext() string {
+	return compressionExts[c]
+}
+
+// ParseCompression returns the codec for a configuration name.
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if strings.EqualFold(n, name) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q", name)
+}
+
+// resetWriteCloser is a compressor that can be reused for another stream
+// after it has been closed.
+type resetWriteCloser interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (n *nopWriteCloser) Reset(w io.Writer) {
+	n.Writer = w
+}
+
+// compressWriter hides any ReadFrom method of the wrapped encoder.  The zstd
+// and lz4 implementations end the frame once the source is drained, which
+// breaks the io.CopyN calls made for every snapshot entry.
+type compressWriter struct {
+	resetWriteCloser
+}
+
+// pgzipWriter restores the block concurrency that pgzip.Writer.Reset
+// discards.
+type pgzipWriter struct {
+	*pgzip.Writer
+	threads int
+}
+
+func (p pgzipWriter) Reset(w io.Writer) {
+	p.Writer.Reset(w)
+	p.Writer.SetConcurrency(1<<20, p.threads)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// newCompressor returns a writer compressing to w.  The level only applies to
+// gzip.  When threads is greater than one the gzip, zstd and lz4 encoders
+// compress blocks concurrently.  Closing the returned writer flushes it but
+// does not close w.
+func newCompressor(w io.Writer, c Compression, level, threads int) (resetWriteCloser, error) {
+	if threads < 1 {
+		threads = 1
+	}
+	switch c {
+	case CompressionNone:
+		return &nopWriteCloser{w}, nil
+	case CompressionGzip:
+		if threads == 1 {
+			return gzip.NewWriterLevel(w, level)
+		}
+		gz, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		if err = gz.SetConcurrency(1<<20, threads); err != nil {
+			return nil, err
+		}
+		return pgzipWriter{gz, threads}, nil
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(threads))
+		if err != nil {
+			return nil, err
+		}
+		return compressWriter{zw}, nil
+	case CompressionLZ4:
+		lz := lz4.NewWriter(w)
+		if err := lz.Apply(lz4.ConcurrencyOption(threads)); err != nil {
+			return nil, err
+		}
+		return compressWriter{lz}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %v", c)
+}
+
+// newDecompressor returns a reader decompressing r.  Closing the returned
+// reader does not close r.
+func newDecompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{zr}, nil
+	case CompressionLZ4:
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %v", c)
+}
+
+// Compressed snapshot entries are framed as a sequence of length prefixed
+// blocks terminated by an empty block.  This lets a reader find the end of an
+// entry without knowing its compressed size up front.
+const maxBlockSize = 1 << 16
+
+// blockWriter frames everything written to it into blocks of at most
+// maxBlockSize bytes.  Close writes the terminating empty block.
+type blockWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newBlockWriter(w io.Writer) *blockWriter {
+	return &blockWriter{
+		w:   w,
+		buf: make([]byte, 4, 4+maxBlockSize),
+	}
+}
+
+func (b *blockWriter) Reset(w io.Writer) {
+	b.w = w
+	b.buf = b.buf[:4]
+}
+
+func (b *blockWriter) flush() error {
+	binary.LittleEndian.PutUint32(b.buf[0:4], uint32(len(b.buf)-4))
+	_, err := b.w.Write(b.buf)
+	b.buf = b.buf[:4]
+	return err
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := copy(b.buf[len(b.buf):cap(b.buf)], p)
+		b.buf = b.buf[:len(b.buf)+n]
+		p = p[n:]
+		written += n
+		if len(b.buf) == cap(b.buf) {
+			if err := b.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *blockWriter) Close() error {
+	if len(b.buf) > 4 {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	return b.flush()
+}
+
+// blockReader reads the blocks written by a blockWriter and returns io.EOF
+// after the terminating empty block.
+type blockReader struct {
+	r         io.Reader
+	remaining uint32
+	done      bool
+}
+
+func (b *blockReader) Reset(r io.Reader) {
+	b.r = r
+	b.remaining = 0
+	b.done = false
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	if b.remaining == 0 {
+		var l [4]byte
+		if _, err := io.ReadFull(b.r, l[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.remaining = binary.LittleEndian.Uint32(l[:])
+		if b.remaining == 0 {
+			b.done = true
+			return 0, io.EOF
+		}
+	}
+	if uint32(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= uint32(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// probeSize is the amount of entry data sampled to decide whether it is
+// worth compressing.
+const probeSize = 1 << 16
+
+// incompressibleExtensions lists file extensions whose content is already
+// compressed or encrypted.
+var incompressibleExtensions = map[string]struct{}{
+	".7z": {}, ".aac": {}, ".age": {}, ".apk": {}, ".avi": {},
+	".bz2": {}, ".deb": {}, ".enc": {}, ".flac": {}, ".gif": {},
+	".gpg": {}, ".gz": {}, ".heic": {}, ".jar": {}, ".jpeg": {},
+	".jpg": {}, ".lz4": {}, ".lzma": {}, ".m4a": {}, ".m4v": {},
+	".mkv": {}, ".mov": {}, ".mp3": {}, ".mp4": {}, ".ogg": {},
+	".opus": {}, ".png": {}, ".rar": {}, ".rpm": {}, ".tbz": {},
+	".tgz": {}, ".txz": {}, ".webm": {}, ".webp": {}, ".xz": {},
+	".zip": {}, ".zst": {},
+}
+
+// countWriter counts the bytes written through it to w.  A nil w discards
+// the data.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.w == nil {
+		c.n += int64(len(p))
+		return len(p), nil
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// isCompressible reports whether data starting with sample should be
+// compressed.  Known compressed formats are rejected by extension; anything
+// else is compressed with a fast deflate pass and must shrink by at least a
+// tenth.
+func isCompressible(path string, sample []byte) bool {
+	if _, ok := incompressibleExtensions[strings.ToLower(filepath.Ext(path))]; ok {
+		return false
+	}
+	// Tiny entries do not make up for the framing overhead.
+	if len(sample) < 128 {
+		return false
+	}
+	c := new(countWriter)
+	fw, err := flate.NewWriter(c, flate.BestSpeed)
+	if err != nil {
+		return false
+	}
+	fw.Write(sample)
+	fw.Close()
+	return c.n < int64(len(sample))*9/10
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("multus compression test data "), 1<<15)
+	for c := range compressionNames {
+		for _, threads := range []int{1, 4} {
+			buf := new(bytes.Buffer)
+			w, err := newCompressor(buf, c, 6, threads)
+			if err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			// Write in pieces the way Snapshot.Add does.
+			half := int64(len(data) / 2)
+			if _, err = io.CopyN(w, bytes.NewReader(data[:half]), half); err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			if _, err = w.Write(data[half:]); err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			if err = w.Close(); err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			if c != CompressionNone && buf.Len() >= len(data) {
+				t.Fatalf("%v: not compressed: %d >= %d", c, buf.Len(), len(data))
+			}
+
+			r, err := newDecompressor(buf, c)
+			if err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			r.Close()
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%v threads %d: data mismatch", c, threads)
+			}
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for c, name := range compressionNames {
+		got, err := ParseCompression(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c {
+			t.Fatalf("%q: got %v want %v", name, got, c)
+		}
+	}
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+}
+
+func TestBlockFraming(t *testing.T) {
+	for _, size := range []int{0, 1, maxBlockSize - 1, maxBlockSize, 3*maxBlockSize + 7} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		buf := new(bytes.Buffer)
+		bw := newBlockWriter(buf)
+		if _, err := bw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("trailer")
+
+		br := &blockReader{r: buf}
+		got, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: data mismatch", size)
+		}
+		if buf.String() != "trailer" {
+			t.Fatalf("size %d: reader consumed past terminator", size)
+		}
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible "), 1000)
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		sample []byte
+		want   bool
+	}{
+		{"/a.txt", text, true},
+		{"/a.JPG", text, false},
+		{"/a.tar.gz", text, false},
+		{"/a.bin", random, false},
+		{"/a.txt", text[:100], false},
+	}
+	for _, test := range tests {
+		if got := isCompressible(test.path, test.sample); got != test.want {
+			t.Errorf("%q (%d bytes): got %v want %v", test.path,
+				len(test.sample), got, test.want)
+		}
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"compress/gzip"
+	"errors"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"time"
 
+	"github.com/companyzero/multus/storage"
 	"gopkg.in/yaml.v2"
 )
 
@@ -13,18 +18,52 @@ var (
 	defaultHomeDir = AppDataDir("multus", false)
 )
 
+// RotationConfig holds the policies that start a new chain.  Any policy
+// that is due starts a level 0 run; zero values disable a policy.
+type RotationConfig struct {
+	MaxAgeDays          int
+	MonthlyWeekday      string
+	MaxIncrementPercent int
+	weekday             time.Weekday
+}
+
 type BackupConfig struct {
-	Group        string
-	MaxIntervals uint16
-	GZLevel      int
-	PubkeyFile   string
-	Paths        []string
-	Excludes     []string
-	rExcludes    []*regexp.Regexp
+	Group              string
+	MaxIntervals       uint16
+	Differential       bool
+	Rotation           RotationConfig
+	Storage            storage.Config
+	Compression        string
+	GZLevel            int
+	CompressionThreads int
+	Dedup              bool
+	ChunkKeyFile       string
+	HostKeyFile        string
+	PubkeyFile         string
+	// PubkeyFiles are further recipients.  Any of their secret keys
+	// restores the backups.
+	PubkeyFiles []string
+	Paths       []string
+	Excludes    []string
+	rExcludes   []*regexp.Regexp
+	compression Compression
 }
 
 type RestoreConfig struct {
 	SecretFile string
+	// At most one passphrase source for the secret key may be set, without
+	// one the passphrase is read from the terminal.
+	PassphraseFile    string
+	PassphraseEnv     string
+	PassphraseFD      *int
+	PassphraseCommand string
+	// Storage overrides the backup storage to restore from, for example a
+	// bucket the agent mirrors to.
+	Storage *storage.Config
+	// TempDir is where restores to a tar stream or stdout, exports and
+	// mounts stage deltas and patched files larger than 32 MiB.  It
+	// defaults to $TMPDIR or /tmp.
+	TempDir string
 }
 
 type config struct {
@@ -33,6 +72,25 @@ type config struct {
 	Restore    RestoreConfig
 }
 
+// storageDefaults fills in the SSH files of sftp storage, which default to
+// the files below ~/.ssh.
+func storageDefaults(st *storage.Config) error {
+	if st.Type != "sftp" || (len(st.IdentityFile) != 0 && len(st.KnownHostsFile) != 0) {
+		return nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	if len(st.IdentityFile) == 0 {
+		st.IdentityFile = filepath.Join(home, ".ssh", "id_ed25519")
+	}
+	if len(st.KnownHostsFile) == 0 {
+		st.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return nil
+}
+
 func loadConfig() (*config, error) {
 	configPath := filepath.Join(defaultHomeDir, "multus.conf")
 	configFile, err := ioutil.ReadFile(configPath)
@@ -42,12 +100,43 @@ func loadConfig() (*config, error) {
 
 	cfg := config{
 		Backup: BackupConfig{
-			GZLevel: gzip.DefaultCompression,
+			Compression: CompressionGzip.String(),
+			GZLevel:     gzip.DefaultCompression,
 		},
 	}
 	if err = yaml.UnmarshalStrict(configFile, &cfg); err != nil {
 		return nil, err
 	}
+	cfg.Backup.compression, err = ParseCompression(cfg.Backup.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Backup.ChunkKeyFile) == 0 {
+		cfg.Backup.ChunkKeyFile = filepath.Join(defaultHomeDir, "chunk.key")
+	}
+	if len(cfg.Backup.HostKeyFile) == 0 {
+		cfg.Backup.HostKeyFile = filepath.Join(defaultHomeDir, "host.key")
+	}
+	if cfg.Backup.CompressionThreads <= 0 {
+		cfg.Backup.CompressionThreads = runtime.NumCPU()
+	}
+	if len(cfg.Backup.Rotation.MonthlyWeekday) != 0 {
+		cfg.Backup.Rotation.weekday, err = parseWeekday(cfg.Backup.Rotation.MonthlyWeekday)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = storageDefaults(&cfg.Backup.Storage); err != nil {
+		return nil, err
+	}
+	if cfg.Restore.passphraseSources() > 1 {
+		return nil, errors.New("more than one passphrase source set")
+	}
+	if cfg.Restore.Storage != nil {
+		if err = storageDefaults(cfg.Restore.Storage); err != nil {
+			return nil, err
+		}
+	}
 	for _, exclude := range cfg.Backup.Excludes {
 		cfg.Backup.rExcludes = append(cfg.Backup.rExcludes,
 			regexp.MustCompile(exclude))
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/companyzero/multus/storage"
+	"github.com/jrick/ss/stream"
+)
+
+// consolidate merges levels 0 to level of a chain in the backup directory
+// into a new level 0 snapshot.  When the merged chain is the one tracked by
+// sig.cache, the cache is replaced so later runs continue from the new chain.
+func consolidate(ctx context.Context, secretKey *stream.SecretKey, pubKeys []*stream.PublicKey, cfg *config, level int32) error {
+	if !cfg.Backup.Storage.IsLocal() {
+		return fmt.Errorf("consolidate needs local storage, not %v", cfg.Backup.Storage.Type)
+	}
+	destDir := filepath.Clean(cfg.BackupPath)
+
+	gid, err := lookupGroup(cfg.Backup.Group)
+	if err != nil {
+		return err
+	}
+	uid := os.Geteuid()
+
+	repo, err := openRepository(&cfg.Backup.Storage, destDir, cfg.Restore.TempDir)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	insts, err := SnapshotList(secretKey, repo.store)
+	if err != nil {
+		return err
+	}
+	chain, err := selectChain(insts, level)
+	if err != nil {
+		return err
+	}
+	last := chain[len(chain)-1]
+
+	scratch, err := ioutil.TempDir(destDir, ".consolidate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	log.Printf("----------  CONSOLIDATING LEVELS 0-%d (%v %v) -----------", last.Increment, last.Timestamp, last.ChainID)
+	startTime := time.Now()
+	attribs := make(map[string]FileAttributes)
+	err = restoreChain(ctx, secretKey, repo, chain, scratch, nil, attribs)
+	if err != nil {
+		return err
+	}
+
+	hostKey, err := LoadHostKey(cfg.Backup.HostKeyFile)
+	if err != nil {
+		return err
+	}
+	store, err := storage.NewLocal(destDir, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	id, err := newChainID()
+	if err != nil {
+		return err
+	}
+	sc := NewSignatureCache(id, last.Hostname, time.Now(), last.Differential)
+
+	snap, err := NewSnapshot(pubKeys, store, cfg.Backup.compression, cfg.Backup.GZLevel,
+		cfg.Backup.CompressionThreads, sc.chainID, sc.hostname, sc.timeStamp, 0, sc.differential, sc.version)
+	if err != nil {
+		return err
+	}
+
+	var chunks *ChunkStore
+	if cfg.Backup.Dedup {
+		chunkKey, err := LoadChunkKey(cfg.Backup.ChunkKeyFile)
+		if err != nil {
+			snap.Abort()
+			return err
+		}
+		chunks = NewChunkStore(store, pubKeys, chunkKey, cfg.Backup.compression, cfg.Backup.GZLevel)
+	}
+
+	// Parent directories are added before their contents.
+	paths := make([]string, 0, len(attribs))
+	for path := range attribs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			md := &Metadata{Path: path, Attribs: attribs[path]}
+			err = consolidateEntry(snap, sc, chunks, md, filepath.Join(scratch, path))
+		}
+		if err != nil {
+			snap.Abort()
+			return err
+		}
+	}
+
+	if err = snap.Close(); err != nil {
+		return err
+	}
+	bytesWritten := snap.BytesWritten()
+	if chunks != nil {
+		if err = chunks.WriteRefs(refsFileName(snap.Name())); err != nil {
+			store.Remove(snap.Name())
+			return err
+		}
+		bytesWritten += chunks.BytesWritten()
+	}
+	if err = writeManifest(store, snap, hostKey); err != nil {
+		store.Remove(snap.Name())
+		if chunks != nil {
+			store.Remove(refsFileName(snap.Name()))
+		}
+		return err
+	}
+	sc.baseSize = uint64(bytesWritten)
+	log.Printf("%q: %d files consolidated", snap.Name(), len(paths))
+
+	sigFile := filepath.Join(destDir, "sig.cache")
+	current, err := LoadSignatureCache(sigFile, ^uint16(0))
+	if err != nil {
+		return err
+	}
+	if current.Len() != 0 && current.chainID == last.ChainID {
+		if current.instance != last.Increment {
+			log.Printf("%q: chain continues past level %d, later runs restart from the consolidated chain",
+				sigFile, last.Increment)
+		}
+		if err = sc.WriteFile(sigFile); err != nil {
+			return err
+		}
+		if err = os.Chown(sigFile, uid, gid); err != nil {
+			log.Printf("%v", err)
+		}
+	} else {
+		log.Printf("%q: tracks another chain, not replaced", sigFile)
+	}
+
+	log.Printf("completed: duration:%v bytes written:%d", time.Since(startTime), bytesWritten)
+	return nil
+}
+
+// consolidateEntry adds the restored copy of md at scratchPath to snap as a
+// full entry.
+func consolidateEntry(snap *Snapshot, sc *SignatureCache, chunks *ChunkStore, md *Metadata, scratchPath string) error {
+	fileMode := os.FileMode(md.Attribs.Mode)
+	switch {
+	case isSocket(fileMode):
+		return nil
+	case isSymlink(fileMode):
+		dest, err := os.Readlink(scratchPath)
+		if err != nil {
+			return err
+		}
+		dataReader := bytes.NewReader([]byte(dest))
+		fingerprint, err := GenFingerprint(md, dataReader)
+		if err != nil {
+			return err
+		}
+		sig, err := signatureFromReader(dataReader)
+		if err != nil {
+			return err
+		}
+		if err = snap.Add(md, 0, dataReader, int64(dataReader.Len())); err != nil {
+			return err
+		}
+		sc.Add(md.Path, fingerprint, sig)
+		return nil
+	case fileMode.IsRegular():
+		fd, err := os.Open(scratchPath)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		fingerprint, err := GenFingerprint(md, fd)
+		if err != nil {
+			return err
+		}
+		if chunks != nil {
+			refs, err := chunks.Store(fd)
+			if err != nil {
+				return err
+			}
+			if err = snap.Add(md, entryChunked, bytes.NewReader(refs), int64(len(refs))); err != nil {
+				return err
+			}
+			sc.Add(md.Path, fingerprint, nil)
+			return nil
+		}
+		sig, err := signatureFromReader(fd)
+		if err != nil {
+			return err
+		}
+		st, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		if err = snap.Add(md, 0, fd, st.Size()); err != nil {
+			return err
+		}
+		sc.Add(md.Path, fingerprint, sig)
+		return nil
+	default:
+		fingerprint, err := GenFingerprint(md, nil)
+		if err != nil {
+			return err
+		}
+		if err = snap.Add(md, 0, nil, 0); err != nil {
+			return err
+		}
+		sc.Add(md.Path, fingerprint, nil)
+		return nil
+	}
+}
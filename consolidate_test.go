@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jrick/ss/stream"
+)
+
+func TestConsolidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	backupDir := filepath.Join(dir, "backup")
+	if err = os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pk, sk := testKeys(t)
+	cfg := testConfig(t, backupDir, srcDir)
+
+	file := filepath.Join(srcDir, "sub", "file")
+	link := filepath.Join(srcDir, "link")
+	basis := testData(t, 1<<17)
+	if err = ioutil.WriteFile(file, basis, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("sub", link); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	newData := append(append([]byte{}, basis[:1<<16]...), []byte("inserted")...)
+	newData = append(newData, basis[1<<16:]...)
+	if err = ioutil.WriteFile(file, newData, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("sub/file", link); err != nil {
+		t.Fatal(err)
+	}
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	oldChain, err := filepath.Glob(filepath.Join(backupDir, "*.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oldChain) != 2 {
+		t.Fatalf("expected 2 increments, got %d", len(oldChain))
+	}
+
+	if err = consolidate(ctx, sk, []*stream.PublicKey{pk}, cfg, -1); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := LoadSignatureCache(filepath.Join(backupDir, "sig.cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Instance() != 0 {
+		t.Fatalf("expected consolidated cache at level 0, got %d", sc.Instance())
+	}
+	consolidated := filepath.Join(backupDir, snapshotFileName(sc.chainID, sc.hostname, sc.timeStamp, 0, cfg.Backup.compression))
+	if _, err = os.Stat(consolidated); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unchanged tree continues the consolidated chain.
+	if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(backupDir, snapshotFileName(sc.chainID, sc.hostname, sc.timeStamp, 1, cfg.Backup.compression))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range oldChain {
+		if err = os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restoreDir := filepath.Join(dir, "restore")
+	if err = restore(ctx, sk, testRepo(t, backupDir), restoreDir, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(restoreDir, srcDir)
+	b, err := ioutil.ReadFile(filepath.Join(restored, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, newData) {
+		t.Fatalf("consolidated file content mismatch")
+	}
+	dest, err := os.Readlink(filepath.Join(restored, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != "sub/file" {
+		t.Fatalf("symlink mismatch: %q", dest)
+	}
+}
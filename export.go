@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/companyzero/multus/storage"
+	"github.com/jrick/ss/stream"
+)
+
+// exportTar writes the state of a chain at level to w as a tar archive,
+// compressed with zstd when compress is set.
+func exportTar(ctx context.Context, secretKey *stream.SecretKey, repo *repository, w io.Writer, level int32,
+	compress bool) error {
+
+	insts, err := SnapshotList(secretKey, repo.store)
+	if err != nil {
+		return err
+	}
+	chain, err := selectChain(insts, level)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exporting level %d...", chain[len(chain)-1].Increment)
+	startTime := time.Now()
+	if !compress {
+		err = writeTar(ctx, secretKey, repo, chain, w, nil)
+	} else {
+		var zw io.WriteCloser
+		zw, err = newCompressor(w, CompressionZstd, 0, 1)
+		if err != nil {
+			return err
+		}
+		err = writeTar(ctx, secretKey, repo, chain, zw, nil)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("completed in %v", time.Since(startTime))
+	return nil
+}
+
+// tarReader returns a reader of the tar archive in r, which may be gzip or
+// zstd compressed.
+func tarReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return newDecompressor(br, CompressionGzip)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return newDecompressor(br, CompressionZstd)
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// tarMetadata returns the metadata of a tar entry.
+func tarMetadata(hdr *tar.Header) *Metadata {
+	md := &Metadata{
+		Path: path.Clean("/" + hdr.Name),
+		Attribs: FileAttributes{
+			Size: hdr.Size,
+			MTim: hdr.ModTime.UnixNano(),
+			Mode: uint32(hdr.FileInfo().Mode()),
+			UID:  uint32(hdr.Uid),
+			GID:  uint32(hdr.Gid),
+		},
+	}
+	switch hdr.Typeflag {
+	case tar.TypeChar, tar.TypeBlock:
+		md.Attribs.RDev = makedev(uint64(hdr.Devmajor), uint64(hdr.Devminor))
+	case tar.TypeSymlink:
+		md.Attribs.Size = int64(len(hdr.Linkname))
+	}
+	return md
+}
+
+// rereadable returns the archive in r as a reader from its start when it can
+// be read again, as a regular file or an in-memory archive can.
+func rereadable(r io.Reader) *io.SectionReader {
+	switch r := r.(type) {
+	case *os.File:
+		st, err := r.Stat()
+		if err != nil || !st.Mode().IsRegular() {
+			return nil
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil
+		}
+		return io.NewSectionReader(r, offset, st.Size()-offset)
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return io.NewSectionReader(r, 0, r.Size())
+	}
+	return nil
+}
+
+// tarEntry returns the content of the n-th regular file named name, counting
+// from 1, in the archive in r.
+func tarEntry(r *io.SectionReader, name string, n int) (io.ReadCloser, int64, error) {
+	tr, err := tarReader(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		return nil, 0, err
+	}
+	archive := tar.NewReader(tr)
+	for {
+		hdr, err := archive.Next()
+		if err != nil {
+			tr.Close()
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%q: not found rereading the archive", name)
+			}
+			return nil, 0, err
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Clean("/"+hdr.Name) != name {
+			continue
+		}
+		if n--; n == 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{archive, tr}, hdr.Size, nil
+		}
+	}
+}
+
+// importTar writes the tar archive in r as level 0 of a new chain for
+// hostname started at timeStamp.  The chain stands beside the one sig.cache
+// tracks, so backups carry on with theirs.  Hard links are imported as
+// copies of their target: with dedup as references to its chunks, without
+// from the target's entry, read again from the start of the archive.  An
+// archive read from a pipe cannot be read again, so without dedup its hard
+// links are skipped.
+func importTar(ctx context.Context, pubKeys []*stream.PublicKey, cfg *config, r io.Reader, hostname string,
+	timeStamp time.Time) error {
+
+	destDir := filepath.Clean(cfg.BackupPath)
+	gid, err := lookupGroup(cfg.Backup.Group)
+	if err != nil {
+		return err
+	}
+	uid := os.Geteuid()
+	if err = os.MkdirAll(destDir, 0750); err != nil {
+		return err
+	}
+	if err = os.Chown(destDir, uid, gid); err != nil {
+		return err
+	}
+	id, err := newChainID()
+	if err != nil {
+		return err
+	}
+	hostKey, err := LoadHostKey(cfg.Backup.HostKeyFile)
+	if err != nil {
+		return err
+	}
+	store, err := storage.Open(&cfg.Backup.Storage, destDir, uid, gid)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	tr, err := tarReader(r)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	log.Printf("importing to %v (%v %v %v)", store.Location(), hostname, timeStamp, id)
+	snap, err := NewSnapshot(pubKeys, store, cfg.Backup.compression, cfg.Backup.GZLevel,
+		cfg.Backup.CompressionThreads, id, hostname, timeStamp, 0, false, FormatVersion)
+	if err != nil {
+		return err
+	}
+	var chunks *ChunkStore
+	if cfg.Backup.Dedup {
+		chunkKey, err := LoadChunkKey(cfg.Backup.ChunkKeyFile)
+		if err != nil {
+			snap.Abort()
+			return err
+		}
+		chunks = NewChunkStore(store, pubKeys, chunkKey, cfg.Backup.compression, cfg.Backup.GZLevel)
+	}
+
+	startTime := time.Now()
+	var imported, skipped int
+	dirs := map[string]bool{"/": true}
+	links := make(map[string][]byte)
+	// files counts the regular files of each path read so far, which
+	// picks the entry a hard link refers to when an archive holds a path
+	// more than once.
+	files := make(map[string]int)
+	src := rereadable(r)
+	err = func() error {
+		archive := tar.NewReader(tr)
+		for {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			hdr, err := archive.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			md := tarMetadata(hdr)
+
+			// Restores only create the directories they have
+			// entries for.
+			var missing []string
+			for parent := path.Dir(md.Path); !dirs[parent]; parent = path.Dir(parent) {
+				missing = append(missing, parent)
+			}
+			for i := len(missing) - 1; i >= 0; i-- {
+				log.Printf("%q: adding missing directory", missing[i])
+				dir := &Metadata{Path: missing[i], Attribs: md.Attribs}
+				dir.Attribs.Size = 0
+				dir.Attribs.RDev = 0
+				dir.Attribs.Mode = uint32(os.ModeDir | 0755)
+				if err = snap.Add(dir, 0, nil, 0); err != nil {
+					return err
+				}
+				dirs[missing[i]] = true
+			}
+
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				dirs[md.Path] = true
+				fallthrough
+			case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+				err = snap.Add(md, 0, nil, 0)
+			case tar.TypeSymlink:
+				err = snap.Add(md, 0, bytes.NewReader([]byte(hdr.Linkname)), md.Attribs.Size)
+			case tar.TypeReg:
+				if chunks == nil {
+					files[md.Path]++
+					err = snap.Add(md, 0, archive, hdr.Size)
+					break
+				}
+				var refs []byte
+				if refs, err = chunks.Store(archive); err != nil {
+					return err
+				}
+				links[md.Path] = refs
+				err = snap.Add(md, entryChunked, bytes.NewReader(refs), int64(len(refs)))
+			case tar.TypeLink:
+				target := path.Clean("/" + hdr.Linkname)
+				if n := files[target]; n != 0 {
+					if src == nil {
+						log.Printf("%q: skipping hard link to %q, the archive cannot be read again",
+							md.Path, hdr.Linkname)
+						skipped++
+						continue
+					}
+					var content io.ReadCloser
+					content, md.Attribs.Size, err = tarEntry(src, target, n)
+					if err != nil {
+						return err
+					}
+					err = snap.Add(md, 0, content, md.Attribs.Size)
+					content.Close()
+					break
+				}
+				refs, ok := links[target]
+				if !ok {
+					log.Printf("%q: skipping hard link to %q, not a file of the archive", md.Path, hdr.Linkname)
+					skipped++
+					continue
+				}
+				var chunkRefs []ChunkRef
+				if chunkRefs, err = ParseChunkRefs(refs); err != nil {
+					return err
+				}
+				md.Attribs.Size = 0
+				for _, ref := range chunkRefs {
+					md.Attribs.Size += int64(ref.Len)
+				}
+				err = snap.Add(md, entryChunked, bytes.NewReader(refs), int64(len(refs)))
+			default:
+				log.Printf("%q: skipping unsupported tar entry type %q", md.Path, hdr.Typeflag)
+				skipped++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%q: %v", md.Path, err)
+			}
+			imported++
+		}
+	}()
+	if err != nil {
+		snap.Abort()
+		return err
+	}
+
+	if err = snap.Close(); err != nil {
+		return err
+	}
+	bytesWritten := snap.BytesWritten()
+	if chunks != nil {
+		if err = chunks.WriteRefs(refsFileName(snap.Name())); err != nil {
+			store.Remove(snap.Name())
+			return err
+		}
+		bytesWritten += chunks.BytesWritten()
+	}
+	if err = writeManifest(store, snap, hostKey); err != nil {
+		store.Remove(snap.Name())
+		if chunks != nil {
+			store.Remove(refsFileName(snap.Name()))
+		}
+		return err
+	}
+	log.Printf("completed: duration:%v bytes written:%d entries:%d skipped:%d",
+		time.Since(startTime), bytesWritten, imported, skipped)
+	return nil
+}
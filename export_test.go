@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jrick/ss/stream"
+)
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir, backupDir, sk := testTree(t, dir, false)
+	ctx := context.Background()
+	var plain, compressed bytes.Buffer
+	if err = exportTar(ctx, sk, testRepo(t, backupDir), &plain, -1, false); err != nil {
+		t.Fatal(err)
+	}
+	checkTar(t, plain.Bytes(), srcDir)
+	if err = exportTar(ctx, sk, testRepo(t, backupDir), &compressed, -1, true); err != nil {
+		t.Fatal(err)
+	}
+	r, err := tarReader(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTar(t, b, srcDir)
+
+	for _, dedup := range []bool{false, true} {
+		importDir := filepath.Join(dir, "import")
+		os.RemoveAll(importDir)
+		pk2, sk2 := testKeys(t)
+		cfg := testConfig(t, importDir)
+		if dedup {
+			cfg.Backup.Dedup = true
+			cfg.Backup.ChunkKeyFile = filepath.Join(dir, "chunk.key")
+		}
+		ts := time.Date(2019, 5, 4, 3, 2, 0, 0, time.Local)
+		if err = importTar(ctx, []*stream.PublicKey{pk2}, cfg, bytes.NewReader(plain.Bytes()), "old", ts); err != nil {
+			t.Fatal(err)
+		}
+		insts, err := SnapshotList(sk2, testRepo(t, importDir).store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(insts) != 1 || insts[0].Hostname != "old" || !insts[0].Timestamp.Equal(ts) || insts[0].Increment != 0 {
+			t.Fatalf("unexpected chain %+v", insts)
+		}
+		var out bytes.Buffer
+		if err = exportTar(ctx, sk2, testRepo(t, importDir), &out, -1, false); err != nil {
+			t.Fatal(err)
+		}
+		checkTar(t, out.Bytes(), srcDir)
+		if _, err = os.Stat(filepath.Join(importDir, "sig.cache")); !os.IsNotExist(err) {
+			t.Fatalf("import wrote sig.cache: %v", err)
+		}
+	}
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("hard linked")
+	mtime := time.Unix(1500000000, 123000000)
+	// a, a/b and dev are missing from the archive.
+	entries := []*tar.Header{
+		{Name: "a/b/file", Typeflag: tar.TypeReg, Mode: 0640, Size: int64(len(data))},
+		{Name: "a/b/link", Typeflag: tar.TypeLink, Linkname: "a/b/file", Mode: 0640},
+		{Name: "a/sym", Typeflag: tar.TypeSymlink, Linkname: "b/file", Mode: 0777},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "dev/fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+	}
+	archive := func(compress bool) []byte {
+		var buf bytes.Buffer
+		w := io.Writer(&buf)
+		gz := gzip.NewWriter(&buf)
+		if compress {
+			w = gz
+		}
+		tw := tar.NewWriter(w)
+		for _, hdr := range entries {
+			hdr.Uid, hdr.Gid, hdr.ModTime, hdr.Format = 1234, 5678, mtime, tar.FormatPAX
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				tw.Write(data)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		dedup    bool
+		compress bool
+		// pipe reads the archive from a reader that cannot be read
+		// again.
+		pipe bool
+	}{
+		{name: "plain"},
+		{name: "gzip", compress: true},
+		{name: "pipe", pipe: true},
+		{name: "dedup", dedup: true},
+		{name: "dedup pipe", dedup: true, compress: true, pipe: true},
+	}
+	for _, test := range tests {
+		backupDir := filepath.Join(dir, "backup")
+		os.RemoveAll(backupDir)
+		pk, sk := testKeys(t)
+		cfg := testConfig(t, backupDir)
+		cfg.Backup.Dedup = test.dedup
+		cfg.Backup.ChunkKeyFile = filepath.Join(dir, "chunk.key")
+		var r io.Reader = bytes.NewReader(archive(test.compress))
+		if test.pipe {
+			r = struct{ io.Reader }{r}
+		}
+		if err = importTar(context.Background(), []*stream.PublicKey{pk}, cfg, r, "h", mtime); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		var out bytes.Buffer
+		if err = exportTar(context.Background(), sk, testRepo(t, backupDir), &out, -1, false); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		got := make(map[string]*tar.Header)
+		content := make(map[string]string)
+		tr := tar.NewReader(&out)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			got[hdr.Name], content[hdr.Name] = hdr, string(b)
+		}
+
+		for _, name := range []string{"a/", "a/b/", "dev/"} {
+			hdr := got[name]
+			if hdr == nil || hdr.Typeflag != tar.TypeDir || hdr.Mode != 0755 {
+				t.Fatalf("%v: missing parent %v: %+v", test.name, name, hdr)
+			}
+		}
+		for _, want := range entries {
+			hdr := got[want.Name]
+			if hdr == nil {
+				if want.Typeflag == tar.TypeLink && test.pipe && !test.dedup {
+					continue
+				}
+				t.Fatalf("%v: %v not exported", test.name, want.Name)
+			}
+			typ := want.Typeflag
+			if typ == tar.TypeLink {
+				typ = tar.TypeReg
+			}
+			if hdr.Typeflag != typ || hdr.Mode != want.Mode || hdr.Uid != 1234 || hdr.Gid != 5678 ||
+				!hdr.ModTime.Equal(mtime) || hdr.Devmajor != want.Devmajor || hdr.Devminor != want.Devminor {
+				t.Fatalf("%v: %v exported as %+v", test.name, want.Name, hdr)
+			}
+			switch want.Typeflag {
+			case tar.TypeReg, tar.TypeLink:
+				if content[want.Name] != string(data) {
+					t.Fatalf("%v: %v content %q", test.name, want.Name, content[want.Name])
+				}
+			case tar.TypeSymlink:
+				if hdr.Linkname != want.Linkname {
+					t.Fatalf("%v: %v links to %q", test.name, want.Name, hdr.Linkname)
+				}
+			}
+		}
+		if test.pipe && !test.dedup && got["a/b/link"] != nil {
+			t.Fatalf("%v: hard link imported from a pipe", test.name)
+		}
+	}
+}
+
+func TestTarEntry(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, b := range []string{"first", "second"} {
+		tw.WriteHeader(&tar.Header{Name: "./f", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(b))})
+		tw.Write([]byte(b))
+	}
+	tw.Close()
+	src := rereadable(bytes.NewReader(buf.Bytes()))
+	for n, want := range []string{"first", "second"} {
+		r, size, err := tarEntry(src, "/f", n+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(b) != want || size != int64(len(want)) {
+			t.Fatalf("entry %d: %q %d %v", n+1, b, size, err)
+		}
+	}
+	if _, _, err := tarEntry(src, "/f", 3); err == nil {
+		t.Fatal("found a third entry")
+	}
+	if rereadable(struct{ io.Reader }{&buf}) != nil {
+		t.Fatal("pipe read again")
+	}
+}
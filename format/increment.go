@@ -0,0 +1,31 @@
+package format
+
+import "strings"
+
+// incrementExts are the extensions of increments, named after the codec
+// compressing them.  Increments written without compression end in .enc
+// only, so it has to be tried last.
+var incrementExts = []string{".gz.enc", ".zst.enc", ".lz4.enc", ".enc"}
+
+// IncrementExt returns the extension of increments compressed with codec,
+// the file extension of the codec such as ".gz" or "" for none.
+func IncrementExt(codec string) string {
+	return codec + ".enc"
+}
+
+// TrimIncrementExt returns name without its increment extension and whether
+// name has one.
+func TrimIncrementExt(name string) (string, bool) {
+	for _, ext := range incrementExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), true
+		}
+	}
+	return name, false
+}
+
+// IsIncrement reports whether name has the extension of an increment.
+func IsIncrement(name string) bool {
+	_, ok := TrimIncrementExt(name)
+	return ok
+}
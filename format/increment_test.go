@@ -0,0 +1,26 @@
+package format
+
+import "testing"
+
+func TestTrimIncrementExt(t *testing.T) {
+	tests := []struct {
+		name string
+		base string
+		ok   bool
+	}{
+		{"202001010000-h.0.gz.enc", "202001010000-h.0", true},
+		{"202001010000-h.0.zst.enc", "202001010000-h.0", true},
+		{"202001010000-h.0.lz4.enc", "202001010000-h.0", true},
+		{"202001010000-h.0.enc", "202001010000-h.0", true},
+		{"202001010000-h.0.refs", "202001010000-h.0.refs", false},
+	}
+	for _, test := range tests {
+		base, ok := TrimIncrementExt(test.name)
+		if base != test.base || ok != test.ok {
+			t.Errorf("%q: got %q %v, want %q %v", test.name, base, ok, test.base, test.ok)
+		}
+		if ok && ManifestName(test.name) != test.base+".manifest" {
+			t.Errorf("%q: manifest %q", test.name, ManifestName(test.name))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package format defines the files multus writes to a repository that the
+// agent reads as well, so both sides share one definition of them.
+package format
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ChainID identifies a chain.  It is chosen at random when level 0 is
+// written and carried by every increment of the chain.
+type ChainID [16]byte
+
+func (id ChainID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Manifest describes an increment without the secret key.  It is stored
+// unencrypted next to the increment and signed with the host key, so the
+// agent can check increments it pulled.
+type Manifest struct {
+	Version      uint16
+	Hostname     string
+	Timestamp    time.Time
+	ChainID      ChainID
+	Increment    uint16
+	Differential bool
+	// Size and SHA256 describe the encrypted increment file.
+	Size    int64
+	SHA256  [sha256.Size]byte
+	Created time.Time
+}
+
+// manifestFixed is the size of a manifest without the hostname.
+const manifestFixed = 2 + 1 + 8 + 16 + 2 + 1 + 8 + sha256.Size + 8
+
+// ErrManifestSignature is returned for manifests not signed by the host key.
+var ErrManifestSignature = errors.New("invalid manifest signature")
+
+func (m *Manifest) Serialize() []byte {
+	buf := make([]byte, manifestFixed+len(m.Hostname))
+
+	offset := 0
+	binary.LittleEndian.PutUint16(buf[offset:offset+2], m.Version)
+	offset += 2
+	buf[offset] = byte(len(m.Hostname))
+	offset++
+	copy(buf[offset:offset+len(m.Hostname)], m.Hostname)
+	offset += len(m.Hostname)
+	binary.LittleEndian.PutUint64(buf[offset:offset+8], uint64(m.Timestamp.Unix()))
+	offset += 8
+	copy(buf[offset:offset+16], m.ChainID[:])
+	offset += 16
+	binary.LittleEndian.PutUint16(buf[offset:offset+2], m.Increment)
+	offset += 2
+	if m.Differential {
+		buf[offset] = 1
+	}
+	offset++
+	binary.LittleEndian.PutUint64(buf[offset:offset+8], uint64(m.Size))
+	offset += 8
+	copy(buf[offset:offset+sha256.Size], m.SHA256[:])
+	offset += sha256.Size
+	binary.LittleEndian.PutUint64(buf[offset:offset+8], uint64(m.Created.Unix()))
+	return buf
+}
+
+// Sign returns the manifest followed by its signature.
+func (m *Manifest) Sign(key ed25519.PrivateKey) []byte {
+	body := m.Serialize()
+	return append(body, ed25519.Sign(key, body)...)
+}
+
+// ParseManifest parses a signed manifest.  The signature is checked when key
+// is not nil.
+func ParseManifest(b []byte, key ed25519.PublicKey) (*Manifest, error) {
+	if len(b) < manifestFixed+ed25519.SignatureSize {
+		return nil, errors.New("manifest too short")
+	}
+	hostLen := int(b[2])
+	if len(b) != manifestFixed+hostLen+ed25519.SignatureSize {
+		return nil, errors.New("invalid manifest length")
+	}
+	body := b[:manifestFixed+hostLen]
+	if key != nil && !ed25519.Verify(key, body, b[len(body):]) {
+		return nil, ErrManifestSignature
+	}
+
+	m := &Manifest{}
+	offset := 0
+	m.Version = binary.LittleEndian.Uint16(body[offset : offset+2])
+	offset += 3
+	m.Hostname = string(body[offset : offset+hostLen])
+	offset += hostLen
+	m.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(body[offset:offset+8])), 0)
+	offset += 8
+	copy(m.ChainID[:], body[offset:offset+16])
+	offset += 16
+	m.Increment = binary.LittleEndian.Uint16(body[offset : offset+2])
+	offset += 2
+	m.Differential = body[offset] != 0
+	offset++
+	m.Size = int64(binary.LittleEndian.Uint64(body[offset : offset+8]))
+	offset += 8
+	copy(m.SHA256[:], body[offset:offset+sha256.Size])
+	offset += sha256.Size
+	m.Created = time.Unix(int64(binary.LittleEndian.Uint64(body[offset:offset+8])), 0)
+	return m, nil
+}
+
+// ManifestName returns the name of the manifest belonging to an increment.
+func ManifestName(increment string) string {
+	base, _ := TrimIncrementExt(increment)
+	return base + ".manifest"
+}
@@ -0,0 +1,51 @@
+package format
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{
+		Version:      8,
+		Hostname:     "host",
+		Timestamp:    time.Unix(1600000000, 0),
+		ChainID:      ChainID{1, 2, 3},
+		Increment:    3,
+		Differential: true,
+		Size:         12345,
+		SHA256:       sha256.Sum256([]byte("increment")),
+		Created:      time.Unix(1600000100, 0),
+	}
+	b := m.Sign(key)
+	got, err := ParseManifest(b, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Serialize(), m.Serialize()) {
+		t.Fatalf("manifest mismatch: %+v", got)
+	}
+	if _, err = ParseManifest(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err = ParseManifest(b, other); err != ErrManifestSignature {
+		t.Fatalf("unexpected error %v", err)
+	}
+	b[len(b)-ed25519.SignatureSize-1] ^= 1
+	if _, err = ParseManifest(b, pub); err != ErrManifestSignature {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err = ParseManifest(b[:len(b)-1], pub); err == nil {
+		t.Fatal("truncated manifest parsed")
+	}
+}
@@ -0,0 +1,42 @@
+package format
+
+import (
+	"crypto/sha512"
+
+	"github.com/jrick/ss/stream"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The header of a file encrypted to several public keys starts with
+// RecipientsScheme and the number of recipients.  For every recipient it
+// holds the fingerprint of the public key, an ss key encapsulation and the
+// file key sealed with the encapsulated shared key.  It ends with
+// RecipientsScheme again and a random file id, the associated data of the
+// stream and of the sealed file keys, so recipients are added or removed
+// without encrypting the file again.  The scheme follows the key schemes of
+// ss, so other headers are read by stream.ReadHeader.
+const (
+	RecipientsScheme = 0x80
+	// MaxRecipients is the number of recipients a header can hold.
+	MaxRecipients = 255
+	// RecipientsFixed is the scheme and recipient count.
+	RecipientsFixed = 2
+	// FileIDSize is the size of the random file id.
+	FileIDSize = 16
+	// RecipientsADSize is the scheme and file id closing the header.
+	RecipientsADSize = 1 + FileIDSize
+
+	// TagSize is the poly1305 tag of every sealed message.
+	TagSize = 16
+	// FingerprintSize is the size of the SHA512 of a public key.
+	FingerprintSize = sha512.Size
+	CiphertextSize  = len(stream.Ciphertext{})
+	WrappedKeySize  = chacha20poly1305.KeySize + TagSize
+	RecipientSize   = FingerprintSize + CiphertextSize + WrappedKeySize
+)
+
+// RecipientsHeaderSize returns the size of a recipients header for n
+// recipients.
+func RecipientsHeaderSize(n int) int64 {
+	return RecipientsFixed + int64(n)*int64(RecipientSize) + RecipientsADSize
+}
@@ -3,7 +3,12 @@ module github.com/companyzero/multus
 go 1.13
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
 	github.com/jrick/ss v0.7.1
+	github.com/klauspost/compress v1.10.10
+	github.com/klauspost/pgzip v1.2.4
+	github.com/pierrec/lz4/v4 v4.0.3
+	github.com/pkg/sftp v1.11.0
 	github.com/silvasur/golibrsync v0.0.0-20171002182919-c00c43c28b3f
 	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
 	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/jrick/ss/stream"
+	"github.com/silvasur/golibrsync/librsync"
+)
+
+// maxMemoryContent is the size up to which opened files are held in memory,
+// larger ones are staged in an unlinked temporary file in the temporary
+// directory of the repository.
+const maxMemoryContent = 32 << 20
+
+// recordRef locates a record in the decrypted increments of a chain.
+type recordRef struct {
+	// Increment indexes the chain.
+	Increment int
+	Offset    int64
+	// Len is the size of the record data.
+	Len int64
+}
+
+// indexEntry is the final state of a path in a chain.  Files and symlinks
+// refer to their last full record and the deltas that apply on top of it.
+type indexEntry struct {
+	Path    string
+	Attribs FileAttributes
+	Base    recordRef
+	Deltas  []recordRef
+	// Children are the sorted names of the entries of a directory.
+	Children []string
+}
+
+// chainIndex locates every path of a chain level in its increments so
+// content is only read, and deltas only applied, when a file is opened.
+type chainIndex struct {
+	secretKey *stream.SecretKey
+	repo      *repository
+	chain     IncrementalFiles
+	chunks    *chunkReader
+	entries   map[string]*indexEntry
+
+	// mu serializes reads of the records.  An increment stays open
+	// after a read, so the records that follow are reached without
+	// decrypting it again.
+	mu      sync.Mutex
+	readers map[int]*SnapshotReader
+	last    map[int]int64
+}
+
+// buildIndex reads the increments of chain and indexes the final state of
+// its paths.  Directories missing from the chain are added read-only.
+func buildIndex(ctx context.Context, secretKey *stream.SecretKey, repo *repository,
+	chain IncrementalFiles) (*chainIndex, error) {
+
+	idx := &chainIndex{
+		secretKey: secretKey,
+		repo:      repo,
+		chain:     chain,
+		chunks:    repo.chunkReader(secretKey),
+		entries:   make(map[string]*indexEntry),
+		readers:   make(map[int]*SnapshotReader),
+		last:      make(map[int]int64),
+	}
+	for i := range chain {
+		sr, err := openIncrement(secretKey, repo, &chain[i])
+		if err != nil {
+			return nil, err
+		}
+		for {
+			if ctx.Err() != nil {
+				sr.Close()
+				return nil, ctx.Err()
+			}
+			entry, err := sr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				sr.Close()
+				return nil, err
+			}
+			attrib := entry.Attribs
+			if attrib.IsEmpty() {
+				delete(idx.entries, entry.Path)
+				continue
+			}
+			ref := recordRef{Increment: i, Offset: entry.Offset, Len: int64(entry.DataLen)}
+			fileMode := os.FileMode(attrib.Mode)
+			if !fileMode.IsRegular() && !isSymlink(fileMode) {
+				idx.entries[entry.Path] = &indexEntry{Path: entry.Path, Attribs: attrib, Base: ref}
+				continue
+			}
+			if entry.Flags&entryDelta == 0 {
+				idx.entries[entry.Path] = &indexEntry{Path: entry.Path, Attribs: attrib, Base: ref}
+				continue
+			}
+			ie := idx.entries[entry.Path]
+			if ie == nil {
+				sr.Close()
+				return nil, fmt.Errorf("%q: no basis for delta", entry.Path)
+			}
+			ie.Attribs = attrib
+			ie.Deltas = append(ie.Deltas, ref)
+		}
+		if err = sr.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make([]string, 0, len(idx.entries))
+	for p := range idx.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		idx.link(p)
+	}
+	if _, ok := idx.entries["/"]; !ok {
+		idx.addDir("/")
+	}
+	for _, ie := range idx.entries {
+		sort.Strings(ie.Children)
+	}
+	return idx, nil
+}
+
+// link adds p to its parent directory, adding the parent when the chain has
+// no entry for it.
+func (idx *chainIndex) link(p string) {
+	if p == "/" {
+		return
+	}
+	parent := path.Dir(p)
+	dir, ok := idx.entries[parent]
+	if !ok {
+		dir = idx.addDir(parent)
+		idx.link(parent)
+	}
+	dir.Children = append(dir.Children, path.Base(p))
+}
+
+// addDir adds a read-only directory the chain has no entry for, dated from
+// the start of the chain.
+func (idx *chainIndex) addDir(p string) *indexEntry {
+	ie := &indexEntry{
+		Path: p,
+		Attribs: FileAttributes{
+			MTim: idx.chain[0].Timestamp.UnixNano(),
+			Mode: uint32(os.ModeDir | 0555),
+		},
+		Base: recordRef{Increment: -1},
+	}
+	idx.entries[p] = ie
+	return ie
+}
+
+// root returns the entry of /.
+func (idx *chainIndex) root() *indexEntry {
+	return idx.entries["/"]
+}
+
+// lookup returns the entry of name in dir.
+func (idx *chainIndex) lookup(dir *indexEntry, name string) (*indexEntry, bool) {
+	ie, ok := idx.entries[path.Join(dir.Path, name)]
+	return ie, ok
+}
+
+// record returns the record at ref.
+func (idx *chainIndex) record(ref recordRef) (*SnapshotEntry, error) {
+	sr := idx.readers[ref.Increment]
+	if sr != nil && ref.Offset <= idx.last[ref.Increment] {
+		sr.Close()
+		sr = nil
+	}
+	if sr == nil {
+		var err error
+		sr, err = openIncrement(idx.secretKey, idx.repo, &idx.chain[ref.Increment])
+		if err != nil {
+			return nil, err
+		}
+		idx.readers[ref.Increment] = sr
+		idx.last[ref.Increment] = -1
+	}
+	entry, err := sr.NextAt(ref.Offset)
+	if err != nil {
+		sr.Close()
+		delete(idx.readers, ref.Increment)
+		return nil, err
+	}
+	idx.last[ref.Increment] = ref.Offset
+	return entry, nil
+}
+
+// content returns the content of the file or symlink ie, its full record
+// with the deltas applied.  Only the records are read under idx.mu; chunks
+// are fetched and deltas applied outside it.
+func (idx *chainIndex) content(ie *indexEntry) (*fileContent, error) {
+	fc, refs, deltas, err := idx.records(ie)
+	if err != nil {
+		return nil, err
+	}
+	defer deltas.Close()
+
+	for _, ref := range refs {
+		if err = idx.chunks.WriteTo(fc, ref); err != nil {
+			fc.Close()
+			return nil, err
+		}
+	}
+	var offset int64
+	for _, ref := range ie.Deltas {
+		delta := io.NewSectionReader(deltas, offset, ref.Len)
+		offset += ref.Len
+		target, err := newFileContent(idx.repo.tempDir, ie.Attribs.Size)
+		if err == nil {
+			err = librsync.Patch(fc, delta, target)
+			if err != nil {
+				target.Close()
+			}
+		}
+		fc.Close()
+		if err != nil {
+			return nil, err
+		}
+		fc = target
+	}
+	return fc, nil
+}
+
+// records reads the records of ie.  It returns the data of the full record,
+// or the chunks that hold it, and the deltas one after the other.
+func (idx *chainIndex) records(ie *indexEntry) (*fileContent, []ChunkRef, *fileContent, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, err := idx.record(ie.Base)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var refs []ChunkRef
+	size := int64(entry.DataLen)
+	if entry.Flags&entryChunked != 0 {
+		b := make([]byte, entry.DataLen)
+		if _, err = io.ReadFull(entry.Data, b); err != nil {
+			return nil, nil, nil, err
+		}
+		if refs, err = ParseChunkRefs(b); err != nil {
+			return nil, nil, nil, err
+		}
+		size = 0
+		for _, ref := range refs {
+			size += int64(ref.Len)
+		}
+	}
+	fc, err := newFileContent(idx.repo.tempDir, size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if refs == nil {
+		if _, err = io.Copy(fc, entry.Data); err != nil {
+			fc.Close()
+			return nil, nil, nil, err
+		}
+	}
+
+	deltas, err := newFileContent(idx.repo.tempDir, 0)
+	if err != nil {
+		fc.Close()
+		return nil, nil, nil, err
+	}
+	for _, ref := range ie.Deltas {
+		entry, err := idx.record(ref)
+		if err == nil && entry.Path != ie.Path {
+			err = fmt.Errorf("%q: delta record holds %q", ie.Path, entry.Path)
+		}
+		if err == nil {
+			_, err = io.CopyN(deltas, entry.Data, ref.Len)
+		}
+		if err != nil {
+			fc.Close()
+			deltas.Close()
+			return nil, nil, nil, err
+		}
+	}
+	return fc, refs, deltas, nil
+}
+
+// Close closes the increments left open by reads.
+func (idx *chainIndex) Close() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for i, sr := range idx.readers {
+		sr.Close()
+		delete(idx.readers, i)
+	}
+}
+
+// fileContent is the content of an opened file, in memory or in an
+// unlinked temporary file in dir.
+type fileContent struct {
+	dir  string
+	buf  []byte
+	fd   *os.File
+	size int64
+}
+
+// newFileContent returns an empty fileContent for about size bytes, staged
+// in dir once it outgrows memory.
+func newFileContent(dir string, size int64) (*fileContent, error) {
+	fc := &fileContent{dir: dir}
+	if size <= maxMemoryContent {
+		fc.buf = make([]byte, 0, size)
+		return fc, nil
+	}
+	if err := fc.spill(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// spill moves the content to an unlinked temporary file.
+func (fc *fileContent) spill() error {
+	fd, err := ioutil.TempFile(fc.dir, "multus")
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(fd.Name()); err != nil {
+		fd.Close()
+		return err
+	}
+	if _, err = fd.Write(fc.buf); err != nil {
+		fd.Close()
+		return err
+	}
+	fc.fd = fd
+	fc.buf = nil
+	return nil
+}
+
+// Write appends p.  Content in memory moves to a temporary file once it
+// outgrows maxMemoryContent.
+func (fc *fileContent) Write(p []byte) (int, error) {
+	if fc.fd == nil && fc.size+int64(len(p)) > maxMemoryContent {
+		if err := fc.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if fc.fd == nil {
+		fc.buf = append(fc.buf, p...)
+		fc.size += int64(len(p))
+		return len(p), nil
+	}
+	n, err := fc.fd.WriteAt(p, fc.size)
+	fc.size += int64(n)
+	return n, err
+}
+
+// ReadAt reads the content at off.
+func (fc *fileContent) ReadAt(p []byte, off int64) (int, error) {
+	if fc.fd != nil {
+		return fc.fd.ReadAt(p, off)
+	}
+	if off >= fc.size {
+		return 0, io.EOF
+	}
+	n := copy(p, fc.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns the length of the content.
+func (fc *fileContent) Size() int64 {
+	return fc.size
+}
+
+// String returns the content, the target of a symlink.
+func (fc *fileContent) String() string {
+	if fc.fd == nil {
+		return string(fc.buf)
+	}
+	b := make([]byte, fc.size)
+	n, _ := fc.fd.ReadAt(b, 0)
+	return string(b[:n])
+}
+
+// Close releases the content.
+func (fc *fileContent) Close() error {
+	fc.buf = nil
+	if fc.fd == nil {
+		return nil
+	}
+	return fc.fd.Close()
+}
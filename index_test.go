@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jrick/ss/stream"
+)
+
+func TestIndexContent(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "multus")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcDir := filepath.Join(dir, "src")
+		backupDir := filepath.Join(dir, "backup")
+		if err = os.Mkdir(srcDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		pk, sk := testKeys(t)
+		cfg := testConfig(t, backupDir, srcDir)
+		if dedup {
+			cfg.Backup.Dedup = true
+			cfg.Backup.ChunkKeyFile = filepath.Join(dir, "chunk.key")
+		}
+
+		changed := filepath.Join(srcDir, "changed")
+		link := filepath.Join(srcDir, "link")
+		deleted := filepath.Join(srcDir, "deleted")
+		basis := testData(t, 1<<17)
+		if err = ioutil.WriteFile(changed, basis, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(deleted, []byte("deleted"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Symlink("changed", link); err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		newData := append(append([]byte{}, basis[:1<<16]...), []byte("inserted")...)
+		newData = append(newData, basis[1<<16:]...)
+		if err = ioutil.WriteFile(changed, newData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Remove(deleted); err != nil {
+			t.Fatal(err)
+		}
+		if err = backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		repo := testRepo(t, backupDir)
+		insts, err := SnapshotList(sk, repo.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := chainIncrements(insts, insts[0].ChainID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := buildIndex(ctx, sk, repo, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idx.Close()
+
+		if _, ok := idx.entries[deleted]; ok {
+			t.Fatal("deleted file indexed")
+		}
+		root := idx.root()
+		if len(root.Children) != 1 {
+			t.Fatalf("root children %q", root.Children)
+		}
+		src, ok := idx.entries[srcDir]
+		if !ok {
+			t.Fatal("source directory not indexed")
+		}
+		if len(src.Children) != 2 {
+			t.Fatalf("source children %q", src.Children)
+		}
+		// Deduplicated files are stored as chunk references, not
+		// deltas.
+		ie := idx.entries[changed]
+		if ie == nil || (len(ie.Deltas) == 1) == dedup || ie.Attribs.Size != int64(len(newData)) {
+			t.Fatalf("changed entry %+v", ie)
+		}
+
+		// Contents are read concurrently.
+		want := map[string][]byte{changed: newData, link: []byte("changed")}
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*len(want))
+		for i := 0; i < 2; i++ {
+			for p := range want {
+				wg.Add(1)
+				go func(ie *indexEntry) {
+					defer wg.Done()
+					fc, err := idx.content(ie)
+					if err != nil {
+						errs <- err
+						return
+					}
+					defer fc.Close()
+					if got := fc.String(); got != string(want[ie.Path]) {
+						errs <- fmt.Errorf("%q: content mismatch", ie.Path)
+					}
+				}(idx.entries[p])
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("dedup %v: %v", dedup, err)
+		}
+	}
+}
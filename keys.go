@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jrick/ss/keyfile"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// defaultKeyName is the name of the keys keygen creates, matching the sample
+// configuration.
+const defaultKeyName = "user"
+
+// kdfParams are the Argon2id parameters secret keys are encrypted with, the
+// defaults of ss.
+var kdfParams = keyfile.Argon2idParams{Time: 1, Memory: 64 * 1024}
+
+// promptPassphrase reads a passphrase from the terminal, twice when confirm
+// is set.
+func promptPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprint(os.Stderr, "\n")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if !confirm {
+		return passphrase, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s (again): ", prompt)
+	again, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprint(os.Stderr, "\n")
+	defer zero(again)
+	if err != nil {
+		zero(passphrase)
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		zero(passphrase)
+		return nil, errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// keygen creates the key pair name.public and name.secret in dir, encrypting
+// the secret key with passphrase, and returns the fingerprint.
+func keygen(dir, name string, passphrase []byte) (string, error) {
+	pkFilename := filepath.Join(dir, name+".public")
+	skFilename := filepath.Join(dir, name+".secret")
+	for _, file := range []string{pkFilename, skFilename} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			return "", fmt.Errorf("%q already exists", file)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	pkBuf, skBuf := new(bytes.Buffer), new(bytes.Buffer)
+	fp, err := keyfile.GenerateKeys(rand.Reader, pkBuf, skBuf, passphrase, &kdfParams, name)
+	if err != nil {
+		return "", err
+	}
+	defer zero(skBuf.Bytes())
+	if err = ioutil.WriteFile(skFilename, skBuf.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	if err = ioutil.WriteFile(pkFilename, pkBuf.Bytes(), 0644); err != nil {
+		os.Remove(skFilename)
+		return "", err
+	}
+	return fp, nil
+}
+
+// passwd encrypts the secret key in file, which opens with passphrase, again
+// with newPassphrase.
+func passwd(file string, passphrase, newPassphrase []byte) error {
+	skBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	defer zero(skBytes)
+	sk, kf, err := keyfile.OpenSecretKey(bytes.NewReader(skBytes), passphrase)
+	if err != nil {
+		return fmt.Errorf("%q: %v", file, err)
+	}
+	defer zero(sk[:])
+
+	dir, base := filepath.Split(file)
+	tmp, err := ioutil.TempFile(dir, base)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = keyfile.EncryptSecretKey(rand.Reader, tmp, sk, newPassphrase, &kdfParams, kf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// readKeyFingerprint returns the fingerprint of the public or secret key in
+// file.  Public keys are hashed, secret keys are not decrypted, so their
+// fingerprint comes from the key file.
+func readKeyFingerprint(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	defer zero(b)
+	if bytes.HasPrefix(b, []byte("ss encryption public key\n")) {
+		pk, err := keyfile.ReadPublicKey(bytes.NewReader(b))
+		if err != nil {
+			return "", fmt.Errorf("%q: %v", file, err)
+		}
+		fp := keyFingerprint(pk)
+		return formatFingerprint(fp[:]), nil
+	}
+	if !bytes.HasPrefix(b, []byte("ss encryption secret key\n")) {
+		return "", fmt.Errorf("%q: not an ss key file", file)
+	}
+	fp, err := keyFileField(bytes.NewReader(b), "fingerprint")
+	if err != nil {
+		return "", fmt.Errorf("%q: %v", file, err)
+	}
+	return fp, nil
+}
+
+// keyFileField returns a field of the header of an ss key file.
+func keyFileField(r io.Reader, name string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if v := strings.TrimPrefix(line, name+": "); v != line {
+			return v, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no %s", name)
+}
+
+// printKeyInfo writes the fingerprints of the key files to w.
+func printKeyInfo(w io.Writer, files []string) error {
+	for _, file := range files {
+		fp, err := readKeyFingerprint(file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: %s\n", file, fp)
+	}
+	return nil
+}
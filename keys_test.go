@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jrick/ss/keyfile"
+	"github.com/jrick/ss/stream"
+)
+
+func TestKeygenPasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(params keyfile.Argon2idParams) { kdfParams = params }(kdfParams)
+	kdfParams.Memory = 64
+	fp, err := keygen(dir, "k", []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkFile, skFile := filepath.Join(dir, "k.public"), filepath.Join(dir, "k.secret")
+	pkBytes, err := ioutil.ReadFile(pkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keygen(dir, "k", []byte("one")); err == nil {
+		t.Fatal("keygen overwrote keys")
+	}
+	// Either existing file stops keygen.
+	for _, name := range []string{"public", "secret"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, "only."+name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = keygen(dir, "only", []byte("one")); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Fatalf("keygen with an existing %v file: %v", name, err)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, "only."+name)); string(b) != name {
+			t.Fatalf("%v file overwritten", name)
+		}
+		os.Remove(filepath.Join(dir, "only."+name))
+	}
+	if b, _ := ioutil.ReadFile(pkFile); !bytes.Equal(b, pkBytes) {
+		t.Fatal("public key overwritten")
+	}
+	for _, file := range []string{pkFile, skFile} {
+		got, err := readKeyFingerprint(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != fp {
+			t.Fatalf("%v: fingerprint %v, want %v", file, got, fp)
+		}
+	}
+	if err = passwd(skFile, []byte("bad"), []byte("two")); err == nil {
+		t.Fatal("passwd with the wrong passphrase succeeded")
+	}
+	if err = passwd(skFile, []byte("one"), []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(skFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = keyfile.OpenSecretKey(bytes.NewReader(b), []byte("one")); err == nil {
+		t.Fatal("secret key opens with the old passphrase")
+	}
+	sk, _, err := keyfile.OpenSecretKey(bytes.NewReader(b), []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := keyfile.ReadPublicKey(bytes.NewReader(pkBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkFP := keyFingerprint(pk); formatFingerprint(pkFP[:]) != fp {
+		t.Fatal("public key fingerprint mismatch")
+	}
+	skFP := secretKeyFingerprint(sk)
+	if formatFingerprint(skFP[:]) != fp {
+		t.Fatal("secret key fingerprint mismatch")
+	}
+	var out bytes.Buffer
+	if err = printKeyInfo(&out, []string{pkFile, skFile}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != pkFile+": "+fp+"\n"+skFile+": "+fp+"\n" {
+		t.Fatalf("key info %q", out.String())
+	}
+}
+
+func TestRestoreWrongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	backupDir := filepath.Join(dir, "backup")
+	if err = os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(srcDir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pk1, _ := testKeys(t)
+	_, sk2 := testKeys(t)
+	cfg := testConfig(t, backupDir, srcDir)
+	if err = backup(context.Background(), []*stream.PublicKey{pk1}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	err = restore(context.Background(), sk2, testRepo(t, backupDir), filepath.Join(dir, "restore"), nil, -1)
+	fp := keyFingerprint(pk1)
+	if err == nil || !strings.Contains(err.Error(), "encrypted to "+formatFingerprint(fp[:])) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
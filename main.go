@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,15 +14,62 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/companyzero/multus/storage"
 	"github.com/jrick/ss/keyfile"
-	"golang.org/x/crypto/ssh/terminal"
+	"github.com/jrick/ss/stream"
 )
 
-const FormatVersion = uint16(1)
+const FormatVersion = uint16(8)
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "backup\nrestore /RESTOREPATH [file] [level]")
+	fmt.Fprintln(os.Stderr, "backup\nrestore [--shares] [--to-tar] /RESTOREPATH|TARFILE|- [file] [level]\n"+
+		"restore [--shares] --to-stdout file [level]\nconsolidate [level]\nlist\nrekey [--reencrypt]\nkeygen [name]\npasswd\nkey info [keyfile ...]\nkey split -n shares -k threshold [-o prefix]\n"+
+		"export [--zstd] TARFILE|- [level]\nimport [--host hostname] [--time YYYYMMDDhhmm] TARFILE|-\nmount chain level /MOUNTPOINT\n  (every open of a file decrypts it and applies its deltas again)")
+}
+
+// readPublicKeys returns the public keys of all recipients.
+func readPublicKeys(cfg *config) ([]*stream.PublicKey, error) {
+	files := cfg.Backup.PubkeyFiles
+	if len(cfg.Backup.PubkeyFile) != 0 {
+		files = append([]string{cfg.Backup.PubkeyFile}, files...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("pubkeyfile not set")
+	}
+	pubKeys := make([]*stream.PublicKey, 0, len(files))
+	for _, file := range files {
+		pubKeyBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pk, err := keyfile.ReadPublicKey(bytes.NewReader(pubKeyBytes))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", file, err)
+		}
+		pubKeys = append(pubKeys, pk)
+	}
+	return pubKeys, nil
+}
+
+func readSecretKey(cfg *config) (*stream.SecretKey, error) {
+	if len(cfg.Restore.SecretFile) == 0 {
+		return nil, fmt.Errorf("secretfile not set")
+	}
+	skBytes, err := ioutil.ReadFile(cfg.Restore.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(skBytes)
+	secret, err := readPassphrase(&cfg.Restore)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(secret)
+	sk, _, err := keyfile.OpenSecretKey(bytes.NewReader(skBytes), secret)
+	return sk, err
 }
 
 func main() {
@@ -51,7 +99,7 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 	go func() {
 		for sig := range signals {
@@ -79,40 +127,244 @@ func main() {
 			fmt.Fprintln(os.Stderr, "no paths to backup")
 			os.Exit(1)
 		}
-		if len(cfg.Backup.PubkeyFile) == 0 {
-			fmt.Fprintln(os.Stderr, "pubkeyfile not set")
+		pubKeys, err := readPublicKeys(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		gErr = backup(ctx, pubKeys, cfg)
+	case "restore":
+		// --shares reconstructs the secret key from shares instead of
+		// opening secretfile.  --to-tar writes a tar stream to the
+		// restore path, - for stdout, and --to-stdout the content of the
+		// only matching file.
+		var shares, toTar, toStdout bool
+		args := os.Args[2:]
+		for ; len(args) != 0 && strings.HasPrefix(args[0], "--"); args = args[1:] {
+			switch args[0] {
+			case "--shares":
+				shares = true
+			case "--to-tar":
+				toTar = true
+			case "--to-stdout":
+				toStdout = true
+			default:
+				usage()
+				os.Exit(1)
+			}
+		}
+		if toTar && toStdout {
+			usage()
 			os.Exit(1)
 		}
-		pubKeyBytes, err := ioutil.ReadFile(cfg.Backup.PubkeyFile)
+		var destDir string
+		if !toStdout {
+			if len(args) == 0 {
+				usage()
+				os.Exit(1)
+			}
+			destDir = filepath.Clean(args[0])
+			args = args[1:]
+		}
+		if len(args) > 2 || (toStdout && len(args) == 0) {
+			usage()
+			os.Exit(1)
+		}
+
+		var fileRegexp *regexp.Regexp
+		if len(args) > 0 {
+			fileRegexp, err = regexp.Compile(args[0])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		ii := int32(-1)
+		if len(args) > 1 {
+			i, err := strconv.ParseUint(args[1], 10, 16)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			ii = int32(i)
+		}
+
+		var sk *stream.SecretKey
+		if shares {
+			sk, err = readSecretKeyShares(os.Stdin)
+		} else {
+			sk, err = readSecretKey(cfg)
+		}
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		pubKey, err := keyfile.ReadPublicKey(bytes.NewReader(pubKeyBytes))
+		storageCfg := cfg.Restore.Storage
+		if storageCfg == nil {
+			storageCfg = &cfg.Backup.Storage
+		}
+		repo, err := openRepository(storageCfg, cfg.BackupPath, cfg.Restore.TempDir)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		gErr = backup(ctx, pubKey, cfg)
-	case "restore":
-		if len(os.Args) < 3 {
+		switch {
+		case toStdout:
+			gErr = restoreStream(ctx, sk, repo, os.Stdout, fileRegexp, ii, true)
+		case toTar && destDir == "-":
+			gErr = restoreStream(ctx, sk, repo, os.Stdout, fileRegexp, ii, false)
+		case toTar:
+			fd, err := os.OpenFile(destDir, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			gErr = restoreStream(ctx, sk, repo, fd, fileRegexp, ii, false)
+			if err = fd.Close(); gErr == nil {
+				gErr = err
+			}
+		default:
+			gErr = restore(ctx, sk, repo, destDir, fileRegexp, ii)
+		}
+		repo.Close()
+	case "export":
+		args := os.Args[2:]
+		compress := len(args) != 0 && args[0] == "--zstd"
+		if compress {
+			args = args[1:]
+		}
+		if len(args) == 0 || len(args) > 2 {
 			usage()
 			os.Exit(1)
 		}
-		destDir := filepath.Clean(os.Args[2])
-
-		var fileRegexp *regexp.Regexp
-		if len(os.Args) > 3 {
-			fileRegexp, err = regexp.Compile(os.Args[3])
+		ii := int32(-1)
+		if len(args) > 1 {
+			i, err := strconv.ParseUint(args[1], 10, 16)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
+			ii = int32(i)
+		}
+		sk, err := readSecretKey(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		storageCfg := cfg.Restore.Storage
+		if storageCfg == nil {
+			storageCfg = &cfg.Backup.Storage
+		}
+		repo, err := openRepository(storageCfg, cfg.BackupPath, cfg.Restore.TempDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if args[0] == "-" {
+			gErr = exportTar(ctx, sk, repo, os.Stdout, ii, compress)
+		} else {
+			fd, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			gErr = exportTar(ctx, sk, repo, fd, ii, compress)
+			if err = fd.Close(); gErr == nil {
+				gErr = err
+			}
+		}
+		repo.Close()
+	case "mount":
+		if len(os.Args) != 5 {
+			usage()
+			os.Exit(1)
+		}
+		level, err := strconv.ParseUint(os.Args[3], 10, 16)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sk, err := readSecretKey(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		storageCfg := cfg.Restore.Storage
+		if storageCfg == nil {
+			storageCfg = &cfg.Backup.Storage
+		}
+		repo, err := openRepository(storageCfg, cfg.BackupPath, cfg.Restore.TempDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		gErr = mountChain(ctx, sk, repo, os.Args[2], int32(level), os.Args[4])
+		repo.Close()
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		fs.Usage = usage
+		hostname := fs.String("host", "", "hostname of the chain")
+		ts := fs.String("time", "", "start of the chain, YYYYMMDDhhmm")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 {
+			usage()
+			os.Exit(1)
+		}
+		if len(cfg.BackupPath) == 0 {
+			fmt.Fprintln(os.Stderr, "backuppath not set")
+			os.Exit(1)
+		}
+		if len(cfg.Backup.Group) == 0 {
+			fmt.Fprintln(os.Stderr, "backup group not set")
+			os.Exit(1)
+		}
+		if len(*hostname) == 0 {
+			if *hostname, err = os.Hostname(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		timeStamp := time.Now()
+		if len(*ts) != 0 {
+			if timeStamp, err = time.ParseInLocation("200601021504", *ts, time.Local); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		pubKeys, err := readPublicKeys(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if fs.Arg(0) == "-" {
+			gErr = importTar(ctx, pubKeys, cfg, os.Stdin, *hostname, timeStamp)
+		} else {
+			fd, err := os.Open(fs.Arg(0))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			gErr = importTar(ctx, pubKeys, cfg, fd, *hostname, timeStamp)
+			fd.Close()
+		}
+	case "consolidate":
+		if len(os.Args) > 3 {
+			usage()
+			os.Exit(1)
+		}
+		if len(cfg.BackupPath) == 0 {
+			fmt.Fprintln(os.Stderr, "backuppath not set")
+			os.Exit(1)
+		}
+		if len(cfg.Backup.Group) == 0 {
+			fmt.Fprintln(os.Stderr, "backup group not set")
+			os.Exit(1)
 		}
 
 		ii := int32(-1)
-		if len(os.Args) > 4 {
-			i, err := strconv.ParseUint(os.Args[4], 10, 16)
+		if len(os.Args) > 2 {
+			i, err := strconv.ParseUint(os.Args[2], 10, 16)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
@@ -120,30 +372,169 @@ func main() {
 			ii = int32(i)
 		}
 
-		if len(cfg.Restore.SecretFile) == 0 {
-			fmt.Fprintln(os.Stderr, "secretfile not set")
+		pubKeys, err := readPublicKeys(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sk, err := readSecretKey(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		gErr = consolidate(ctx, sk, pubKeys, cfg, ii)
+	case "rekey":
+		// --reencrypt encrypts the payloads again under new file keys,
+		// for when a secret key is compromised.
+		reencrypt := len(os.Args) == 3 && os.Args[2] == "--reencrypt"
+		if len(os.Args) != 2 && !reencrypt {
+			usage()
+			os.Exit(1)
+		}
+		if len(cfg.BackupPath) == 0 {
+			fmt.Fprintln(os.Stderr, "backuppath not set")
+			os.Exit(1)
+		}
+		if len(cfg.Backup.Group) == 0 {
+			fmt.Fprintln(os.Stderr, "backup group not set")
+			os.Exit(1)
+		}
+		pubKeys, err := readPublicKeys(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sk, err := readSecretKey(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		gErr = rekey(ctx, sk, pubKeys, cfg, reencrypt)
+	case "list":
+		if len(os.Args) != 2 {
+			usage()
+			os.Exit(1)
+		}
+		key, err := readManifestKey(cfg.Backup.HostKeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		storageCfg := cfg.Restore.Storage
+		if storageCfg == nil {
+			storageCfg = &cfg.Backup.Storage
+		}
+		store, err := storage.Open(storageCfg, cfg.BackupPath, -1, -1)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		skBytes, err := ioutil.ReadFile(cfg.Restore.SecretFile)
+		list, err := ManifestList(store, key)
+		store.Close()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		fmt.Fprintf(os.Stderr, "%q secret: ", cfg.Restore.SecretFile)
-		secret, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Fprint(os.Stderr, "\n")
+		printManifests(os.Stdout, list)
+	case "keygen":
+		if len(os.Args) > 3 {
+			usage()
+			os.Exit(1)
+		}
+		name := defaultKeyName
+		if len(os.Args) == 3 {
+			name = os.Args[2]
+		}
+		passphrase, err := promptPassphrase(fmt.Sprintf("%q passphrase", name), true)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fp, err := keygen(defaultHomeDir, name, passphrase)
+		zero(passphrase)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %s\n", filepath.Join(defaultHomeDir, name+".public"), fp)
+	case "passwd":
+		if len(os.Args) != 2 {
+			usage()
+			os.Exit(1)
+		}
+		if len(cfg.Restore.SecretFile) == 0 {
+			fmt.Fprintln(os.Stderr, "secretfile not set")
+			os.Exit(1)
+		}
+		passphrase, err := readPassphrase(&cfg.Restore)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		sk, _, err := keyfile.OpenSecretKey(bytes.NewReader(skBytes), secret)
-		zero(secret)
-		zero(skBytes)
+		newPassphrase, err := promptPassphrase("new passphrase", true)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		gErr = restore(ctx, sk, cfg.BackupPath, destDir, fileRegexp, ii)
+		gErr = passwd(cfg.Restore.SecretFile, passphrase, newPassphrase)
+		zero(passphrase)
+		zero(newPassphrase)
+	case "key":
+		if len(os.Args) < 3 || (os.Args[2] != "info" && os.Args[2] != "split") {
+			usage()
+			os.Exit(1)
+		}
+		if os.Args[2] == "split" {
+			fs := flag.NewFlagSet("key split", flag.ExitOnError)
+			fs.Usage = usage
+			n := fs.Int("n", 0, "number of shares")
+			k := fs.Int("k", 0, "shares needed to restore")
+			prefix := fs.String("o", "", "share file prefix")
+			fs.Parse(os.Args[3:])
+			if fs.NArg() != 0 || *n == 0 || *k == 0 {
+				usage()
+				os.Exit(1)
+			}
+			if len(cfg.Restore.SecretFile) == 0 {
+				fmt.Fprintln(os.Stderr, "secretfile not set")
+				os.Exit(1)
+			}
+			if len(*prefix) == 0 {
+				*prefix = cfg.Restore.SecretFile + ".share"
+			}
+			sk, err := readSecretKey(cfg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			shares, err := splitKey(sk, *n, *k)
+			zero(sk[:])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			files, err := writeShares(*prefix, shares)
+			for _, file := range files {
+				fmt.Println(file)
+			}
+			gErr = err
+			break
+		}
+		files := os.Args[3:]
+		if len(files) == 0 {
+			if len(cfg.Backup.PubkeyFile) != 0 {
+				files = append(files, cfg.Backup.PubkeyFile)
+			}
+			files = append(files, cfg.Backup.PubkeyFiles...)
+			if len(cfg.Restore.SecretFile) != 0 {
+				files = append(files, cfg.Restore.SecretFile)
+			}
+		}
+		if len(files) == 0 {
+			fmt.Fprintln(os.Stderr, "no key files")
+			os.Exit(1)
+		}
+		gErr = printKeyInfo(os.Stdout, files)
 	default:
 		usage()
 		os.Exit(1)
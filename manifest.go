@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/companyzero/multus/format"
+	"github.com/companyzero/multus/storage"
+)
+
+// writeManifest stores the signed manifest of the closed snapshot snap.
+func writeManifest(store storage.Backend, snap *Snapshot, key ed25519.PrivateKey) error {
+	m := snap.Manifest()
+	w, err := store.Create(format.ManifestName(snap.Name()))
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(m.Sign(key)); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// LoadHostKey reads the key manifests are signed with, generating it when
+// the file does not exist.  The public key is kept next to it for the agent
+// configuration.
+func LoadHostKey(keyFile string) (ed25519.PrivateKey, error) {
+	seed, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%q: invalid key length %d", keyFile, len(seed))
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(keyFile, key.Seed(), 0600); err != nil {
+		return nil, err
+	}
+	pubHex := hex.EncodeToString(pub)
+	if err = ioutil.WriteFile(keyFile+".pub", []byte(pubHex+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	log.Printf("generated host key %q, manifest key: %s", keyFile, pubHex)
+	return key, nil
+}
+
+// readManifestKey returns the public half of the host key written next to
+// keyFile.
+func readManifestKey(keyFile string) (ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(keyFile + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%q: invalid manifest key", keyFile+".pub")
+	}
+	return key, nil
+}
+
+// ManifestFile is an increment in a repository and its manifest, which is
+// nil for increments written without one.
+type ManifestFile struct {
+	Filename string
+	Size     int64
+	Manifest *format.Manifest
+}
+
+// ManifestList returns the increments in store described by their signed
+// manifests, ordered by chain and level.  Only the manifests are read, so
+// neither the secret key nor a download of the increments is needed.
+func ManifestList(store storage.Backend, key ed25519.PublicKey) ([]ManifestFile, error) {
+	files, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+	var list []ManifestFile
+	for _, file := range files {
+		if !format.IsIncrement(file.Name) {
+			continue
+		}
+		mf := ManifestFile{Filename: file.Name, Size: file.Size}
+		b, err := readAll(store, format.ManifestName(file.Name))
+		if storage.IsNotExist(err) {
+			list = append(list, mf)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if mf.Manifest, err = format.ParseManifest(b, key); err != nil {
+			return nil, fmt.Errorf("%q: %v", format.ManifestName(file.Name), err)
+		}
+		if mf.Manifest.Size != file.Size {
+			return nil, fmt.Errorf("%q: size %d, manifest has %d", file.Name,
+				file.Size, mf.Manifest.Size)
+		}
+		list = append(list, mf)
+	}
+	sort.SliceStable(list, func(a, b int) bool {
+		ma, mb := list[a].Manifest, list[b].Manifest
+		if ma == nil || mb == nil {
+			return ma != nil && mb == nil
+		}
+		if !ma.Timestamp.Equal(mb.Timestamp) {
+			return ma.Timestamp.Before(mb.Timestamp)
+		}
+		if ma.ChainID != mb.ChainID {
+			return bytes.Compare(ma.ChainID[:], mb.ChainID[:]) < 0
+		}
+		return ma.Increment < mb.Increment
+	})
+	return list, nil
+}
+
+func readAll(store storage.Backend, name string) ([]byte, error) {
+	r, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// printManifests writes a table of the increments in list to w.
+func printManifests(w io.Writer, list []ManifestFile) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tHOST\tCHAIN\tSTARTED\tLEVEL\tTYPE\tSIZE\tCREATED")
+	for _, mf := range list {
+		m := mf.Manifest
+		if m == nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t%d\tno manifest\n", mf.Filename, mf.Size)
+			continue
+		}
+		typ := "incremental"
+		switch {
+		case m.Increment == 0:
+			typ = "full"
+		case m.Differential:
+			typ = "differential"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%d\t%s\t%d\t%s\n", mf.Filename, m.Hostname,
+			m.ChainID, m.Timestamp.Format("2006-01-02 15:04"), m.Increment, typ, m.Size,
+			m.Created.Format(time.RFC3339))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,254 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/jrick/ss/stream"
+)
+
+// mountFS is a read-only FUSE filesystem over the index of a chain level.
+type mountFS struct {
+	idx *chainIndex
+
+	mu    sync.Mutex
+	nodes map[string]fs.Node
+}
+
+func newMountFS(idx *chainIndex) *mountFS {
+	return &mountFS{
+		idx:   idx,
+		nodes: make(map[string]fs.Node),
+	}
+}
+
+// Root returns the directory of /.
+func (mfs *mountFS) Root() (fs.Node, error) {
+	return mfs.node(mfs.idx.root()), nil
+}
+
+// node returns the node of ie, the same one for every lookup so the kernel
+// sees a single inode.
+func (mfs *mountFS) node(ie *indexEntry) fs.Node {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if n, ok := mfs.nodes[ie.Path]; ok {
+		return n
+	}
+	mn := mountNode{fs: mfs, entry: ie}
+	var n fs.Node
+	fileMode := os.FileMode(ie.Attribs.Mode)
+	switch {
+	case isDir(fileMode):
+		n = &mountDir{mn}
+	case isSymlink(fileMode):
+		n = &mountSymlink{mn}
+	case fileMode.IsRegular():
+		n = &mountFile{mn}
+	default:
+		n = &mn
+	}
+	mfs.nodes[ie.Path] = n
+	return n
+}
+
+// mountNode is a path of the chain.  Devices, pipes and sockets are plain
+// mountNodes.
+type mountNode struct {
+	fs    *mountFS
+	entry *indexEntry
+}
+
+// Attr returns the attributes of the path as backed up.
+func (n *mountNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attrib := n.entry.Attribs
+	mtime := time.Unix(0, attrib.MTim)
+	// Nothing changes while mounted.
+	attr.Valid = time.Hour
+	attr.Mode = os.FileMode(attrib.Mode)
+	attr.Size = uint64(attrib.Size)
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.Atime = mtime
+	attr.Mtime = mtime
+	attr.Ctime = mtime
+	attr.Nlink = 1
+	attr.Uid = attrib.UID
+	attr.Gid = attrib.GID
+	if isDevice(attr.Mode) {
+		// The kernel encoding of device numbers in 32 bits.
+		major, minor := major(attrib.RDev), minor(attrib.RDev)
+		attr.Rdev = uint32(minor&0xff | major<<8 | (minor&^0xff)<<12)
+	}
+	return nil
+}
+
+// mountDir is a directory of the chain.
+type mountDir struct {
+	mountNode
+}
+
+// Lookup returns the node of name in the directory.
+func (d *mountDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	ie, ok := d.fs.idx.lookup(d.entry, name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return d.fs.node(ie), nil
+}
+
+// ReadDirAll lists the directory.
+func (d *mountDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirents := make([]fuse.Dirent, 0, len(d.entry.Children))
+	for _, name := range d.entry.Children {
+		ie, ok := d.fs.idx.lookup(d.entry, name)
+		if !ok {
+			continue
+		}
+		dirents = append(dirents, fuse.Dirent{Name: name, Type: direntType(os.FileMode(ie.Attribs.Mode))})
+	}
+	return dirents, nil
+}
+
+// direntType returns the directory entry type of fileMode.
+func direntType(fileMode os.FileMode) fuse.DirentType {
+	switch {
+	case isDir(fileMode):
+		return fuse.DT_Dir
+	case isSymlink(fileMode):
+		return fuse.DT_Link
+	case isCharDevice(fileMode):
+		return fuse.DT_Char
+	case isDevice(fileMode):
+		return fuse.DT_Block
+	case isNamedPipe(fileMode):
+		return fuse.DT_FIFO
+	case isSocket(fileMode):
+		return fuse.DT_Socket
+	case fileMode.IsRegular():
+		return fuse.DT_File
+	}
+	return fuse.DT_Unknown
+}
+
+// mountSymlink is a symlink of the chain.
+type mountSymlink struct {
+	mountNode
+}
+
+// Readlink returns the target of the symlink, applying its deltas.
+func (s *mountSymlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	content, err := s.fs.idx.content(s.entry)
+	if err != nil {
+		log.Printf("%q: %v", s.entry.Path, err)
+		return "", fuse.EIO
+	}
+	defer content.Close()
+	return content.String(), nil
+}
+
+// mountFile is a regular file of the chain.
+type mountFile struct {
+	mountNode
+}
+
+// Open reads the content of the file and applies its deltas.  Nothing is
+// kept between opens, so each one decrypts the increments and patches the
+// file again; the kernel page cache spares rereads of a file kept open.
+func (f *mountFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	content, err := f.fs.idx.content(f.entry)
+	if err != nil {
+		log.Printf("%q: %v", f.entry.Path, err)
+		return nil, fuse.EIO
+	}
+	resp.Flags |= fuse.OpenKeepCache
+	return &mountHandle{content: content}, nil
+}
+
+// mountHandle is an open file.
+type mountHandle struct {
+	content *fileContent
+}
+
+// Read reads the content of the file.
+func (h *mountHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if req.Offset >= h.content.Size() {
+		return nil
+	}
+	buf := make([]byte, req.Size)
+	n, err := h.content.ReadAt(buf, req.Offset)
+	if err != nil && n == 0 {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Release drops the content of the file.
+func (h *mountHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.content.Close()
+}
+
+// mountChain mounts level of the chain whose id starts with chainPrefix on
+// dir until it is unmounted or ctx is done.
+func mountChain(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chainPrefix string,
+	level int32, dir string) error {
+
+	insts, err := SnapshotList(secretKey, repo.store)
+	if err != nil {
+		return err
+	}
+	id, err := findChain(insts, chainPrefix)
+	if err != nil {
+		return err
+	}
+	chain, err := chainIncrements(insts, id, level)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("indexing chain %v level %d...", id, chain[len(chain)-1].Increment)
+	startTime := time.Now()
+	idx, err := buildIndex(ctx, secretKey, repo, chain)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	log.Printf("indexed %d paths in %v", len(idx.entries), time.Since(startTime))
+
+	c, err := fuse.Mount(dir, fuse.FSName("multus"), fuse.Subtype("multus"), fuse.ReadOnly())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := fuse.Unmount(dir); err != nil {
+				log.Printf("unmount %q: %v", dir, err)
+			}
+		case <-done:
+		}
+	}()
+
+	log.Printf("mounted on %q", dir)
+	if err = fs.Serve(c, newMountFS(idx)); err != nil {
+		return err
+	}
+	<-c.Ready
+	return c.MountError
+}
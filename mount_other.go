@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/jrick/ss/stream"
+)
+
+// mountChain is only supported where FUSE is.
+func mountChain(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chainPrefix string,
+	level int32, dir string) error {
+
+	return fmt.Errorf("mount is not supported on %s", runtime.GOOS)
+}
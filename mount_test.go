@@ -0,0 +1,215 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+func readNode(t *testing.T, n fs.Node) []byte {
+	t.Helper()
+	ctx := context.Background()
+	var attr fuse.Attr
+	if err := n.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	h, err := n.(fs.NodeOpener).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	for off := int64(0); ; {
+		resp := &fuse.ReadResponse{}
+		if err := h.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Offset: off, Size: 4096}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) == 0 {
+			break
+		}
+		out = append(out, resp.Data...)
+		off += int64(len(resp.Data))
+	}
+	if uint64(len(out)) != attr.Size {
+		t.Fatalf("read %d bytes, attr size %d", len(out), attr.Size)
+	}
+	resp := &fuse.ReadResponse{}
+	if err := h.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Offset: int64(attr.Size) + 1, Size: 4096}, resp); err != nil ||
+		len(resp.Data) != 0 {
+		t.Fatalf("read past the end: %d bytes %v", len(resp.Data), err)
+	}
+	h.(fs.HandleReleaser).Release(ctx, &fuse.ReleaseRequest{})
+	return out
+}
+
+func TestDirentType(t *testing.T) {
+	tests := []struct {
+		mode os.FileMode
+		want fuse.DirentType
+	}{
+		{0644, fuse.DT_File},
+		{os.ModeDir | 0755, fuse.DT_Dir},
+		{os.ModeSymlink | 0777, fuse.DT_Link},
+		{os.ModeDevice | os.ModeCharDevice | 0666, fuse.DT_Char},
+		{os.ModeDevice | 0660, fuse.DT_Block},
+		{os.ModeNamedPipe | 0600, fuse.DT_FIFO},
+		{os.ModeSocket | 0600, fuse.DT_Socket},
+		{os.ModeIrregular, fuse.DT_Unknown},
+	}
+	for _, test := range tests {
+		if got := direntType(test.mode); got != test.want {
+			t.Errorf("%v: %v, want %v", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestMountIndex(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "multus")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcDir, backupDir, sk := testTree(t, dir, dedup)
+		ctx := context.Background()
+		repo := testRepo(t, backupDir)
+		insts, err := SnapshotList(sk, repo.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := findChain(insts, insts[0].ChainID.String()[:6])
+		if err != nil || id != insts[0].ChainID {
+			t.Fatal(id, err)
+		}
+		if _, err = findChain(insts, "zz"); err == nil {
+			t.Fatal("found unknown chain")
+		}
+		for _, level := range []int32{1, 0} {
+			chain, err := chainIncrements(insts, id, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx, err := buildIndex(ctx, sk, repo, chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mfs := newMountFS(idx)
+			n, _ := mfs.Root()
+			for _, name := range strings.Split(strings.TrimPrefix(srcDir, "/"), "/") {
+				if n, err = n.(fs.NodeStringLookuper).Lookup(ctx, name); err != nil {
+					t.Fatal(name, err)
+				}
+			}
+			src := n.(*mountDir)
+			dirents, err := src.ReadDirAll(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, d := range dirents {
+				names = append(names, d.Name)
+			}
+			want := "changed fifo link sub unchanged"
+			if level == 0 {
+				want = "changed deleted fifo link sub unchanged"
+			}
+			if os.Geteuid() == 0 {
+				want = strings.Replace(want, "link", "link null", 1)
+			}
+			if got := strings.Join(names, " "); got != want {
+				t.Fatalf("level %d: %q", level, got)
+			}
+			if level == 1 {
+				checkAttrs(t, src, dirents, srcDir)
+			}
+			if _, err = src.Lookup(ctx, "missing"); err != fuse.ENOENT {
+				t.Fatal(err)
+			}
+			// Out of order, so increments are reopened.
+			for _, name := range []string{"sub/text.txt", "unchanged", "sub/big", "changed"} {
+				n := fs.Node(src)
+				for _, part := range strings.Split(name, "/") {
+					n, _ = n.(fs.NodeStringLookuper).Lookup(ctx, part)
+				}
+				got := readNode(t, n)
+				want, _ := ioutil.ReadFile(filepath.Join(srcDir, name))
+				if level == 0 && name == "changed" {
+					if len(got) != 1<<17 {
+						t.Fatalf("level 0 changed: %d", len(got))
+					}
+					continue
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("level %d: %s content mismatch", level, name)
+				}
+			}
+			link, _ := src.Lookup(ctx, "link")
+			target, err := link.(fs.NodeReadlinker).Readlink(ctx, &fuse.ReadlinkRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[int32]string{0: "unchanged", 1: "changed"}[level]; target != want {
+				t.Fatalf("level %d: link %q", level, target)
+			}
+			fifo, _ := src.Lookup(ctx, "fifo")
+			var attr fuse.Attr
+			fifo.Attr(ctx, &attr)
+			if attr.Mode&os.ModeNamedPipe == 0 {
+				t.Fatalf("fifo mode %v", attr.Mode)
+			}
+			if _, ok := fifo.(fs.NodeOpener); ok {
+				t.Fatal("fifo opens")
+			}
+			root, _ := mfs.Root()
+			root.Attr(ctx, &attr)
+			if !attr.Mode.IsDir() {
+				t.Fatalf("root mode %v", attr.Mode)
+			}
+			idx.Close()
+		}
+		repo.Close()
+	}
+}
+
+// checkAttrs checks the attributes and directory entry types of dirents in d
+// against the files of dir.
+func checkAttrs(t *testing.T, d *mountDir, dirents []fuse.Dirent, dir string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, dirent := range dirents {
+		n, err := d.Lookup(ctx, dirent.Name)
+		if err != nil {
+			t.Fatal(dirent.Name, err)
+		}
+		var attr fuse.Attr
+		if err = n.Attr(ctx, &attr); err != nil {
+			t.Fatal(dirent.Name, err)
+		}
+		st, err := os.Lstat(filepath.Join(dir, dirent.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sys := st.Sys().(*syscall.Stat_t)
+		if attr.Mode != st.Mode() || attr.Uid != sys.Uid || attr.Gid != sys.Gid ||
+			!attr.Mtime.Equal(st.ModTime()) || dirent.Type != direntType(st.Mode()) {
+			t.Fatalf("%v: attributes %+v, dirent type %v, want %v", dirent.Name, attr, dirent.Type, st.Mode())
+		}
+		if st.Mode().IsRegular() && attr.Size != uint64(st.Size()) {
+			t.Fatalf("%v: size %d, want %d", dirent.Name, attr.Size, st.Size())
+		}
+		if dirent.Name == "null" && (dirent.Type != fuse.DT_Char || attr.Rdev != 1<<8|3) {
+			t.Fatalf("null: type %v, rdev %#x", dirent.Type, attr.Rdev)
+		}
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"time"
 )
 
 func main() {
+	dryRun := flag.Bool("dry-run", false, "only report what cleanup would delete")
+	flag.Parse()
+
 	cfg, err := loadConfig()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -24,48 +27,53 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	for _, host := range cfg.Hosts {
-		fmt.Printf("syncing %s\n", host.Hostname)
-		storagePath := filepath.Join(cfg.StoragePath, host.Hostname)
-		err = os.MkdirAll(storagePath, 0700)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v -- skipping %v",
-				err, host.Hostname)
-			continue
-		}
-		backupPath := filepath.Clean(host.BackupPath)
-		args := []string{
-			"--timeout",
-			"10",
-			"--include",
-			"**.gz.enc",
-			"--include",
-			"sig.cache",
-			"--exclude",
-			"*",
-			"--bwlimit",
-			cfg.BWLimit,
-			"-av",
-			"-e",
-			"ssh",
-			cfg.Login + "@" + host.Hostname + ":" + filepath.Join(backupPath) + string(os.PathSeparator),
-			storagePath,
-		}
+	transport, err := newSFTPTransport(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-		cmd := exec.CommandContext(ctx, "/usr/local/bin/rsync", args...)
-		fmt.Printf("%s\n", cmd.String())
-		stdoutStderr, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			continue
-		}
+	results := syncHosts(ctx, cfg, transport)
+	fmt.Println()
+	synced := printSummary(os.Stdout, results)
+	cancel()
 
-		fmt.Printf("%s\n\n", stdoutStderr)
+	fmt.Println()
+	verified, err := verify(cfg, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify: %v\n", err)
+		os.Exit(1)
 	}
-	cancel()
+	if !printVerify(os.Stdout, verified) {
+		synced = false
+	}
+	fmt.Println()
 
-	err = cleanup(cfg.StoragePath, cfg.MaxSize)
+	err = cleanup(cfg, *dryRun)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cleanup: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.Mirror != nil {
+		store, err := cfg.Mirror.open()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mirror: %v\n", err)
+			os.Exit(1)
+		}
+		start := time.Now()
+		result, err := mirror(cfg, store, *dryRun)
+		fmt.Printf("mirror %s: %d files uploaded, %d bytes, %d deleted, %v\n", store.Location(),
+			result.Uploaded, result.Bytes, result.Deleted, time.Since(start).Truncate(time.Millisecond))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mirror: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Exit status 2 tells failed, invalid or stale hosts apart from other
+	// errors.
+	if !synced {
+		os.Exit(2)
 	}
 }
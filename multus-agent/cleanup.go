@@ -1,124 +1,417 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	chunkDir = "chunks"
+
+	// chunkGracePeriod protects chunks whose reference lists may not
+	// have been synced yet.
+	chunkGracePeriod = 24 * time.Hour
+)
+
 var (
-	fileRexp = regexp.MustCompile(`\.gz\.enc$`)
-	hashRexp = regexp.MustCompile(`[[:xdigit:]]{64}`)
+	// fileRexp matches the YYYYMMDDhhmm-host.CHAINID.N.EXT increments
+	// written by multus, EXT naming the codec as in .gz.enc or .enc without
+	// compression.  Increments of older versions have no chain id.
+	fileRexp  = regexp.MustCompile(`^([0-9]{12})-(.+?)(?:\.([[:xdigit:]]{32}))?\.([0-9]+)(?:\.gz|\.zst|\.lz4)?\.enc$`)
+	chunkRexp = regexp.MustCompile(`^([[:xdigit:]]{64})\.enc$`)
 )
 
-type Cleanup struct {
-	Timestamp time.Time
-	Files     map[string]os.FileInfo
+// Increment is a single synced snapshot file.
+type Increment struct {
+	Path    string
+	Level   uint16
+	Size    int64
+	ModTime time.Time
 }
 
-type File struct {
-	Path      string
+// Chain is a level 0 snapshot and the increments based on it.  All of them
+// have to be kept for the chain to be restorable.
+type Chain struct {
+	Dir       string
+	Hostname  string
 	Timestamp time.Time
+	// ID is the hex encoded chain id, empty for chains of older versions.
+	ID         string
+	Increments []Increment
+	// RefFiles lists the chunk reference files of the increments.
+	RefFiles []string
+	// Manifests lists the signed manifests of the increments.
+	Manifests []string
 	Size      int64
 }
 
-type Files []File
+func (c *Chain) String() string {
+	s := fmt.Sprintf("%s/%s-%s", filepath.Base(c.Dir),
+		c.Timestamp.Format("200601021504"), c.Hostname)
+	if c.ID != "" {
+		s += "." + c.ID
+	}
+	return s
+}
+
+// Complete reports whether the chain has a level 0 and no missing levels.
+func (c *Chain) Complete() bool {
+	for i, inc := range c.Increments {
+		if inc.Level != uint16(i) {
+			return false
+		}
+	}
+	return len(c.Increments) != 0
+}
+
+// remove deletes all files of the chain.
+func (c *Chain) remove(dryRun bool) error {
+	files := append(append([]string{}, c.RefFiles...), c.Manifests...)
+	for _, inc := range c.Increments {
+		files = append(files, inc.Path)
+	}
+	for _, file := range files {
+		log.Printf("%q: delete", file)
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type Chains []*Chain
+
+func (c Chains) Len() int {
+	return len(c)
+}
 
-func (f Files) Len() int {
-	return len(f)
+func (c Chains) Less(a, b int) bool {
+	if !c[a].Timestamp.Equal(c[b].Timestamp) {
+		return c[a].Timestamp.Before(c[b].Timestamp)
+	}
+	return c[a].ID < c[b].ID
 }
 
-func (f Files) Less(a, b int) bool {
-	return f[a].Timestamp.Before(f[b].Timestamp)
+func (c Chains) Swap(a, b int) {
+	c[a], c[b] = c[b], c[a]
 }
 
-func (f Files) Swap(a, b int) {
-	f[a], f[b] = f[b], f[a]
+// newestComplete returns the newest complete chain of every host directory.
+func (c Chains) newestComplete() map[string]*Chain {
+	newest := make(map[string]*Chain)
+	for _, chain := range c {
+		if !chain.Complete() {
+			continue
+		}
+		if n, ok := newest[chain.Dir]; !ok || chain.Timestamp.After(n.Timestamp) {
+			newest[chain.Dir] = chain
+		}
+	}
+	return newest
 }
 
-func cleanup(storagePath string, maxSize int64) error {
+// loadChains groups the increments below storagePath into chains, oldest
+// first, and returns them along with the size of everything stored there.
+func loadChains(storagePath string) (Chains, int64, error) {
 	var totalSize int64
-	now := time.Now()
-	var files Files
-	err := filepath.Walk(storagePath, func(srcPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	chainMap := make(map[string]*Chain)
+	chainOf := func(dir string, matches []string) (*Chain, error) {
+		key := filepath.Join(dir, matches[1]+"-"+matches[2]+"."+matches[3])
+		if chain, ok := chainMap[key]; ok {
+			return chain, nil
 		}
-		st, err := os.Stat(srcPath)
+		ts, err := time.ParseInLocation("200601021504", matches[1], time.Local)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		chain := &Chain{
+			Dir:       dir,
+			Hostname:  matches[2],
+			Timestamp: ts,
+			ID:        strings.ToLower(matches[3]),
 		}
-		if !st.Mode().IsDir() && !st.Mode().IsRegular() {
+		chainMap[key] = chain
+		return chain, nil
+	}
+
+	err := filepath.Walk(storagePath, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
 			return err
 		}
-		if st.Mode().IsDir() {
+		if !info.Mode().IsRegular() {
 			return nil
 		}
-		sysStat, ok := st.Sys().(*syscall.Stat_t)
-		if !ok {
-			return fmt.Errorf("stat returned type %T", st.Sys())
-		}
-		file := File{
-			Path:      srcPath,
-			Size:      st.Size(),
-			Timestamp: time.Unix(sysStat.Ctim.Sec, sysStat.Ctim.Nsec),
+		totalSize += info.Size()
+		fileName := info.Name()
+		dir := filepath.Dir(srcPath)
+		if chunkRexp.MatchString(fileName) || fileName == "sig.cache" ||
+			fileName == verifyCacheName || strings.HasSuffix(fileName, partialSuffix) {
+			return nil
 		}
-		totalSize += file.Size
-		fileName := filepath.Base(srcPath)
-		if !fileRexp.MatchString(fileName) {
-			if fileName != "sig.cache" {
+		if ext := filepath.Ext(fileName); ext == ".refs" || ext == ".manifest" {
+			matches := fileRexp.FindStringSubmatch(strings.TrimSuffix(fileName, ext) + ".enc")
+			if matches == nil {
 				log.Printf("%q: unknown file", srcPath)
+				return nil
 			}
+			chain, err := chainOf(dir, matches)
+			if err != nil {
+				return err
+			}
+			if ext == ".refs" {
+				chain.RefFiles = append(chain.RefFiles, srcPath)
+			} else {
+				chain.Manifests = append(chain.Manifests, srcPath)
+			}
+			chain.Size += info.Size()
+			return nil
+		}
+		matches := fileRexp.FindStringSubmatch(fileName)
+		if matches == nil {
+			log.Printf("%q: unknown file", srcPath)
 			return nil
 		}
-		files = append(files, file)
+		level, err := strconv.ParseUint(matches[4], 10, 16)
+		if err != nil {
+			log.Printf("%q: unknown file", srcPath)
+			return nil
+		}
+		chain, err := chainOf(dir, matches)
+		if err != nil {
+			return err
+		}
+		chain.Increments = append(chain.Increments, Increment{
+			Path:    srcPath,
+			Level:   uint16(level),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		chain.Size += info.Size()
 		return nil
 	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	chains := make(Chains, 0, len(chainMap))
+	for _, chain := range chainMap {
+		sort.Slice(chain.Increments, func(a, b int) bool {
+			return chain.Increments[a].Level < chain.Increments[b].Level
+		})
+		chains = append(chains, chain)
+	}
+	sort.Stable(chains)
+	return chains, totalSize, nil
+}
+
+// hostFor returns the configuration of the host stored in dir or nil for
+// hosts that are no longer configured.
+func hostFor(cfg *config, dir string) *Host {
+	for i := range cfg.Hosts {
+		if filepath.Join(cfg.StoragePath, cfg.Hosts[i].Hostname) == dir {
+			return &cfg.Hosts[i]
+		}
+	}
+	return nil
+}
+
+// cleanup first prunes the chains that the retention rules do not keep.  It
+// then deletes whole chains, oldest first, until every host fits in its
+// quota and the storage path fits in the maximum size.  The newest complete
+// chain of every host is always kept.  With dryRun set nothing is removed.
+func cleanup(cfg *config, dryRun bool) error {
+	chains, totalSize, err := loadChains(cfg.StoragePath)
 	if err != nil {
 		return err
 	}
-	log.Printf("total size: %d bytes, max size: %d bytes", totalSize, maxSize)
-	if totalSize <= maxSize {
-		return nil
+	log.Printf("total size: %d bytes, max size: %d bytes", totalSize, cfg.MaxSize)
+	if dryRun {
+		log.Printf("dry run, nothing is deleted")
 	}
-	log.Printf("doing cleanup...")
 
-	sort.Sort(files)
-	hashes := make(map[string]time.Duration)
-	for _, file := range files {
-		fileHash := hashRexp.FindString(filepath.Base(file.Path))
-		fileAge := now.Sub(file.Timestamp)
+	deletedRefs := make(map[string]struct{})
+	removed := make(map[*Chain]struct{})
+	remove := func(chain *Chain) error {
+		if err := chain.remove(dryRun); err != nil {
+			return err
+		}
+		for _, refFile := range chain.RefFiles {
+			deletedRefs[refFile] = struct{}{}
+		}
+		removed[chain] = struct{}{}
+		totalSize -= chain.Size
+		log.Printf("%v: deleted %d bytes, %d increments, age: %v", chain,
+			chain.Size, len(chain.Increments), time.Since(chain.Timestamp).Truncate(time.Minute))
+		return nil
+	}
 
-		if age, exists := hashes[fileHash]; exists {
-			if fileAge > age {
-				hashes[fileHash] = fileAge
+	newest := chains.newestComplete()
+	byDir := make(map[string]Chains)
+	var dirs []string
+	for _, chain := range chains {
+		if _, ok := byDir[chain.Dir]; !ok {
+			dirs = append(dirs, chain.Dir)
+		}
+		byDir[chain.Dir] = append(byDir[chain.Dir], chain)
+	}
+	sort.Strings(dirs)
+	now := time.Now()
+	for _, dir := range dirs {
+		retention := cfg.Retention
+		if host := hostFor(cfg, dir); host != nil && host.Retention != nil {
+			retention = host.Retention
+		}
+		if !retention.enabled() {
+			continue
+		}
+		keep := retention.keep(byDir[dir], newest[dir], now)
+		for _, chain := range byDir[dir] {
+			if reasons, ok := keep[chain]; ok {
+				log.Printf("%v: keep (%v)", chain, strings.Join(reasons, ", "))
+				continue
+			}
+			log.Printf("%v: prune", chain)
+			if err = remove(chain); err != nil {
+				return err
 			}
+		}
+	}
+
+	for _, dir := range dirs {
+		host := hostFor(cfg, dir)
+		if host == nil || host.MaxSize <= 0 {
 			continue
 		}
-		hashes[fileHash] = fileAge
+		var hostSize int64
+		for _, chain := range byDir[dir] {
+			if _, ok := removed[chain]; !ok {
+				hostSize += chain.Size
+			}
+		}
+		log.Printf("%v: size: %d bytes, quota: %d bytes", host.Hostname, hostSize, host.MaxSize)
+		if n := newest[dir]; n == nil {
+			log.Printf("%v: WARNING: no complete chain", host.Hostname)
+		} else if n.Size > host.MaxSize {
+			log.Printf("%v: WARNING: newest chain %v alone uses %d bytes, over the %d byte quota",
+				host.Hostname, n, n.Size, host.MaxSize)
+		}
+		for _, chain := range byDir[dir] {
+			if hostSize <= host.MaxSize {
+				break
+			}
+			if _, ok := removed[chain]; ok || newest[dir] == chain {
+				continue
+			}
+			if err = remove(chain); err != nil {
+				return err
+			}
+			hostSize -= chain.Size
+		}
+		if hostSize > host.MaxSize {
+			log.Printf("%v: still %d bytes over quota, newest chain kept",
+				host.Hostname, hostSize-host.MaxSize)
+		}
 	}
 
-	for hash, age := range hashes {
-		var size int64
-		for _, file := range files {
-			fileHash := hashRexp.FindString(filepath.Base(file.Path))
-			if fileHash != hash {
+	var kept Chains
+	for _, chain := range chains {
+		if _, ok := removed[chain]; !ok {
+			kept = append(kept, chain)
+		}
+	}
+
+	if totalSize > cfg.MaxSize {
+		log.Printf("doing cleanup...")
+		for _, chain := range kept {
+			if totalSize <= cfg.MaxSize {
+				break
+			}
+			if newest[chain.Dir] == chain {
 				continue
 			}
-			size += file.Size
-			totalSize -= file.Size
-			log.Printf("%q: delete", file.Path)
+			if err = remove(chain); err != nil {
+				return err
+			}
+		}
+		if totalSize > cfg.MaxSize {
+			log.Printf("still %d bytes over max size, newest chains kept", totalSize-cfg.MaxSize)
+		}
+	}
+
+	return collectChunks(cfg.StoragePath, deletedRefs, dryRun)
+}
+
+// collectChunks removes chunks that are no longer listed in the reference
+// list of any increment below storagePath, ignoring the lists in deleted.
+func collectChunks(storagePath string, deleted map[string]struct{}, dryRun bool) error {
+	chunkPath := filepath.Join(storagePath, chunkDir)
+	if _, err := os.Stat(chunkPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	referenced := make(map[string]struct{})
+	refFiles, err := filepath.Glob(filepath.Join(storagePath, "*", "*.refs"))
+	if err != nil {
+		return err
+	}
+	for _, refFile := range refFiles {
+		if _, ok := deleted[refFile]; ok {
+			continue
+		}
+		fd, err := os.Open(refFile)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(fd)
+		for scanner.Scan() {
+			referenced[scanner.Text()] = struct{}{}
 		}
-		log.Printf("%s: deleted %d bytes, age: %v", hash, size, age)
-		if totalSize <= maxSize {
-			break
+		err = scanner.Err()
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("%q: %v", refFile, err)
 		}
 	}
 
+	var size, count int64
+	now := time.Now()
+	err = filepath.Walk(chunkPath, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		matches := chunkRexp.FindStringSubmatch(info.Name())
+		if !info.Mode().IsRegular() || matches == nil {
+			return nil
+		}
+		if _, ok := referenced[matches[1]]; ok {
+			return nil
+		}
+		if now.Sub(info.ModTime()) < chunkGracePeriod {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(srcPath); err != nil {
+				return err
+			}
+		}
+		size += info.Size()
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("chunks: deleted %d unreferenced chunks, %d bytes", count, size)
 	return nil
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileRexp(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name  string
+		host  string
+		id    string
+		level int
+		kind  string
+	}{
+		{"202001010000-h.example.com.0.gz.enc", "h.example.com", "", 0, "increment"},
+		{"202001010000-h.example.com.3.zst.enc", "h.example.com", "", 3, "increment"},
+		{"202001010000-h.example.com.12.lz4.enc", "h.example.com", "", 12, "increment"},
+		{"202001010000-h.example.com.1.enc", "h.example.com", "", 1, "increment"},
+		{"202001010000-db1.example.com." + id + ".0.gz.enc", "db1.example.com", id, 0, "increment"},
+		{"202001010000-db1.example.com." + id + ".2.zst.enc", "db1.example.com", id, 2, "increment"},
+		{"202001010000-db1.example.com." + id + ".1.lz4.enc", "db1.example.com", id, 1, "increment"},
+		{"202001010000-db1.example.com." + id + ".4.enc", "db1.example.com", id, 4, "increment"},
+		{"202001010000-h.1.refs", "h", "", -1, "refs"},
+		{"202001010000-h." + id + ".1.refs", "h", id, -1, "refs"},
+		{"202001010000-h.1.manifest", "h", "", -1, "manifest"},
+		{"202001010000-h." + id + ".0.manifest", "h", id, -1, "manifest"},
+		{"202001010000-h.0.gz", "", "", -1, ""},
+		{"202001010000-h.0.bz2.enc", "", "", -1, ""},
+		{"20200101-h.0.gz.enc", "", "", -1, ""},
+		{"notes.txt", "", "", -1, ""},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "agent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, filepath.Join(dir, "h"), 10, test.name, "sig.cache")
+		chains, total, err := loadChains(dir)
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if total != 20 {
+			t.Fatalf("%v: total size %d", test.name, total)
+		}
+		if test.kind == "" {
+			if len(chains) != 0 {
+				t.Fatalf("%v: matched %v", test.name, chains[0])
+			}
+			continue
+		}
+		if len(chains) != 1 {
+			t.Fatalf("%v: %d chains", test.name, len(chains))
+		}
+		c := chains[0]
+		if c.Hostname != test.host || c.ID != test.id || c.Timestamp.Format("200601021504") != "202001010000" {
+			t.Fatalf("%v: chain %v", test.name, c)
+		}
+		switch test.kind {
+		case "increment":
+			if len(c.Increments) != 1 || c.Increments[0].Level != uint16(test.level) {
+				t.Fatalf("%v: increments %+v", test.name, c.Increments)
+			}
+		case "refs":
+			if len(c.RefFiles) != 1 || len(c.Increments) != 0 {
+				t.Fatalf("%v: not a reference list", test.name)
+			}
+		case "manifest":
+			if len(c.Manifests) != 1 || len(c.Increments) != 0 {
+				t.Fatalf("%v: not a manifest", test.name)
+			}
+		}
+	}
+}
+
+func TestLoadChainsChainID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id1 := "0123456789abcdef0123456789abcdef"
+	id2 := "fedcba9876543210fedcba9876543210"
+	writeFiles(t, filepath.Join(dir, "h.example.com"), 10,
+		"202001010000-h.example.com."+id1+".0.gz.enc",
+		"202001010000-h.example.com."+id1+".1.zst.enc",
+		"202001010000-h.example.com."+id1+".1.manifest",
+		"202001010000-h.example.com."+id1+".1.refs",
+		"202001010000-h.example.com."+id2+".0.enc",
+		"202001010000-h.example.com.0.gz.enc")
+
+	chains, _, err := loadChains(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 3 {
+		t.Fatalf("got %d chains", len(chains))
+	}
+	for i, want := range []struct {
+		id     string
+		levels int
+	}{{"", 1}, {id1, 2}, {id2, 1}} {
+		c := chains[i]
+		if c.ID != want.id || c.Hostname != "h.example.com" || len(c.Increments) != want.levels {
+			t.Fatalf("chain %d: %v with %d increments", i, c, len(c.Increments))
+		}
+	}
+	if len(chains[1].Manifests) != 1 || len(chains[1].RefFiles) != 1 || chains[1].Size != 40 {
+		t.Fatalf("manifest and references not grouped with their chain")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	a := []string{
+		"a/202001010000-a.0.gz.enc", "a/202001010000-a.1.gz.enc", "a/202001010000-a.1.manifest",
+		"a/202002010000-a.0.zst.enc",
+		"a/202003010000-a." + id + ".0.enc",
+	}
+	// The newest chain of b lost level 0, so the older one is its newest
+	// complete chain.
+	b := []string{
+		"b/201901010000-b.0.lz4.enc", "b/201901010000-b.0.refs",
+		"b/202004010000-b.1.gz.enc",
+	}
+
+	tests := []struct {
+		name    string
+		files   []string
+		maxSize int64
+		hosts   []Host
+		dryRun  bool
+		deleted []string
+		// logged are messages cleanup must log.
+		logged []string
+	}{
+		{
+			name:    "oldest first",
+			files:   a,
+			maxSize: 250,
+			deleted: a[:3],
+		},
+		{
+			name:    "newest complete kept",
+			files:   b,
+			maxSize: 1,
+			deleted: b[2:],
+		},
+		{
+			name:    "all hosts over max size",
+			files:   append(append([]string{}, a...), b...),
+			maxSize: 1,
+			deleted: append(append([]string{}, a[:4]...), b[2:]...),
+		},
+		{
+			name:    "dry run",
+			files:   append(append([]string{}, a...), b...),
+			maxSize: 1,
+			dryRun:  true,
+		},
+		{
+			name:    "under max size",
+			files:   a,
+			maxSize: 500,
+		},
+		{
+			name:    "host quota",
+			files:   append(append([]string{}, a...), b...),
+			maxSize: 1 << 20,
+			hosts:   []Host{{Hostname: "a", MaxSize: 150}, {Hostname: "b"}},
+			deleted: a[:4],
+			logged:  []string{"a: size: 500 bytes, quota: 150 bytes"},
+		},
+		{
+			name:    "newest chain over host quota",
+			files:   append(append([]string{}, b...), "b/202005010000-b.0.gz.enc", "b/202005010000-b.1.gz.enc"),
+			maxSize: 1 << 20,
+			hosts:   []Host{{Hostname: "b", MaxSize: 150}},
+			deleted: b,
+			logged: []string{
+				"b: WARNING: newest chain b/202005010000-b alone uses 200 bytes, over the 150 byte quota",
+				"b: still 50 bytes over quota, newest chain kept",
+			},
+		},
+		{
+			name:    "host quota then max size",
+			files:   append(append([]string{}, a...), b...),
+			maxSize: 250,
+			hosts:   []Host{{Hostname: "a", MaxSize: 250}},
+			deleted: append(append([]string{}, a[:4]...), b[2:]...),
+			logged:  []string{"still 50 bytes over max size, newest chains kept"},
+		},
+		{
+			name:    "dry run over host quota",
+			files:   a,
+			maxSize: 1 << 20,
+			hosts:   []Host{{Hostname: "a", MaxSize: 150}},
+			dryRun:  true,
+		},
+	}
+	defer log.SetOutput(log.Writer())
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "agent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range test.files {
+			writeFiles(t, filepath.Join(dir, filepath.Dir(name)), 100, filepath.Base(name))
+		}
+		cfg := &config{StoragePath: dir, MaxSize: test.maxSize, Hosts: test.hosts}
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		err = cleanup(cfg, test.dryRun)
+		deleted := make(map[string]bool)
+		for _, name := range test.deleted {
+			deleted[name] = true
+		}
+		for _, name := range test.files {
+			if exists(filepath.Join(dir, name)) == deleted[name] {
+				t.Errorf("%v: %v deleted: %v", test.name, name, !deleted[name])
+			}
+		}
+		for _, msg := range test.logged {
+			if !strings.Contains(logged.String(), msg) {
+				t.Errorf("%v: %q not logged", test.name, msg)
+			}
+		}
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+	}
+}
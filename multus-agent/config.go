@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -14,7 +18,24 @@ var (
 
 type Host struct {
 	Hostname   string
+	Port       int
 	BackupPath string
+	Dedup      bool
+	// MaxSize is the optional quota of the host's increments in bytes.
+	// Chunks shared between hosts do not count against it.
+	MaxSize int64
+	// Retention overrides the global retention rules for this host.
+	Retention *Retention
+	// Timeout overrides the global sync timeout for this host.
+	Timeout string
+	timeout time.Duration
+	// StaleAfter overrides the global stale threshold for this host.
+	StaleAfter string
+	staleAfter time.Duration
+	// ManifestKey is the hex encoded public key the host signs manifests
+	// with.  When set, every increment needs a valid manifest.
+	ManifestKey string
+	manifestKey ed25519.PublicKey
 }
 
 type config struct {
@@ -22,7 +43,27 @@ type config struct {
 	BWLimit     string
 	MaxSize     int64
 	Login       string
-	Hosts       []Host
+	// IdentityFile and KnownHostsFile default to the files below ~/.ssh.
+	IdentityFile   string
+	KnownHostsFile string
+	Retention      *Retention
+	// Concurrency is the number of hosts synced at once.
+	Concurrency int
+	// Timeout bounds every sync attempt of a host, unlimited when empty.
+	// Failed attempts are retried Retries times, waiting RetryDelay
+	// before the first retry and twice as long before each further one.
+	Timeout    string
+	Retries    int
+	RetryDelay string
+	timeout    time.Duration
+	retryDelay time.Duration
+	// StaleAfter flags hosts whose newest increment is older, disabled
+	// when empty.
+	StaleAfter string
+	staleAfter time.Duration
+	// Mirror optionally copies the storage path into a bucket.
+	Mirror *Mirror
+	Hosts  []Host
 }
 
 func loadConfig() (*config, error) {
@@ -32,7 +73,11 @@ func loadConfig() (*config, error) {
 		return nil, err
 	}
 
-	cfg := config{}
+	cfg := config{
+		Concurrency: 4,
+		Retries:     2,
+		RetryDelay:  "30s",
+	}
 	if err = yaml.UnmarshalStrict(configFile, &cfg); err != nil {
 		return nil, err
 	}
@@ -52,13 +97,70 @@ func loadConfig() (*config, error) {
 	if len(cfg.Login) == 0 {
 		return nil, fmt.Errorf("login not set")
 	}
-	for _, host := range cfg.Hosts {
+	if len(cfg.IdentityFile) == 0 || len(cfg.KnownHostsFile) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.IdentityFile) == 0 {
+			cfg.IdentityFile = filepath.Join(home, ".ssh", "id_ed25519")
+		}
+		if len(cfg.KnownHostsFile) == 0 {
+			cfg.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+	}
+	if cfg.Concurrency < 1 {
+		return nil, fmt.Errorf("invalid concurrency %d", cfg.Concurrency)
+	}
+	if cfg.Retries < 0 {
+		return nil, fmt.Errorf("invalid retries %d", cfg.Retries)
+	}
+	if len(cfg.Timeout) != 0 {
+		if cfg.timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %v", err)
+		}
+	}
+	if cfg.retryDelay, err = time.ParseDuration(cfg.RetryDelay); err != nil {
+		return nil, fmt.Errorf("invalid retrydelay: %v", err)
+	}
+	if len(cfg.StaleAfter) != 0 {
+		if cfg.staleAfter, err = time.ParseDuration(cfg.StaleAfter); err != nil {
+			return nil, fmt.Errorf("invalid staleafter: %v", err)
+		}
+	}
+	if cfg.Mirror != nil {
+		if err = cfg.Mirror.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.Hosts {
+		host := &cfg.Hosts[i]
 		if len(host.Hostname) == 0 {
 			return nil, fmt.Errorf("missing hostname")
 		}
 		if len(host.BackupPath) == 0 {
 			return nil, fmt.Errorf("missing backup path for %v", host.Hostname)
 		}
+		if host.MaxSize < 0 {
+			return nil, fmt.Errorf("invalid maxsize for %v", host.Hostname)
+		}
+		if len(host.Timeout) != 0 {
+			if host.timeout, err = time.ParseDuration(host.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout for %v: %v", host.Hostname, err)
+			}
+		}
+		if len(host.StaleAfter) != 0 {
+			if host.staleAfter, err = time.ParseDuration(host.StaleAfter); err != nil {
+				return nil, fmt.Errorf("invalid staleafter for %v: %v", host.Hostname, err)
+			}
+		}
+		if len(host.ManifestKey) != 0 {
+			key, err := hex.DecodeString(host.ManifestKey)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid manifestkey for %v", host.Hostname)
+			}
+			host.manifestKey = key
+		}
 	}
 	return &cfg, nil
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/companyzero/multus/format"
+)
+
+// readManifest parses the manifest at path.  The signature is checked when
+// key is not nil.
+func readManifest(path string, key ed25519.PublicKey) (*format.Manifest, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return format.ParseManifest(buf, key)
+}
+
+// verifyCacheName is the file below the storage path listing the increments
+// whose hash matched their manifest.
+const verifyCacheName = "verify.cache"
+
+// verifiedFile is an increment as it was when its hash was checked.
+type verifiedFile struct {
+	Size    int64
+	ModTime int64
+	SHA256  [sha256.Size]byte
+}
+
+// verifyCache remembers the increments that matched their manifest, so
+// verify only hashes increments that are new or changed since the last run.
+type verifyCache struct {
+	path  string
+	files map[string]verifiedFile
+	seen  map[string]bool
+}
+
+// loadVerifyCache reads the cache at path.  A missing file is an empty
+// cache and lines that do not parse are dropped.
+func loadVerifyCache(path string) (*verifyCache, error) {
+	c := &verifyCache{
+		path:  path,
+		files: make(map[string]verifiedFile),
+		seen:  make(map[string]bool),
+	}
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		var vf verifiedFile
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != len(vf.SHA256) {
+			continue
+		}
+		copy(vf.SHA256[:], sum)
+		if vf.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			continue
+		}
+		if vf.ModTime, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			continue
+		}
+		c.files[fields[3]] = vf
+	}
+	return c, scanner.Err()
+}
+
+// lookup returns the hash inc had when it was verified, if its size and
+// modification time did not change since.
+func (c *verifyCache) lookup(inc *Increment) ([sha256.Size]byte, bool) {
+	vf, ok := c.files[inc.Path]
+	if !ok || vf.Size != inc.Size || vf.ModTime != inc.ModTime.UnixNano() {
+		return [sha256.Size]byte{}, false
+	}
+	c.seen[inc.Path] = true
+	return vf.SHA256, true
+}
+
+// add records that inc hashed to sum.
+func (c *verifyCache) add(inc *Increment, sum [sha256.Size]byte) {
+	c.files[inc.Path] = verifiedFile{
+		Size:    inc.Size,
+		ModTime: inc.ModTime.UnixNano(),
+		SHA256:  sum,
+	}
+	c.seen[inc.Path] = true
+}
+
+// save replaces the cache file with the increments looked up or added
+// during this run, dropping the ones that were deleted or failed.
+func (c *verifyCache) save() error {
+	tmp := c.path + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	for path, vf := range c.files {
+		if c.seen[path] {
+			fmt.Fprintf(w, "%x %d %d %s\n", vf.SHA256, vf.Size, vf.ModTime, path)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// verifyManifest checks the increment inc of chain against its manifest.
+// The increment is only hashed when cache has no match for it.
+func verifyManifest(chain *Chain, inc *Increment, key ed25519.PublicKey, cache *verifyCache) error {
+	m, err := readManifest(format.ManifestName(inc.Path), key)
+	if err != nil {
+		return err
+	}
+	ts := m.Timestamp
+	if m.Hostname != chain.Hostname || m.Increment != inc.Level ||
+		(chain.ID != "" && m.ChainID.String() != chain.ID) ||
+		ts.Before(chain.Timestamp.Add(-tzSlack)) || ts.After(chain.Timestamp.Add(tzSlack)) {
+		return fmt.Errorf("manifest of %v level %d at %v does not match",
+			m.Hostname, m.Increment, ts)
+	}
+
+	if sum, ok := cache.lookup(inc); ok && inc.Size == m.Size && sum == m.SHA256 {
+		return nil
+	}
+
+	fd, err := os.Open(inc.Path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, fd)
+	if err != nil {
+		return err
+	}
+	if n != m.Size {
+		return fmt.Errorf("size %d, manifest has %d", n, m.Size)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if sum != m.SHA256 {
+		return fmt.Errorf("sha256 does not match manifest")
+	}
+	cache.add(inc, sum)
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/companyzero/multus/storage"
+)
+
+// Mirror is an S3-compatible bucket holding a copy of the storage path.  The
+// bucket has the layout of the storage path, so multus can restore a host
+// from it with the prefix set to the host directory.
+type Mirror struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// ObjectLockMode is GOVERNANCE or COMPLIANCE.  Uploads are locked for
+	// RetainDays days.
+	ObjectLockMode string
+	RetainDays     int
+}
+
+func (m *Mirror) validate() error {
+	if len(m.Endpoint) == 0 || len(m.Bucket) == 0 {
+		return fmt.Errorf("mirror: endpoint and bucket are required")
+	}
+	switch m.ObjectLockMode {
+	case "":
+		if m.RetainDays != 0 {
+			return fmt.Errorf("mirror: retaindays requires objectlockmode")
+		}
+	case "GOVERNANCE", "COMPLIANCE":
+		if m.RetainDays <= 0 {
+			return fmt.Errorf("mirror: objectlockmode requires retaindays")
+		}
+	default:
+		return fmt.Errorf("mirror: invalid objectlockmode %q", m.ObjectLockMode)
+	}
+	return nil
+}
+
+// open returns the bucket with object lock applied to all uploads.
+func (m *Mirror) open() (*storage.S3, error) {
+	s3, err := storage.NewS3(&storage.Config{
+		Type:      "s3",
+		Endpoint:  m.Endpoint,
+		Region:    m.Region,
+		Bucket:    m.Bucket,
+		Prefix:    m.Prefix,
+		AccessKey: m.AccessKey,
+		SecretKey: m.SecretKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m.ObjectLockMode != "" {
+		until := time.Now().Add(time.Duration(m.RetainDays) * 24 * time.Hour)
+		s3.SetUploadHeader("X-Amz-Object-Lock-Mode", m.ObjectLockMode)
+		s3.SetUploadHeader("X-Amz-Object-Lock-Retain-Until-Date", until.UTC().Format(time.RFC3339))
+	}
+	return s3, nil
+}
+
+// MirrorResult describes a mirror run.
+type MirrorResult struct {
+	Uploaded int
+	Bytes    int64
+	Deleted  int
+}
+
+// mirrorFile reports whether name in a host directory is mirrored.
+func mirrorFile(name string) bool {
+	return fileRexp.MatchString(name) || strings.HasSuffix(name, ".refs") ||
+		strings.HasSuffix(name, ".manifest") || name == "sig.cache"
+}
+
+// mirror brings store up to date with the host directories and the chunks
+// below cfg.StoragePath.  Chunks are uploaded before the increments
+// referencing them and deleted after them, so the bucket stays restorable
+// when a run is interrupted.
+//
+// Deleting an object under object lock only hides it: the locked version
+// is kept until its retention ends and the bucket's lifecycle rules expire
+// it.
+func mirror(cfg *config, store storage.Backend, dryRun bool) (*MirrorResult, error) {
+	result := &MirrorResult{}
+
+	chunkRoot := filepath.Join(cfg.StoragePath, chunkDir)
+	chunkDirs, err := ioutil.ReadDir(chunkRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	var chunkNames []string
+	for _, d := range chunkDirs {
+		if d.IsDir() {
+			chunkNames = append(chunkNames, path.Join(chunkDir, d.Name()))
+		}
+	}
+	isChunk := func(name string) bool {
+		return chunkRexp.MatchString(name)
+	}
+
+	var hostNames []string
+	for _, host := range cfg.Hosts {
+		hostNames = append(hostNames, host.Hostname)
+	}
+	sort.Strings(hostNames)
+
+	// All chunk directories are pruned, including the ones already
+	// removed locally.
+	var pruneChunkNames []string
+	for i := 0; i < 256; i++ {
+		pruneChunkNames = append(pruneChunkNames, path.Join(chunkDir, fmt.Sprintf("%02x", i)))
+	}
+
+	passes := []struct {
+		dirs  []string
+		match func(string) bool
+		prune bool
+	}{
+		{chunkNames, isChunk, false},
+		{hostNames, mirrorFile, false},
+		{hostNames, mirrorFile, true},
+		{pruneChunkNames, isChunk, true},
+	}
+	for _, pass := range passes {
+		for _, dir := range pass.dirs {
+			if err := mirrorDir(cfg, store, dir, pass.match, pass.prune, dryRun, result); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// mirrorDir uploads the files of dir matching match that are missing from
+// store or changed, or, when prune is set, deletes the ones no longer
+// present locally.
+func mirrorDir(cfg *config, store storage.Backend, dir string, match func(string) bool, prune, dryRun bool,
+	result *MirrorResult) error {
+
+	remote, err := store.List(dir)
+	if err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+	remoteFiles := make(map[string]storage.FileInfo)
+	for _, f := range remote {
+		remoteFiles[f.Name] = f
+	}
+	localDir := filepath.Join(cfg.StoragePath, filepath.FromSlash(dir))
+	local, err := ioutil.ReadDir(localDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	localFiles := make(map[string]os.FileInfo)
+	for _, f := range local {
+		if f.Mode().IsRegular() && match(f.Name()) {
+			localFiles[f.Name()] = f
+		}
+	}
+
+	if prune {
+		var names []string
+		for name := range remoteFiles {
+			if _, ok := localFiles[name]; !ok && match(name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			name = path.Join(dir, name)
+			log.Printf("mirror: %q: delete", name)
+			result.Deleted++
+			if dryRun {
+				continue
+			}
+			if err := store.Remove(name); err != nil && !storage.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// sig.cache goes last so it never describes increments the bucket
+	// does not have yet.
+	var names []string
+	for name, f := range localFiles {
+		r, ok := remoteFiles[name]
+		if ok && r.Size == f.Size() && !f.ModTime().After(r.ModTime) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if (names[a] == "sig.cache") != (names[b] == "sig.cache") {
+			return names[b] == "sig.cache"
+		}
+		return names[a] < names[b]
+	})
+	for _, name := range names {
+		size := localFiles[name].Size()
+		name = path.Join(dir, name)
+		log.Printf("mirror: %q: upload %d bytes", name, size)
+		result.Uploaded++
+		result.Bytes += size
+		if dryRun {
+			continue
+		}
+		if err := upload(store, filepath.Join(cfg.StoragePath, filepath.FromSlash(name)), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upload(store storage.Backend, localPath, name string) error {
+	fd, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	w, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, fd); err != nil {
+		w.Abort()
+		return fmt.Errorf("%q: %v", name, err)
+	}
+	return w.Close()
+}
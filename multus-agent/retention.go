@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retention selects the chains of a host that are kept.  Each keep rule
+// keeps the newest chain of the last N days, weeks, months or years that
+// have one.  Chains younger than MinAgeDays are never pruned.
+type Retention struct {
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	MinAgeDays  int
+}
+
+func (r *Retention) enabled() bool {
+	return r != nil && (r.KeepDaily > 0 || r.KeepWeekly > 0 ||
+		r.KeepMonthly > 0 || r.KeepYearly > 0 || r.MinAgeDays > 0)
+}
+
+// keep returns why each kept chain of a single host is kept.  Chains missing
+// from the result are pruned.  chains must be sorted oldest first.  newest,
+// the newest complete chain, and the chains after it, which may still be
+// arriving, are always kept.  Without a complete chain nothing is pruned.
+func (r *Retention) keep(chains Chains, newest *Chain, now time.Time) map[*Chain][]string {
+	rules := []struct {
+		name   string
+		n      int
+		bucket func(t time.Time) string
+	}{
+		{"daily", r.KeepDaily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}},
+		{"weekly", r.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{"monthly", r.KeepMonthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+		{"yearly", r.KeepYearly, func(t time.Time) string {
+			return t.Format("2006")
+		}},
+	}
+
+	kept := make(map[*Chain][]string)
+	if newest != nil {
+		kept[newest] = append(kept[newest], "newest")
+	}
+	minAge := time.Duration(r.MinAgeDays) * 24 * time.Hour
+	for i := len(chains) - 1; i >= 0; i-- {
+		if newest == nil || chains[i].Timestamp.After(newest.Timestamp) {
+			kept[chains[i]] = append(kept[chains[i]], "newer than newest complete")
+		}
+		if now.Sub(chains[i].Timestamp) < minAge {
+			kept[chains[i]] = append(kept[chains[i]], "min age")
+		}
+	}
+	for _, rule := range rules {
+		seen := make(map[string]struct{})
+		for i := len(chains) - 1; i >= 0 && len(seen) < rule.n; i-- {
+			chain := chains[i]
+			if !chain.Complete() {
+				continue
+			}
+			bucket := rule.bucket(chain.Timestamp)
+			if _, ok := seen[bucket]; ok {
+				continue
+			}
+			seen[bucket] = struct{}{}
+			kept[chain] = append(kept[chain], rule.name)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionKeep(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	// series returns a complete chain every step for the n steps before
+	// now, oldest first.
+	series := func(n int, step time.Duration) Chains {
+		var chains Chains
+		for i := n; i > 0; i-- {
+			chains = append(chains, &Chain{
+				Dir:        "host",
+				Timestamp:  now.Add(-time.Duration(i) * step),
+				Increments: []Increment{{Level: 0}},
+			})
+		}
+		return chains
+	}
+	const day = 24 * time.Hour
+	// incomplete drops level 0 of the last n chains.
+	incomplete := func(chains Chains, n int) Chains {
+		for _, c := range chains[len(chains)-n:] {
+			c.Increments = []Increment{{Level: 1}}
+		}
+		return chains
+	}
+
+	tests := []struct {
+		name      string
+		retention Retention
+		chains    Chains
+		// newest indexes chains, -1 for none.
+		newest int
+		want   string
+	}{
+		{
+			name:      "daily",
+			retention: Retention{KeepDaily: 3},
+			chains:    series(20, 12*time.Hour),
+			newest:    19,
+			want:      "2020-06-13 12:00 2020-06-14 12:00 2020-06-15 00:00",
+		},
+		{
+			name:      "weekly",
+			retention: Retention{KeepWeekly: 2},
+			chains:    series(21, day),
+			newest:    20,
+			want:      "2020-06-07 12:00 2020-06-14 12:00",
+		},
+		{
+			name:      "monthly",
+			retention: Retention{KeepMonthly: 3},
+			chains:    series(100, day),
+			newest:    99,
+			want:      "2020-04-30 12:00 2020-05-31 12:00 2020-06-14 12:00",
+		},
+		{
+			name:      "yearly",
+			retention: Retention{KeepYearly: 2},
+			chains:    series(400, day),
+			newest:    399,
+			want:      "2019-12-31 12:00 2020-06-14 12:00",
+		},
+		{
+			name:      "overlapping rules",
+			retention: Retention{KeepDaily: 3, KeepMonthly: 2, KeepYearly: 2},
+			chains:    series(400, day),
+			newest:    399,
+			want:      "2019-12-31 12:00 2020-05-31 12:00 2020-06-12 12:00 2020-06-13 12:00 2020-06-14 12:00",
+		},
+		{
+			name:      "min age",
+			retention: Retention{MinAgeDays: 5},
+			chains:    series(10, day),
+			newest:    9,
+			want:      "2020-06-11 12:00 2020-06-12 12:00 2020-06-13 12:00 2020-06-14 12:00",
+		},
+		{
+			name:      "newer than newest complete",
+			retention: Retention{KeepDaily: 1},
+			chains:    incomplete(series(5, day), 2),
+			newest:    2,
+			want:      "2020-06-12 12:00 2020-06-13 12:00 2020-06-14 12:00",
+		},
+		{
+			name:      "incomplete chains skipped by rules",
+			retention: Retention{KeepDaily: 2},
+			chains:    incomplete(series(5, day)[:4], 1),
+			newest:    2,
+			want:      "2020-06-11 12:00 2020-06-12 12:00 2020-06-13 12:00",
+		},
+		{
+			name:      "no complete chain",
+			retention: Retention{KeepDaily: 1},
+			chains:    incomplete(series(3, day), 3),
+			newest:    -1,
+			want:      "2020-06-12 12:00 2020-06-13 12:00 2020-06-14 12:00",
+		},
+	}
+	for _, test := range tests {
+		var newest *Chain
+		if test.newest >= 0 {
+			newest = test.chains[test.newest]
+		}
+		kept := test.retention.keep(test.chains, newest, now)
+		var got []string
+		for c := range kept {
+			got = append(got, c.Timestamp.Format("2006-01-02 15:04"))
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%v: kept %q, want %q", test.name, got, test.want)
+		}
+	}
+}
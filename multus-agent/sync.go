@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// syncer pulls the backups of a single host.
+type syncer interface {
+	Sync(ctx context.Context, host *Host, storagePath, chunkPath string) (*SyncResult, error)
+}
+
+// HostResult describes the sync of a host, including all retries.
+type HostResult struct {
+	Hostname string
+	Attempts int
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+func (r *HostResult) status() string {
+	switch {
+	case r.Err == nil && r.Attempts > 1:
+		return fmt.Sprintf("ok (%d attempts)", r.Attempts)
+	case r.Err == nil:
+		return "ok"
+	case errors.Is(r.Err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "failed"
+}
+
+// syncHosts syncs all configured hosts, at most cfg.Concurrency at a time,
+// and returns their results in configuration order.
+func syncHosts(ctx context.Context, cfg *config, t syncer) []HostResult {
+	results := make([]HostResult, len(cfg.Hosts))
+	sem := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i := range cfg.Hosts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = HostResult{Hostname: cfg.Hosts[i].Hostname, Err: ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
+			results[i] = syncHost(ctx, cfg, t, &cfg.Hosts[i])
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// syncHost syncs host, retrying failed attempts with exponential backoff.
+// Every attempt is bounded by the host timeout.  Retries continue the
+// transfers of the previous attempt.
+func syncHost(ctx context.Context, cfg *config, t syncer, host *Host) HostResult {
+	start := time.Now()
+	result := HostResult{Hostname: host.Hostname}
+	storagePath := filepath.Join(cfg.StoragePath, host.Hostname)
+	if err := os.MkdirAll(storagePath, 0700); err != nil {
+		result.Err = err
+		return result
+	}
+	// Chunks are shared by all hosts so identical data is only stored
+	// once.
+	chunkPath := filepath.Join(cfg.StoragePath, chunkDir)
+
+	timeout := cfg.timeout
+	if host.timeout != 0 {
+		timeout = host.timeout
+	}
+	delay := cfg.retryDelay
+	for {
+		result.Attempts++
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		sr, err := t.Sync(attemptCtx, host, storagePath, chunkPath)
+		if err != nil && attemptCtx.Err() != nil {
+			err = fmt.Errorf("%v: %w", err, attemptCtx.Err())
+		}
+		cancel()
+		if sr != nil {
+			for _, f := range sr.Files {
+				resumed := ""
+				if f.Resumed {
+					resumed = " (resumed)"
+				}
+				fmt.Printf("%s: %d bytes%s sha256:%s\n", f.Path, f.Bytes, resumed, f.SHA256)
+			}
+			result.Files += len(sr.Files)
+			result.Bytes += sr.Bytes
+		}
+		result.Err = err
+		if err == nil || result.Attempts > cfg.Retries || ctx.Err() != nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "%v: attempt %d: %v, retrying in %v\n",
+			host.Hostname, result.Attempts, err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		delay *= 2
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// printSummary writes a table of results to w and reports whether all hosts
+// were synced.
+func printSummary(w io.Writer, results []HostResult) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTATUS\tBYTES\tDURATION\tERROR")
+	for i := range results {
+		r := &results[i]
+		errStr := ""
+		if r.Err != nil {
+			ok = false
+			errStr = r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%s\n", r.Hostname, r.status(), r.Bytes,
+			r.Duration.Truncate(time.Millisecond), errStr)
+	}
+	tw.Flush()
+	return ok
+}
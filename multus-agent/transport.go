@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/companyzero/multus/format"
+	"github.com/companyzero/multus/storage"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const partialSuffix = ".partial"
+
+// FileResult describes a single pulled file.
+type FileResult struct {
+	Path string
+	// Bytes is the amount transferred, which is less than Size for
+	// resumed transfers.
+	Bytes   int64
+	Size    int64
+	SHA256  string
+	Resumed bool
+}
+
+// SyncResult describes a host sync.
+type SyncResult struct {
+	Hostname string
+	Files    []FileResult
+	Skipped  int
+	Bytes    int64
+	Duration time.Duration
+}
+
+func (r *SyncResult) add(f *FileResult) {
+	if f == nil {
+		r.Skipped++
+		return
+	}
+	r.Files = append(r.Files, *f)
+	r.Bytes += f.Bytes
+}
+
+// parseBWLimit parses an rsync style bandwidth limit such as 1.5m into bytes
+// per second.  Without a suffix the value is in KiB.  Zero disables the
+// limit.
+func parseBWLimit(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	mult := float64(1 << 10)
+	if n := len(s); n != 0 {
+		switch s[n-1] {
+		case 'b':
+			mult = 1
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		}
+		if s[n-1] < '0' || s[n-1] > '9' {
+			s = s[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid bwlimit %q", s)
+	}
+	return int64(f * mult), nil
+}
+
+// rateLimiter limits the throughput of all readers wrapped by it.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.n += int64(n)
+	due := l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := l.r.Read(p)
+	if werr := l.limiter.wait(l.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// chunkLocks serializes the pulls of a chunk by hosts synced concurrently.
+type chunkLocks struct {
+	mu    sync.Mutex
+	locks map[string]*chunkLock
+}
+
+type chunkLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the chunk name and returns the function unlocking it.
+func (c *chunkLocks) lock(name string) func() {
+	c.mu.Lock()
+	if c.locks == nil {
+		c.locks = make(map[string]*chunkLock)
+	}
+	l, ok := c.locks[name]
+	if !ok {
+		l = new(chunkLock)
+		c.locks[name] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		c.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(c.locks, name)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// sftpTransport pulls backups from hosts over SFTP.
+type sftpTransport struct {
+	config  *ssh.ClientConfig
+	bwLimit int64
+	chunks  chunkLocks
+}
+
+// newSFTPTransport returns a transport authenticating as cfg.Login with the
+// configured identity and checking host keys against the known hosts file.
+func newSFTPTransport(cfg *config) (*sftpTransport, error) {
+	sshConfig, err := storage.SSHClientConfig(cfg.Login, cfg.IdentityFile, cfg.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	bwLimit, err := parseBWLimit(cfg.BWLimit)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpTransport{
+		config:  sshConfig,
+		bwLimit: bwLimit,
+	}, nil
+}
+
+// syncFile reports whether name in the top level backup directory is pulled.
+func syncFile(name string) bool {
+	return format.IsIncrement(name) || strings.HasSuffix(name, ".refs") ||
+		strings.HasSuffix(name, ".manifest") || name == "sig.cache"
+}
+
+// Sync pulls the increments of host into storagePath.  Chunks of dedup hosts
+// go to chunkPath, which is shared by all hosts.  They are staged below
+// storagePath, so a host never continues the partial chunk of another.
+func (t *sftpTransport) Sync(ctx context.Context, host *Host, storagePath, chunkPath string) (*SyncResult, error) {
+	start := time.Now()
+	result := &SyncResult{Hostname: host.Hostname}
+
+	port := host.Port
+	if port == 0 {
+		port = 22
+	}
+	client, err := storage.DialSSH(ctx, net.JoinHostPort(host.Hostname, strconv.Itoa(port)), t.config)
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+	// Unblock pending requests when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return result, err
+	}
+	defer sc.Close()
+
+	limiter := newRateLimiter(t.bwLimit)
+	backupPath := path.Clean(host.BackupPath)
+	infos, err := sc.ReadDir(backupPath)
+	if err != nil {
+		return result, err
+	}
+	// Manifests go first so increments are checked against them.
+	sort.SliceStable(infos, func(a, b int) bool {
+		return strings.HasSuffix(infos[a].Name(), ".manifest") &&
+			!strings.HasSuffix(infos[b].Name(), ".manifest")
+	})
+	updated := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !syncFile(name) {
+			continue
+		}
+		// Increments only grow while they are written, but sig.cache
+		// is rewritten by every run.
+		opts := pullOptions{resume: name != "sig.cache"}
+		if format.IsIncrement(name) {
+			manifestName := format.ManifestName(name)
+			m, err := readManifest(filepath.Join(storagePath, manifestName), host.manifestKey)
+			if err != nil && !os.IsNotExist(err) {
+				return result, fmt.Errorf("%v: %v", manifestName, err)
+			}
+			opts.manifest = m
+			// A new manifest means the increment may have been
+			// rewritten, so its size and modification time prove
+			// nothing.  Partial data is still resumed as the hash
+			// catches a mix of both versions.
+			opts.force = updated[manifestName]
+		}
+		var f *FileResult
+		if strings.HasSuffix(name, ".manifest") {
+			f, err = pullManifest(sc, path.Join(backupPath, name), info, filepath.Join(storagePath, name))
+		} else {
+			f, err = pull(ctx, sc, limiter, path.Join(backupPath, name), info,
+				filepath.Join(storagePath, name), opts)
+		}
+		if err != nil {
+			return result, err
+		}
+		updated[name] = f != nil
+		result.add(f)
+	}
+
+	if host.Dedup {
+		root := path.Join(backupPath, chunkDir)
+		stagePath := filepath.Join(storagePath, chunkDir)
+		walker := sc.Walk(root)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if walker.Path() == root && os.IsNotExist(err) {
+					break
+				}
+				return result, err
+			}
+			info := walker.Stat()
+			if !info.Mode().IsRegular() || !chunkRexp.MatchString(info.Name()) {
+				continue
+			}
+			rel := strings.TrimPrefix(walker.Path(), root+"/")
+			local := filepath.Join(chunkPath, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(local), 0700); err != nil {
+				return result, err
+			}
+			if err := os.MkdirAll(stagePath, 0700); err != nil {
+				return result, err
+			}
+			// Chunks only change when they are rekeyed.
+			opts := pullOptions{
+				resume:  true,
+				partial: filepath.Join(stagePath, info.Name()+partialSuffix),
+			}
+			unlock := t.chunks.lock(rel)
+			f, err := pull(ctx, sc, limiter, walker.Path(), info, local, opts)
+			unlock()
+			if err != nil {
+				return result, err
+			}
+			result.add(f)
+		}
+	}
+
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// pullManifest copies the manifest at remotePath to localPath unless both are
+// the same.  Rewritten manifests keep their size and may keep their
+// modification time, so they are always compared in full.  It returns nil
+// when nothing changed.
+func pullManifest(sc *sftp.Client, remotePath string, info os.FileInfo, localPath string) (*FileResult, error) {
+	remote, err := sc.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+	b, err := ioutil.ReadAll(remote)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", remotePath, err)
+	}
+	if old, err := ioutil.ReadFile(localPath); err == nil && bytes.Equal(old, b) {
+		return nil, nil
+	}
+	partial := localPath + partialSuffix
+	if err = ioutil.WriteFile(partial, b, 0600); err != nil {
+		return nil, err
+	}
+	if err = os.Chtimes(partial, info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(partial, localPath); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return &FileResult{
+		Path:   localPath,
+		Bytes:  int64(len(b)),
+		Size:   int64(len(b)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// pullOptions control a pull.
+type pullOptions struct {
+	// resume continues the partial file of an earlier pull.
+	resume bool
+	// force pulls the file even if the local copy looks up to date.
+	force bool
+	// partial is the file data is staged in, localPath with
+	// partialSuffix when empty.
+	partial string
+	// manifest, if not nil, describes the increment being pulled.  Data
+	// that does not match its size and SHA256 is discarded.
+	manifest *format.Manifest
+}
+
+// pull copies remotePath to localPath unless localPath already has the
+// remote size and modification time.  Data is staged in a partial file,
+// which a later pull continues when opts.resume is set.  It returns nil when
+// nothing had to be copied.
+func pull(ctx context.Context, sc *sftp.Client, limiter *rateLimiter, remotePath string, info os.FileInfo,
+	localPath string, opts pullOptions) (*FileResult, error) {
+
+	if st, err := os.Stat(localPath); err == nil && !opts.force {
+		if st.Size() == info.Size() && st.ModTime().Unix() == info.ModTime().Unix() {
+			return nil, nil
+		}
+	}
+	if m := opts.manifest; m != nil && m.Size != info.Size() {
+		return nil, fmt.Errorf("%v: size %d, manifest has %d", remotePath, info.Size(), m.Size)
+	}
+
+	partial := opts.partial
+	if partial == "" {
+		partial = localPath + partialSuffix
+	}
+	fd, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if fd != nil {
+			fd.Close()
+		}
+	}()
+	h := sha256.New()
+	var offset int64
+	if opts.resume {
+		offset, err = resumeOffset(fd, info.Size(), h)
+	} else {
+		err = fd.Truncate(0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := sc.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+	if _, err = remote.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(io.MultiWriter(fd, h), &limitedReader{ctx: ctx, r: remote, limiter: limiter})
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", remotePath, err)
+	}
+	if offset+n != info.Size() {
+		return nil, fmt.Errorf("%v: size changed during transfer: got %d, expected %d",
+			remotePath, offset+n, info.Size())
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if opts.manifest != nil && sum != opts.manifest.SHA256 {
+		fd.Close()
+		fd = nil
+		// The data is bad, so it must not be resumed either.
+		os.Remove(partial)
+		return nil, fmt.Errorf("%v: sha256 does not match manifest", remotePath)
+	}
+	err = fd.Close()
+	fd = nil
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chtimes(partial, info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(partial, localPath); err != nil {
+		return nil, err
+	}
+	return &FileResult{
+		Path:    localPath,
+		Bytes:   n,
+		Size:    info.Size(),
+		SHA256:  hex.EncodeToString(sum[:]),
+		Resumed: offset != 0,
+	}, nil
+}
+
+// resumeOffset hashes the data already in the partial file fd and leaves fd
+// positioned after it.  Partial files that cannot be the prefix of a file of
+// size bytes are truncated.
+func resumeOffset(fd *os.File, size int64, h hash.Hash) (int64, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st.Size() > size {
+		if err = fd.Truncate(0); err != nil {
+			return 0, err
+		}
+		return 0, nil
+	}
+	return io.Copy(h, fd)
+}
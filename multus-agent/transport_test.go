@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/companyzero/multus/format"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSFTPServer serves SFTP on a local port for clients using clientKey.
+func testSFTPServer(t *testing.T, clientKey ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					ch, reqs, err := nc.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						for req := range reqs {
+							ok := req.Type == "subsystem" && bytes.HasSuffix(req.Payload, []byte("sftp"))
+							req.Reply(ok, nil)
+							if ok {
+								srv, _ := sftp.NewServer(ch)
+								go func() { srv.Serve(); ch.Close() }()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), hostSigner.PublicKey()
+}
+
+func writeFiles(t *testing.T, dir string, size int, names ...string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeTestManifest writes the manifest of the increment at incPath, which
+// holds data, signed with key.
+func writeTestManifest(t *testing.T, incPath string, data []byte, key ed25519.PrivateKey) {
+	t.Helper()
+	m := &format.Manifest{
+		Version:   8,
+		Hostname:  "h",
+		Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local),
+		Size:      int64(len(data)),
+		SHA256:    sha256.Sum256(data),
+		Created:   time.Now(),
+	}
+	if err := ioutil.WriteFile(format.ManifestName(incPath), m.Sign(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSFTPSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	clientSigner, _ := ssh.NewSignerFromKey(clientPriv)
+	addr, hostKey := testSFTPServer(t, clientSigner.PublicKey())
+	hostname, port, _ := net.SplitHostPort(addr)
+	var portNum int
+	for _, c := range port {
+		portNum = portNum*10 + int(c-'0')
+	}
+	manifestPub, manifestKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	src := filepath.Join(dir, "src")
+	chunk := strings.Repeat("ab", 32) + ".enc"
+	writeFiles(t, src, 1000, "202001010000-h.0.gz.enc", "202001010000-h.0.refs",
+		"sig.cache", "other")
+	writeTestManifest(t, filepath.Join(src, "202001010000-h.0.gz.enc"), make([]byte, 1000), manifestKey)
+	writeFiles(t, filepath.Join(src, "chunks", "ab"), 10, chunk)
+	big := make([]byte, 1<<18)
+	rand.Read(big)
+	inc1 := filepath.Join(src, "202001010000-h.1.gz.enc")
+	if err = ioutil.WriteFile(inc1, big, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestManifest(t, inc1, big, manifestKey)
+
+	dst := filepath.Join(dir, "dst")
+	chunks := filepath.Join(dir, "chunks")
+	os.MkdirAll(dst, 0700)
+	// An interrupted earlier transfer.
+	if err = ioutil.WriteFile(filepath.Join(dst, "202001010000-h.1.gz.enc"+partialSuffix), big[:1000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The partial chunk of another host.
+	os.MkdirAll(filepath.Join(chunks, "ab"), 0700)
+	if err = ioutil.WriteFile(filepath.Join(chunks, "ab", chunk+partialSuffix), []byte{1, 2, 3}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &sftpTransport{
+		config: &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+		},
+		bwLimit: 1 << 20,
+	}
+	host := &Host{Hostname: hostname, Port: portNum, BackupPath: src, Dedup: true, manifestKey: manifestPub}
+	result, err := tr.Sync(context.Background(), host, dst, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 7 {
+		t.Fatalf("expected 7 files, got %+v", result.Files)
+	}
+	var resumed bool
+	for _, f := range result.Files {
+		if f.Resumed {
+			resumed = true
+			if f.Bytes != int64(len(big)-1000) {
+				t.Fatalf("resumed transfer copied %d bytes", f.Bytes)
+			}
+		}
+	}
+	if !resumed {
+		t.Fatalf("partial file not resumed")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dst, "202001010000-h.1.gz.enc"))
+	if err != nil || !bytes.Equal(b, big) {
+		t.Fatalf("resumed file mismatch: %v", err)
+	}
+	if exists(filepath.Join(dst, "other")) {
+		t.Fatalf("unrelated file synced")
+	}
+	b, err = ioutil.ReadFile(filepath.Join(chunks, "ab", chunk))
+	if err != nil || !bytes.Equal(b, make([]byte, 10)) {
+		t.Fatalf("chunk mismatch: %v", err)
+	}
+
+	result, err = tr.Sync(context.Background(), host, dst, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 0 || result.Skipped != 7 {
+		t.Fatalf("expected everything up to date, got %+v", result)
+	}
+
+	// A rewritten increment with the same size and modification time is
+	// pulled again along with its new manifest.
+	st, err := os.Stat(inc1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rand.Read(big)
+	if err = ioutil.WriteFile(inc1, big, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(inc1, st.ModTime(), st.ModTime())
+	writeTestManifest(t, inc1, big, manifestKey)
+	result, err = tr.Sync(context.Background(), host, dst, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 2 {
+		t.Fatalf("expected the increment and its manifest, got %+v", result.Files)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dst, "202001010000-h.1.gz.enc"))
+	if err != nil || !bytes.Equal(b, big) {
+		t.Fatalf("rewritten file mismatch: %v", err)
+	}
+
+	// Data that does not match its manifest is discarded.
+	inc2 := filepath.Join(src, "202001010000-h.2.gz.enc")
+	writeFiles(t, src, 100, filepath.Base(inc2))
+	writeTestManifest(t, inc2, []byte(strings.Repeat("x", 100)), manifestKey)
+	_, err = tr.Sync(context.Background(), host, dst, chunks)
+	if err == nil || !strings.Contains(err.Error(), "sha256 does not match manifest") {
+		t.Fatalf("expected a hash mismatch, got %v", err)
+	}
+	if exists(filepath.Join(dst, filepath.Base(inc2))) || exists(filepath.Join(dst, filepath.Base(inc2)+partialSuffix)) {
+		t.Fatalf("mismatched data kept")
+	}
+}
+
+func TestParseBWLimit(t *testing.T) {
+	for s, want := range map[string]int64{"1.5m": 3 << 19, "100": 100 << 10, "0": 0, "2g": 2 << 30} {
+		got, err := parseBWLimit(s)
+		if err != nil || got != want {
+			t.Fatalf("%v: got %v %v", s, got, err)
+		}
+	}
+	if _, err := parseBWLimit("fast"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
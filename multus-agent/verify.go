@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/companyzero/multus/format"
+	"github.com/jrick/ss/stream"
+)
+
+const (
+	// streamOverhead is the authentication tag sealed with every chunk of
+	// an ss stream.
+	streamOverhead = format.TagSize
+	// streamVersionSize is the sealed protocol version following the
+	// header.
+	streamVersionSize = 4 + streamOverhead
+	// streamChunkSize is the size of a sealed chunk.  Only the last chunk
+	// may be shorter and it holds at least one byte.
+	streamChunkSize = 1<<16 + streamOverhead
+
+	// tzSlack covers the difference between the time zone chain names
+	// are written in and the one of the agent.
+	tzSlack = 14 * time.Hour
+)
+
+// VerifyResult describes the checks of the increments of a host.
+type VerifyResult struct {
+	Hostname string
+	// Latest is the modification time of the newest increment.
+	Latest   time.Time
+	Stale    bool
+	Problems []string
+}
+
+func (r *VerifyResult) problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// OK reports whether the host passed all checks.
+func (r *VerifyResult) OK() bool {
+	return len(r.Problems) == 0 && !r.Stale
+}
+
+// verifyIncrement checks that path starts with a stream header for public
+// keys and that its size fits the chunking of the stream.  Data cut at a
+// chunk boundary cannot be detected without the secret key.
+func verifyIncrement(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	st, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	headerSize, err := streamHeaderSize(bufio.NewReader(fd))
+	if err != nil {
+		return err
+	}
+	rest := st.Size() - headerSize - streamVersionSize
+	if last := rest % streamChunkSize; rest <= 0 || (last != 0 && last <= streamOverhead) {
+		return fmt.Errorf("truncated")
+	}
+	return nil
+}
+
+// sigCacheHeader is the chain recorded in a sig.cache file.
+type sigCacheHeader struct {
+	Hostname  string
+	Timestamp time.Time
+	// ID is the hex encoded chain id, empty before format version 8.
+	ID       string
+	Instance uint16
+}
+
+// streamHeaderSize returns the size of the stream header at the start of r.
+func streamHeaderSize(r *bufio.Reader) (int64, error) {
+	b, err := r.Peek(format.RecipientsFixed)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stream header: %v", err)
+	}
+	if b[0] == format.RecipientsScheme {
+		if b[1] == 0 {
+			return 0, fmt.Errorf("no recipients")
+		}
+		return format.RecipientsHeaderSize(int(b[1])), nil
+	}
+	header, err := stream.ReadHeader(r)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stream header: %v", err)
+	}
+	if header.Scheme != stream.StreamlinedNTRUPrime4591761Scheme {
+		return 0, fmt.Errorf("not encrypted to a public key")
+	}
+	return int64(len(header.Bytes)), nil
+}
+
+// readSigCacheHeader returns the chain and latest level recorded in a
+// sig.cache file.
+func readSigCacheHeader(path string) (*sigCacheHeader, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	r := bufio.NewReader(fd)
+	var buf [2 + 2 + 1]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	version := binary.LittleEndian.Uint16(buf[:2])
+	hostLen := int(buf[4])
+	rest := make([]byte, hostLen+8+16)
+	if version < 8 {
+		rest = rest[:hostLen+8]
+	}
+	if _, err = io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	h := &sigCacheHeader{
+		Hostname:  string(rest[:hostLen]),
+		Timestamp: time.Unix(int64(binary.LittleEndian.Uint64(rest[hostLen:])), 0),
+		Instance:  binary.LittleEndian.Uint16(buf[2:]),
+	}
+	if version >= 8 {
+		h.ID = hex.EncodeToString(rest[hostLen+8:])
+	}
+	return h, nil
+}
+
+// verify checks the increments of every configured host without the secret
+// key: the stream structure of each file and its signed manifest, that chains
+// have no missing levels, that the chain sig.cache tracks holds the level it
+// last recorded and that all chunks listed in reference files are present.
+// Hosts whose newest increment is older than their stale threshold are
+// flagged.
+func verify(cfg *config, now time.Time) ([]VerifyResult, error) {
+	chains, _, err := loadChains(cfg.StoragePath)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := loadVerifyCache(filepath.Join(cfg.StoragePath, verifyCacheName))
+	if err != nil {
+		return nil, err
+	}
+	chunkPath := filepath.Join(cfg.StoragePath, chunkDir)
+	results := make([]VerifyResult, 0, len(cfg.Hosts))
+	for i := range cfg.Hosts {
+		host := &cfg.Hosts[i]
+		result := VerifyResult{Hostname: host.Hostname}
+		dir := filepath.Join(cfg.StoragePath, host.Hostname)
+		var newest *Chain
+		byID := make(map[string]*Chain)
+		for _, chain := range chains {
+			if chain.Dir != dir {
+				continue
+			}
+			newest = chain
+			if chain.ID != "" {
+				byID[chain.ID] = chain
+			}
+			if !chain.Complete() {
+				result.problemf("%v: missing levels", chain)
+			}
+			for j := range chain.Increments {
+				inc := &chain.Increments[j]
+				if inc.ModTime.After(result.Latest) {
+					result.Latest = inc.ModTime
+				}
+				if err := verifyIncrement(inc.Path); err != nil {
+					result.problemf("%v: %v", filepath.Base(inc.Path), err)
+					continue
+				}
+				// Without a manifest key, increments written before
+				// manifests existed pass.
+				if _, err := os.Stat(format.ManifestName(inc.Path)); os.IsNotExist(err) && host.manifestKey == nil {
+					continue
+				}
+				if err := verifyManifest(chain, inc, host.manifestKey, cache); err != nil {
+					result.problemf("%v: %v", filepath.Base(inc.Path), err)
+				}
+			}
+			for _, refFile := range chain.RefFiles {
+				missing, err := missingChunks(refFile, chunkPath)
+				if err != nil {
+					result.problemf("%v: %v", filepath.Base(refFile), err)
+				} else if missing != 0 {
+					result.problemf("%v: %d chunks missing", filepath.Base(refFile), missing)
+				}
+			}
+		}
+
+		switch {
+		case newest == nil:
+			result.problemf("no increments")
+		default:
+			sc, err := readSigCacheHeader(filepath.Join(dir, "sig.cache"))
+			if err != nil {
+				result.problemf("sig.cache: %v", err)
+				break
+			}
+			chain := newest
+			if sc.ID != "" {
+				chain = byID[sc.ID]
+			}
+			if chain == nil || sc.Hostname != chain.Hostname || sc.Timestamp.After(chain.Timestamp.Add(tzSlack)) {
+				result.problemf("sig.cache: chain of %v at %v missing", sc.Hostname, sc.Timestamp)
+			} else if last := chain.Increments[len(chain.Increments)-1].Level; sc.Instance > last {
+				result.problemf("sig.cache: level %d missing from %v", sc.Instance, chain)
+			}
+		}
+
+		staleAfter := cfg.staleAfter
+		if host.staleAfter != 0 {
+			staleAfter = host.staleAfter
+		}
+		if staleAfter > 0 && now.Sub(result.Latest) > staleAfter {
+			result.Stale = true
+		}
+		results = append(results, result)
+	}
+	if err := cache.save(); err != nil {
+		log.Printf("%q: %v", cache.path, err)
+	}
+	return results, nil
+}
+
+// missingChunks returns the number of chunks listed in refFile that are not
+// in chunkPath.
+func missingChunks(refFile, chunkPath string) (int, error) {
+	fd, err := os.Open(refFile)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	missing := 0
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		id := scanner.Text()
+		if len(id) < 2 {
+			return missing, fmt.Errorf("invalid chunk id %q", id)
+		}
+		_, err := os.Stat(filepath.Join(chunkPath, id[:2], id+".enc"))
+		if os.IsNotExist(err) {
+			missing++
+		} else if err != nil {
+			return missing, err
+		}
+	}
+	return missing, scanner.Err()
+}
+
+// printVerify writes the verification results to w and reports whether all
+// hosts passed.
+func printVerify(w io.Writer, results []VerifyResult) bool {
+	ok := true
+	for i := range results {
+		r := &results[i]
+		if r.OK() {
+			fmt.Fprintf(w, "%s: verified, newest increment %v\n", r.Hostname,
+				r.Latest.Format(time.RFC3339))
+			continue
+		}
+		ok = false
+		if r.Stale {
+			latest := "never"
+			if !r.Latest.IsZero() {
+				latest = r.Latest.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s: STALE, newest increment %v\n", r.Hostname, latest)
+		}
+		for _, p := range r.Problems {
+			fmt.Fprintf(w, "%s: %s\n", r.Hostname, p)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// passphraseSources returns the number of passphrase sources set in cfg.
+func (cfg *RestoreConfig) passphraseSources() int {
+	n := 0
+	for _, set := range []bool{
+		len(cfg.PassphraseFile) != 0,
+		len(cfg.PassphraseEnv) != 0,
+		cfg.PassphraseFD != nil,
+		len(cfg.PassphraseCommand) != 0,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// readPassphrase returns the passphrase of the secret key from the source
+// set in cfg and prompts on the terminal when none is set.  A trailing
+// newline is removed from passphrases of every source.
+func readPassphrase(cfg *RestoreConfig) ([]byte, error) {
+	if cfg.passphraseSources() > 1 {
+		return nil, errors.New("more than one passphrase source set")
+	}
+	var (
+		secret []byte
+		err    error
+	)
+	switch {
+	case len(cfg.PassphraseFile) != 0:
+		secret, err = ioutil.ReadFile(cfg.PassphraseFile)
+	case len(cfg.PassphraseEnv) != 0:
+		v, ok := os.LookupEnv(cfg.PassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("passphraseenv: %v not set", cfg.PassphraseEnv)
+		}
+		secret = []byte(v)
+	case cfg.PassphraseFD != nil:
+		fd := os.NewFile(uintptr(*cfg.PassphraseFD), "passphrase")
+		if fd == nil {
+			return nil, fmt.Errorf("passphrasefd: invalid descriptor %d", *cfg.PassphraseFD)
+		}
+		secret, err = ioutil.ReadAll(fd)
+		fd.Close()
+	case len(cfg.PassphraseCommand) != 0:
+		cmd := exec.Command("/bin/sh", "-c", cfg.PassphraseCommand)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		secret, err = cmd.Output()
+		if err != nil {
+			zero(secret)
+			return nil, fmt.Errorf("passphrasecommand: %v", err)
+		}
+	default:
+		return promptPassphrase(fmt.Sprintf("%q secret", cfg.SecretFile), false)
+	}
+	if err != nil {
+		zero(secret)
+		return nil, err
+	}
+	secret = bytes.TrimSuffix(secret, []byte("\n"))
+	secret = bytes.TrimSuffix(secret, []byte("\r"))
+	if len(secret) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return secret, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// passphraseFD returns a descriptor to read b from.  readPassphrase closes
+// the descriptor it reads.
+func passphraseFD(t *testing.T, b string) *int {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err = w.Write([]byte(b)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fd
+}
+
+func TestReadPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := func(b string) string {
+		name := filepath.Join(dir, "pass")
+		if err := ioutil.WriteFile(name, []byte(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	const env = "MULTUS_TEST_PASSPHRASE"
+	defer os.Unsetenv(env)
+
+	tests := []struct {
+		name string
+		env  string
+		cfg  func() RestoreConfig
+		want string
+		err  string
+	}{
+		{
+			name: "file",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseFile: file("secret")} },
+			want: "secret",
+		},
+		{
+			name: "file newline",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseFile: file("secret\n")} },
+			want: "secret",
+		},
+		{
+			name: "file crlf",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseFile: file("secret\r\n")} },
+			want: "secret",
+		},
+		{
+			name: "only the last newline trimmed",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseFile: file(" sec ret\n\n")} },
+			want: " sec ret\n",
+		},
+		{
+			name: "missing file",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseFile: filepath.Join(dir, "missing")} },
+			err:  "no such file",
+		},
+		{
+			name: "empty file",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseFile: file("\n")} },
+			err:  "empty passphrase",
+		},
+		{
+			name: "environment",
+			env:  "secret",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseEnv: env} },
+			want: "secret",
+		},
+		{
+			name: "environment newline",
+			env:  "secret\n",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseEnv: env} },
+			want: "secret",
+		},
+		{
+			name: "environment unset",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseEnv: "MULTUS_TEST_UNSET"} },
+			err:  "not set",
+		},
+		{
+			name: "descriptor",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseFD: passphraseFD(t, "secret\r\n")} },
+			want: "secret",
+		},
+		{
+			name: "command",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseCommand: "echo secret"} },
+			want: "secret",
+		},
+		{
+			name: "command without newline",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseCommand: "printf secret"} },
+			want: "secret",
+		},
+		{
+			name: "failing command",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseCommand: "echo secret; exit 1"} },
+			err:  "passphrasecommand",
+		},
+		{
+			name: "command without output",
+			cfg:  func() RestoreConfig { return RestoreConfig{PassphraseCommand: "true"} },
+			err:  "empty passphrase",
+		},
+		{
+			name: "more than one source",
+			env:  "secret",
+			cfg: func() RestoreConfig {
+				return RestoreConfig{PassphraseFile: file("secret"), PassphraseEnv: env}
+			},
+			err: "more than one passphrase source",
+		},
+	}
+	for _, test := range tests {
+		os.Unsetenv(env)
+		if test.env != "" {
+			os.Setenv(env, test.env)
+		}
+		cfg := test.cfg()
+		b, err := readPassphrase(&cfg)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if string(b) != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, b, test.want)
+		}
+	}
+}
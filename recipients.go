@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/companyzero/multus/format"
+	"github.com/jrick/ss/stream"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The layout of recipients headers is shared with the agent.
+const (
+	recipientsScheme = format.RecipientsScheme
+	maxRecipients    = format.MaxRecipients
+	recipientsFixed  = format.RecipientsFixed
+	recipientSize    = format.RecipientSize
+	ciphertextSize   = format.CiphertextSize
+	fingerprintSize  = format.FingerprintSize
+	recipientsADSize = format.RecipientsADSize
+
+	// secretKeyPublicOffset is where an sntrup4591761 secret key embeds its
+	// public key.
+	secretKeyPublicOffset = 382
+)
+
+// keyFingerprint returns the SHA512 of pk.
+func keyFingerprint(pk *stream.PublicKey) [fingerprintSize]byte {
+	return sha512.Sum512(pk[:])
+}
+
+// secretKeyFingerprint returns the fingerprint of the public key belonging
+// to sk.
+func secretKeyFingerprint(sk *stream.SecretKey) [fingerprintSize]byte {
+	return sha512.Sum512(sk[secretKeyPublicOffset:])
+}
+
+// formatFingerprint encodes a fingerprint the way ss writes it to key files.
+func formatFingerprint(fp []byte) string {
+	return "sha512:" + base64.StdEncoding.EncodeToString(fp)
+}
+
+// streamHeader is the parsed header of an encrypted file: either a single
+// recipient ss header or a recipients header.  Bytes is authenticated by the
+// stream and passed to stream.Encrypt and stream.Decrypt, which write and
+// read it after the recipients.
+type streamHeader struct {
+	Bytes []byte
+	// recipients is the scheme, recipient count and recipients of a
+	// recipients header.
+	recipients []byte
+	ss         *stream.Header
+}
+
+// encapsulate returns a recipients header with a new random file id for a
+// new random file key and the key.
+func encapsulate(pubKeys []*stream.PublicKey) (*streamHeader, *stream.SymmetricKey, error) {
+	key := new(stream.SymmetricKey)
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, nil, err
+	}
+	ad := make([]byte, recipientsADSize)
+	ad[0] = recipientsScheme
+	if _, err := rand.Read(ad[1:]); err != nil {
+		return nil, nil, err
+	}
+	h := &streamHeader{Bytes: ad}
+	if err := h.encapsulate(pubKeys, key); err != nil {
+		return nil, nil, err
+	}
+	return h, key, nil
+}
+
+// encapsulate replaces the recipients of h with pubKeys.  Every recipient
+// gets its fingerprint and an ss key encapsulation whose shared key seals
+// key, the file key.  The file id of h is kept, so the stream stays valid.
+func (h *streamHeader) encapsulate(pubKeys []*stream.PublicKey, key *stream.SymmetricKey) error {
+	if h.ss != nil {
+		return errors.New("single recipient ss header")
+	}
+	if len(pubKeys) == 0 {
+		return errors.New("no recipients")
+	}
+	if len(pubKeys) > maxRecipients {
+		return fmt.Errorf("%d recipients, at most %d are supported", len(pubKeys), maxRecipients)
+	}
+	recipients := make([]byte, recipientsFixed, recipientsFixed+len(pubKeys)*recipientSize)
+	recipients[0] = recipientsScheme
+	recipients[1] = byte(len(pubKeys))
+	var nonce [chacha20poly1305.NonceSize]byte
+	for _, pk := range pubKeys {
+		ssHeader, shared, err := stream.Encapsulate(rand.Reader, pk)
+		if err != nil {
+			return err
+		}
+		aead, err := chacha20poly1305.New(shared[:])
+		if err != nil {
+			return err
+		}
+		fp := keyFingerprint(pk)
+		recipients = append(recipients, fp[:]...)
+		recipients = append(recipients, ssHeader[1:]...)
+		// The shared key is used once, so a zero nonce is safe.
+		recipients = aead.Seal(recipients, nonce[:], key[:], h.Bytes)
+	}
+	h.recipients = recipients
+	return nil
+}
+
+// encrypt writes h and r encrypted with key to w.
+func (h *streamHeader) encrypt(w io.Writer, r io.Reader, key *stream.SymmetricKey) error {
+	if _, err := w.Write(h.recipients); err != nil {
+		return err
+	}
+	return stream.Encrypt(w, r, h.Bytes, key)
+}
+
+// readStreamHeader reads the header of an encrypted file from r without
+// reading past it.
+func readStreamHeader(r io.Reader) (*streamHeader, error) {
+	recipients := make([]byte, recipientsFixed)
+	if _, err := io.ReadFull(r, recipients[:1]); err != nil {
+		return nil, err
+	}
+	if recipients[0] != recipientsScheme {
+		h, err := stream.ReadHeader(io.MultiReader(bytes.NewReader(recipients[:1]), r))
+		if err != nil {
+			return nil, err
+		}
+		return &streamHeader{Bytes: h.Bytes, ss: h}, nil
+	}
+	if _, err := io.ReadFull(r, recipients[1:]); err != nil {
+		return nil, err
+	}
+	if recipients[1] == 0 {
+		return nil, errors.New("no recipients in header")
+	}
+	recipients = append(recipients, make([]byte, int(recipients[1])*recipientSize)...)
+	if _, err := io.ReadFull(r, recipients[recipientsFixed:]); err != nil {
+		return nil, err
+	}
+	ad := make([]byte, recipientsADSize)
+	if _, err := io.ReadFull(r, ad); err != nil {
+		return nil, err
+	}
+	if ad[0] != recipientsScheme {
+		return nil, errors.New("invalid recipients header")
+	}
+	return &streamHeader{Bytes: ad, recipients: recipients}, nil
+}
+
+// Recipients returns the number of public keys the file key is encapsulated
+// to.
+func (h *streamHeader) Recipients() int {
+	if h.ss != nil {
+		return 1
+	}
+	return int(h.recipients[1])
+}
+
+// recipient returns the fingerprint and the sealed file key of recipient i.
+func (h *streamHeader) recipient(i int) (fp, sealed []byte) {
+	r := h.recipients[recipientsFixed+i*recipientSize:][:recipientSize]
+	return r[:fingerprintSize], r[fingerprintSize:]
+}
+
+// Fingerprints returns the fingerprints of the recipients, or nil for single
+// recipient ss headers.
+func (h *streamHeader) Fingerprints() []string {
+	if h.ss != nil {
+		return nil
+	}
+	fps := make([]string, h.Recipients())
+	for i := range fps {
+		fp, _ := h.recipient(i)
+		fps[i] = formatFingerprint(fp)
+	}
+	return fps
+}
+
+// key recovers the file key with secretKey.  Recipients with a fingerprint
+// other than the one of secretKey are skipped.
+func (h *streamHeader) key(secretKey *stream.SecretKey) (*stream.SymmetricKey, error) {
+	if h.ss != nil {
+		return stream.Decapsulate(h.ss, secretKey)
+	}
+	skFP := secretKeyFingerprint(secretKey)
+	var nonce [chacha20poly1305.NonceSize]byte
+	for i := 0; i < h.Recipients(); i++ {
+		fp, r := h.recipient(i)
+		if !bytes.Equal(fp, skFP[:]) {
+			continue
+		}
+		ssHeader := &stream.Header{
+			Scheme:     stream.StreamlinedNTRUPrime4591761Scheme,
+			Ciphertext: new(stream.Ciphertext),
+		}
+		copy(ssHeader.Ciphertext[:], r[:ciphertextSize])
+		shared, err := stream.Decapsulate(ssHeader, secretKey)
+		if err != nil {
+			continue
+		}
+		aead, err := chacha20poly1305.New(shared[:])
+		if err != nil {
+			return nil, err
+		}
+		plain, err := aead.Open(nil, nonce[:], r[ciphertextSize:], h.Bytes)
+		if err != nil {
+			continue
+		}
+		key := new(stream.SymmetricKey)
+		copy(key[:], plain)
+		return key, nil
+	}
+	return nil, fmt.Errorf("encrypted to %v, not to secret key %v",
+		strings.Join(h.Fingerprints(), ", "), formatFingerprint(skFP[:]))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/companyzero/multus/format"
+	"github.com/jrick/ss/stream"
+)
+
+// encryptTest encrypts data to pubKeys.
+func encryptTest(t *testing.T, data []byte, pubKeys ...*stream.PublicKey) []byte {
+	t.Helper()
+
+	header, key, err := encapsulate(pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enc bytes.Buffer
+	if err = header.encrypt(&enc, bytes.NewReader(data), key); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+// decryptTest decrypts enc with sk.
+func decryptTest(enc []byte, sk *stream.SecretKey) ([]byte, *streamHeader, error) {
+	r := bytes.NewReader(enc)
+	header, err := readStreamHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := header.key(sk)
+	if err != nil {
+		return nil, header, err
+	}
+	var plain bytes.Buffer
+	err = stream.Decrypt(&plain, r, header.Bytes, key)
+	return plain.Bytes(), header, err
+}
+
+func TestEncapsulate(t *testing.T) {
+	data := testData(t, 1<<17)
+	var pubKeys []*stream.PublicKey
+	var secretKeys []*stream.SecretKey
+	for i := 0; i < 3; i++ {
+		pk, sk := testKeys(t)
+		pubKeys = append(pubKeys, pk)
+		secretKeys = append(secretKeys, sk)
+	}
+	other, otherSK := testKeys(t)
+
+	for _, n := range []int{1, 3} {
+		enc := encryptTest(t, data, pubKeys[:n]...)
+		if int64(len(enc)) < format.RecipientsHeaderSize(n) {
+			t.Fatalf("%d recipients: %d bytes", n, len(enc))
+		}
+		for i, sk := range secretKeys[:n] {
+			plain, header, err := decryptTest(enc, sk)
+			if err != nil {
+				t.Fatalf("%d recipients, key %d: %v", n, i, err)
+			}
+			if !bytes.Equal(plain, data) {
+				t.Fatalf("%d recipients, key %d: content mismatch", n, i)
+			}
+			fps := header.Fingerprints()
+			if header.Recipients() != n || len(fps) != n {
+				t.Fatalf("%d recipients: header lists %d", n, header.Recipients())
+			}
+			for j, pk := range pubKeys[:n] {
+				fp := keyFingerprint(pk)
+				if fps[j] != formatFingerprint(fp[:]) {
+					t.Fatalf("%d recipients: fingerprint %d %v", n, j, fps[j])
+				}
+			}
+		}
+		_, _, err := decryptTest(enc, otherSK)
+		if err == nil || !strings.Contains(err.Error(), "not to secret key") {
+			t.Fatalf("%d recipients: decrypted without being a recipient: %v", n, err)
+		}
+	}
+
+	// A recipient whose fingerprint does not match is skipped.
+	enc := encryptTest(t, data, pubKeys[0], other)
+	enc[recipientsFixed] ^= 1
+	if _, _, err := decryptTest(enc, secretKeys[0]); err == nil {
+		t.Fatal("recipient with a wrong fingerprint used")
+	}
+	if _, _, err := decryptTest(enc, otherSK); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file id authenticates the sealed file keys.
+	enc = encryptTest(t, data, pubKeys[0])
+	enc[format.RecipientsHeaderSize(1)-1] ^= 1
+	if _, _, err := decryptTest(enc, secretKeys[0]); err == nil {
+		t.Fatal("file key opened under another file id")
+	}
+
+	if _, _, err := encapsulate(nil); err == nil {
+		t.Fatal("encapsulated to no recipients")
+	}
+	tooMany := make([]*stream.PublicKey, maxRecipients+1)
+	for i := range tooMany {
+		tooMany[i] = other
+	}
+	if _, _, err := encapsulate(tooMany); err == nil {
+		t.Fatalf("encapsulated to %d recipients", len(tooMany))
+	}
+}
+
+func TestReadStreamHeaderSS(t *testing.T) {
+	pk, sk := testKeys(t)
+	ssHeader, key, err := stream.Encapsulate(rand.Reader, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enc bytes.Buffer
+	if err = stream.Encrypt(&enc, strings.NewReader("single recipient"), ssHeader, key); err != nil {
+		t.Fatal(err)
+	}
+	plain, header, err := decryptTest(enc.Bytes(), sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "single recipient" || header.Recipients() != 1 || header.Fingerprints() != nil {
+		t.Fatalf("%q %d recipients", plain, header.Recipients())
+	}
+}
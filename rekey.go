@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/companyzero/multus/format"
+	"github.com/companyzero/multus/storage"
+	"github.com/jrick/ss/stream"
+)
+
+// rekey rewrites the increments and chunks of the backup storage for the
+// recipients in pubKeys.  The file key of every file is encapsulated to the
+// new recipients and the payload is copied as is.  With reencrypt set, or
+// for files with a single recipient ss header, the payload is encrypted
+// again under a new file key and file id instead, as a compromised secret
+// key may have recovered the old file keys.  Manifests are updated and
+// signed again.
+func rekey(ctx context.Context, secretKey *stream.SecretKey, pubKeys []*stream.PublicKey, cfg *config,
+	reencrypt bool) error {
+
+	destDir := filepath.Clean(cfg.BackupPath)
+	gid, err := lookupGroup(cfg.Backup.Group)
+	if err != nil {
+		return err
+	}
+	hostKey, err := LoadHostKey(cfg.Backup.HostKeyFile)
+	if err != nil {
+		return err
+	}
+	store, err := storage.Open(&cfg.Backup.Storage, destDir, os.Geteuid(), gid)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	log.Printf("rekeying %v for %d recipients, reencrypt: %v", store.Location(), len(pubKeys), reencrypt)
+	startTime := time.Now()
+
+	files, err := store.List("")
+	if err != nil {
+		return err
+	}
+	var increments int
+	for _, file := range files {
+		if !format.IsIncrement(file.Name) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		size, sum, err := rekeyFile(store, file.Name, secretKey, pubKeys, reencrypt)
+		if err != nil {
+			return fmt.Errorf("%q: %v", file.Name, err)
+		}
+		if err = updateManifest(store, file.Name, size, sum, hostKey); err != nil {
+			return fmt.Errorf("%q: %v", format.ManifestName(file.Name), err)
+		}
+		log.Printf("%q: %d bytes", file.Name, size)
+		increments++
+	}
+
+	var chunks int
+	for i := 0; i < 256; i++ {
+		dir := path.Join(ChunkDir, fmt.Sprintf("%02x", i))
+		files, err := store.List(dir)
+		if storage.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name, ".enc") {
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			name := path.Join(dir, file.Name)
+			if _, _, err := rekeyFile(store, name, secretKey, pubKeys, reencrypt); err != nil {
+				return fmt.Errorf("%q: %v", name, err)
+			}
+			chunks++
+		}
+	}
+
+	log.Printf("completed: duration:%v increments:%d chunks:%d", time.Since(startTime), increments, chunks)
+	return nil
+}
+
+// rekeyFile replaces the encrypted file name in store with a copy for
+// pubKeys and returns the size and SHA256 of the copy.
+func rekeyFile(store storage.Backend, name string, secretKey *stream.SecretKey,
+	pubKeys []*stream.PublicKey, reencrypt bool) (int64, [sha256.Size]byte, error) {
+
+	var sum [sha256.Size]byte
+	r, err := store.Open(name)
+	if err != nil {
+		return 0, sum, err
+	}
+	defer r.Close()
+	w, err := store.Create(name)
+	if err != nil {
+		return 0, sum, err
+	}
+	h := sha256.New()
+	out := &countWriter{w: io.MultiWriter(w, h)}
+	if err = rekeyStream(out, r, secretKey, pubKeys, reencrypt); err != nil {
+		w.Abort()
+		return 0, sum, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return out.n, sum, nil
+}
+
+// rekeyStream copies the encrypted stream r to w for pubKeys.  The file key
+// is encapsulated to pubKeys and the payload copied, or with reencrypt set
+// the stream is decrypted and encrypted again with a new file key.
+func rekeyStream(w io.Writer, r io.Reader, secretKey *stream.SecretKey, pubKeys []*stream.PublicKey,
+	reencrypt bool) error {
+
+	header, err := readStreamHeader(r)
+	if err != nil {
+		return err
+	}
+	key, err := header.key(secretKey)
+	if err != nil {
+		return err
+	}
+	// The stream of an ss header authenticates its single encapsulation.
+	if !reencrypt && header.ss == nil {
+		if err = header.encapsulate(pubKeys, key); err != nil {
+			return err
+		}
+		if _, err = w.Write(header.recipients); err != nil {
+			return err
+		}
+		if _, err = w.Write(header.Bytes); err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	}
+
+	newHeader, newKey, err := encapsulate(pubKeys)
+	if err != nil {
+		return err
+	}
+	pipeR, pipeW := io.Pipe()
+	go func() {
+		pipeW.CloseWithError(stream.Decrypt(pipeW, r, header.Bytes, key))
+	}()
+	err = newHeader.encrypt(w, pipeR, newKey)
+	pipeR.CloseWithError(err)
+	return err
+}
+
+// updateManifest records the new size and hash of a rekeyed increment in its
+// manifest.  Increments without a manifest are left alone.
+func updateManifest(store storage.Backend, name string, size int64, sum [sha256.Size]byte,
+	key ed25519.PrivateKey) error {
+
+	b, err := readAll(store, format.ManifestName(name))
+	if storage.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	m, err := format.ParseManifest(b, key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return err
+	}
+	m.Size = size
+	m.SHA256 = sum
+	w, err := store.Create(format.ManifestName(name))
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(m.Sign(key)); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
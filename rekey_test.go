@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/companyzero/multus/format"
+	"github.com/companyzero/multus/storage"
+	"github.com/jrick/ss/stream"
+)
+
+func TestRecipientsRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	backupDir := filepath.Join(dir, "backup")
+	if err = os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(t, 1<<20)
+	if err = ioutil.WriteFile(filepath.Join(srcDir, "a"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pk1, sk1 := testKeys(t)
+	pk2, sk2 := testKeys(t)
+	pk3, sk3 := testKeys(t)
+	cfg := testConfig(t, backupDir, srcDir)
+	cfg.Backup.Dedup = true
+	cfg.Backup.ChunkKeyFile = filepath.Join(dir, "chunk.key")
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err = backup(ctx, []*stream.PublicKey{pk1, pk2}, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	check := func(sk *stream.SecretKey, ok bool) {
+		t.Helper()
+		n++
+		restoreDir := filepath.Join(dir, "restore", string(rune('a'+n)))
+		err := restore(ctx, sk, testRepo(t, backupDir), restoreDir, nil, -1)
+		if !ok {
+			if err == nil {
+				t.Fatal("restore with a key that is not a recipient succeeded")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(restoreDir, srcDir, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatal("content mismatch")
+		}
+	}
+	check(sk1, true)
+	check(sk2, true)
+	check(sk3, false)
+
+	checkManifests := func() {
+		t.Helper()
+		key, err := readManifestKey(cfg.Backup.HostKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := storage.NewLocal(backupDir, -1, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := ManifestList(store, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 {
+			t.Fatalf("%d increments listed", len(list))
+		}
+		for _, mf := range list {
+			b, err := ioutil.ReadFile(filepath.Join(backupDir, mf.Filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mf.Manifest == nil || int64(len(b)) != mf.Manifest.Size || sha256.Sum256(b) != mf.Manifest.SHA256 {
+				t.Fatalf("%q: manifest does not match", mf.Filename)
+			}
+		}
+	}
+
+	if err = rekey(ctx, sk2, []*stream.PublicKey{pk3}, cfg, false); err != nil {
+		t.Fatal(err)
+	}
+	checkManifests()
+	check(sk1, false)
+	check(sk3, true)
+
+	if err = rekey(ctx, sk3, []*stream.PublicKey{pk1}, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	checkManifests()
+	check(sk3, false)
+	check(sk1, true)
+}
+
+func TestRekeyStream(t *testing.T) {
+	data := testData(t, 1<<17)
+	pk1, sk1 := testKeys(t)
+	pk2, sk2 := testKeys(t)
+	pk3, sk3 := testKeys(t)
+	enc := encryptTest(t, data, pk1, pk2)
+	_, header, err := decryptTest(enc, sk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := enc[format.RecipientsHeaderSize(2):]
+
+	for _, reencrypt := range []bool{false, true} {
+		var out bytes.Buffer
+		if err = rekeyStream(&out, bytes.NewReader(enc), sk2, []*stream.PublicKey{pk1, pk3}, reencrypt); err != nil {
+			t.Fatal(err)
+		}
+		for i, sk := range []*stream.SecretKey{sk1, sk3} {
+			plain, newHeader, err := decryptTest(out.Bytes(), sk)
+			if err != nil {
+				t.Fatalf("reencrypt %v, key %d: %v", reencrypt, i, err)
+			}
+			if !bytes.Equal(plain, data) {
+				t.Fatalf("reencrypt %v, key %d: content mismatch", reencrypt, i)
+			}
+			// Without reencrypt only the recipients change.
+			sameID := bytes.Equal(newHeader.Bytes, header.Bytes)
+			samePayload := bytes.Equal(out.Bytes()[format.RecipientsHeaderSize(2):], payload)
+			if sameID == reencrypt || samePayload == reencrypt {
+				t.Fatalf("reencrypt %v: same file id %v, same payload %v", reencrypt, sameID, samePayload)
+			}
+		}
+		if _, _, err = decryptTest(out.Bytes(), sk2); err == nil {
+			t.Fatalf("reencrypt %v: removed recipient decrypted", reencrypt)
+		}
+	}
+
+	// Files with a single recipient ss header are always encrypted again.
+	ssHeader, key, err := stream.Encapsulate(rand.Reader, pk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ssEnc, out bytes.Buffer
+	if err = stream.Encrypt(&ssEnc, bytes.NewReader(data), ssHeader, key); err != nil {
+		t.Fatal(err)
+	}
+	if err = rekeyStream(&out, &ssEnc, sk1, []*stream.PublicKey{pk3}, false); err != nil {
+		t.Fatal(err)
+	}
+	plain, newHeader, err := decryptTest(out.Bytes(), sk3)
+	if err != nil || !bytes.Equal(plain, data) || newHeader.Recipients() != 1 || newHeader.ss != nil {
+		t.Fatalf("rekeyed ss stream: %v", err)
+	}
+}
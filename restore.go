@@ -3,13 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -19,70 +16,79 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/companyzero/multus/storage"
 	"github.com/jrick/ss/stream"
 	"github.com/silvasur/golibrsync/librsync"
-	"golang.org/x/sync/errgroup"
 )
 
-func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDir string, fileRegexp *regexp.Regexp, level int32) error {
-	insts, err := SnapshotList(secretKey, sourceDir)
-	if err != nil {
-		return err
-	}
+// selectChain asks which chain to use when insts holds more than one and
+// returns the increments needed to restore it to level.  A negative level
+// selects the latest one.
+func selectChain(insts IncrementalFiles, level int32) (IncrementalFiles, error) {
 	if len(insts) == 0 {
-		return fmt.Errorf("no backups found")
+		return nil, fmt.Errorf("no backups found")
 	}
 
 	idx := 0
-	snapList := make(map[time.Time]int)
+	snapList := make(map[ChainID]int)
+	started := make(map[ChainID]time.Time)
 	for _, inst := range insts {
-		i, exists := snapList[inst.Timestamp]
+		i, exists := snapList[inst.ChainID]
 		if !exists {
-			snapList[inst.Timestamp] = idx
+			snapList[inst.ChainID] = idx
+			started[inst.ChainID] = inst.Timestamp
 			idx++
 			continue
 		}
 		if i > idx {
-			snapList[inst.Timestamp] = i
+			snapList[inst.ChainID] = i
 		}
 	}
 
-	snapID := insts[0].Timestamp
+	snapID := insts[0].ChainID
 	if len(snapList) > 1 {
-		fmt.Println("snapshots:")
-		for ts, idx := range snapList {
-			fmt.Printf("%d: %v\n", idx, ts)
+		// Listed on stderr, stdout may carry a restore stream.
+		fmt.Fprintln(os.Stderr, "snapshots:")
+		for id, idx := range snapList {
+			fmt.Fprintf(os.Stderr, "%d: %v %v\n", idx, started[id], id)
 		}
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Fprintf(os.Stderr, "enter id to restore: ")
 		os.Stderr.Sync()
 		t, err := reader.ReadString('\n')
 		if err != nil {
-			return err
+			return nil, err
 		}
 		t = strings.Replace(t, "\n", "", -1)
 		fmt.Fprint(os.Stderr, "\n")
 
 		u, err := strconv.ParseUint(t, 10, 64)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		var found bool
-		for ts, idx := range snapList {
+		for id, idx := range snapList {
 			if uint64(idx) == u {
-				snapID = ts
+				snapID = id
 				found = true
 				break
 			}
 		}
 		if !found {
-			return fmt.Errorf("invalid id '%d'", u)
+			return nil, fmt.Errorf("invalid id '%d'", u)
 		}
 	}
 
+	return chainIncrements(insts, snapID, level)
+}
+
+// chainIncrements returns the increments of chain id a restore of level
+// reads.  Levels past the last increment select the last one.
+func chainIncrements(insts IncrementalFiles, id ChainID, level int32) (IncrementalFiles, error) {
+	snapID := id
 	var maxLevel int32
 	for _, inst := range insts {
-		if inst.Timestamp == snapID {
+		if inst.ChainID == snapID {
 			maxLevel++
 		}
 	}
@@ -91,135 +97,206 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 		level = maxLevel
 	}
 
-	log.Printf("Restoring to level %d...", level)
-	startTime := time.Now()
+	var chain IncrementalFiles
 	for _, inst := range insts {
-		if inst.Timestamp != snapID {
+		if inst.ChainID != snapID {
 			log.Printf("skipping %s", inst.Filename)
 			continue
 		}
 		if inst.Increment > uint16(level) {
 			break
 		}
-		//isLastLevel := inst.Instance == level
-
-		log.Printf("----------  APPLYING LEVEL %d  -----------", inst.Increment)
-		log.Printf("file: %q", inst.Filename)
-		dataFile, err := os.Open(inst.Filename)
-		if err != nil {
-			return err
+		chain = append(chain, inst)
+	}
+	if len(chain) == 0 || chain[0].Increment != 0 {
+		return nil, fmt.Errorf("chain %v: level 0 not found", snapID)
+	}
+	// A differential level only depends on level 0.
+	if last := chain[len(chain)-1]; last.Differential && len(chain) > 2 {
+		for _, inst := range chain[1 : len(chain)-1] {
+			log.Printf("skipping %s", inst.Filename)
 		}
-		header, err := stream.ReadHeader(dataFile)
-		if err != nil {
-			dataFile.Close()
-			return err
+		chain = IncrementalFiles{chain[0], last}
+	}
+	return chain, nil
+}
+
+// findChain returns the chain of insts whose id starts with the hex prefix,
+// as printed by list.
+func findChain(insts IncrementalFiles, prefix string) (ChainID, error) {
+	prefix = strings.ToLower(prefix)
+	var (
+		id    ChainID
+		found bool
+	)
+	for _, inst := range insts {
+		if !strings.HasPrefix(inst.ChainID.String(), prefix) || (found && inst.ChainID == id) {
+			continue
 		}
-		symKey, err := stream.Decapsulate(header, secretKey)
-		if err != nil {
-			dataFile.Close()
-			return err
+		if found {
+			return ChainID{}, fmt.Errorf("chain %q is ambiguous", prefix)
 		}
+		id, found = inst.ChainID, true
+	}
+	if !found {
+		return ChainID{}, fmt.Errorf("chain %q not found", prefix)
+	}
+	return id, nil
+}
 
-		pipeR, pipeW := io.Pipe()
-		eg, ctx := errgroup.WithContext(ctx)
-		eg.Go(func() error {
-			defer dataFile.Close()
-			err = stream.Decrypt(pipeW, dataFile, header.Bytes, symKey)
-			if err != nil {
-				pipeW.Close()
-				return err
-			}
-			return pipeW.Close()
-		})
-		dataFileGZ, err := gzip.NewReader(pipeR)
-		if err != nil {
-			pipeR.Close()
-			pipeW.Close()
-			return err
-		}
+// repository is a store holding chains together with the stores that may hold
+// their chunks.  The agent keeps the chunks of all hosts next to the host
+// directories.
+type repository struct {
+	store  storage.Backend
+	chunks []storage.Backend
+	// tempDir stages content that outgrows memory, the default directory
+	// for temporary files when empty.
+	tempDir string
+}
 
-		b := new(bytes.Buffer)
-		if _, err := io.CopyN(b, dataFileGZ, 3); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
-			return err
-		}
-		hostLen := int64(b.Bytes()[2])
-		b.Reset()
-		b.Grow(1024 * 1024)
-		if _, err := io.CopyN(b, dataFileGZ, hostLen+8+2); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
+// openRepository opens the repository configured in cfg for reading.  Local
+// repositories are kept in localDir.  Content that outgrows memory while
+// reading is staged in tempDir.
+func openRepository(cfg *storage.Config, localDir, tempDir string) (*repository, error) {
+	store, err := storage.Open(cfg, localDir, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := storage.Open(cfg.Parent(), filepath.Dir(filepath.Clean(localDir)), -1, -1)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return &repository{
+		store:   store,
+		chunks:  []storage.Backend{store, parent},
+		tempDir: tempDir,
+	}, nil
+}
+
+func (r *repository) chunkReader(secretKey *stream.SecretKey) *chunkReader {
+	return newChunkReader(secretKey, r.chunks...)
+}
+
+func (r *repository) Close() {
+	for _, store := range r.chunks {
+		store.Close()
+	}
+}
+
+func restore(ctx context.Context, secretKey *stream.SecretKey, repo *repository, destDir string, fileRegexp *regexp.Regexp, level int32) error {
+	insts, err := SnapshotList(secretKey, repo.store)
+	if err != nil {
+		return err
+	}
+	chain, err := selectChain(insts, level)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restoring to level %d...", chain[len(chain)-1].Increment)
+	startTime := time.Now()
+	err = restoreChain(ctx, secretKey, repo, chain, destDir, fileRegexp, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("completed in %v", time.Since(startTime))
+	return nil
+}
+
+// restoreStream writes the state of a chain at level to w without touching
+// the local filesystem, as a tar stream or, with single, as the content of
+// the only file matching fileRegexp.
+func restoreStream(ctx context.Context, secretKey *stream.SecretKey, repo *repository, w io.Writer,
+	fileRegexp *regexp.Regexp, level int32, single bool) error {
+
+	insts, err := SnapshotList(secretKey, repo.store)
+	if err != nil {
+		return err
+	}
+	chain, err := selectChain(insts, level)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Streaming level %d...", chain[len(chain)-1].Increment)
+	startTime := time.Now()
+	if single {
+		err = writeFile(ctx, secretKey, repo, chain, w, fileRegexp)
+	} else {
+		err = writeTar(ctx, secretKey, repo, chain, w, fileRegexp)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("completed in %v", time.Since(startTime))
+	return nil
+}
+
+// restoreChain applies the increments of chain to destDir in order.  When
+// attribs is not nil it receives the attributes of every path in the final
+// state, including the ones that cannot be restored as files.
+func restoreChain(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chain IncrementalFiles,
+	destDir string, fileRegexp *regexp.Regexp, attribs map[string]FileAttributes) error {
+
+	chunks := repo.chunkReader(secretKey)
+
+	for _, inst := range chain {
+		log.Printf("----------  APPLYING LEVEL %d  -----------", inst.Increment)
+		log.Printf("file: %q", inst.Filename)
+		sr, err := OpenSnapshot(secretKey, repo.store, inst.Filename)
+		if err != nil {
 			return err
 		}
-		buf := b.Bytes()
-		if snapID != time.Unix(int64(binary.LittleEndian.Uint64(buf[hostLen:hostLen+8])), 0) {
-			dataFileGZ.Close()
-			pipeR.Close()
+		if inst.ChainID != sr.Header.ChainID {
+			sr.Close()
 			return nil
 		}
-		tmpInc := binary.LittleEndian.Uint16(buf[hostLen+8 : hostLen+8+2])
-		if tmpInc != inst.Increment {
-			dataFileGZ.Close()
-			pipeR.Close()
+		if sr.Header.Increment != inst.Increment {
+			sr.Close()
 			return fmt.Errorf("%q inconsistency: got:%d expected:%d",
-				inst.Filename, tmpInc, inst.Increment)
+				inst.Filename, sr.Header.Increment, inst.Increment)
 		}
+
+		b := new(bytes.Buffer)
+		b.Grow(1024 * 1024)
 		for {
 			if ctx.Err() != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
+				sr.Close()
 				return ctx.Err()
 			}
 			b.Reset()
-			if _, err := io.CopyN(b, dataFileGZ, 2); err != nil {
+			entry, err := sr.Next()
+			if err != nil {
 				if errors.Is(err, io.EOF) {
 					break
 				}
-				dataFileGZ.Close()
-				pipeR.Close()
+				sr.Close()
 				return err
 			}
-			pathLen := binary.LittleEndian.Uint16(b.Bytes()[0:2])
-			b.Reset()
-			if _, err := io.CopyN(b, dataFileGZ, int64(pathLen)); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
-				return err
-			}
-			path := filepath.Join(destDir, b.String())
+			path := filepath.Join(destDir, entry.Path)
 			extract := true
-			if fileRegexp != nil && !fileRegexp.MatchString(b.String()) {
+			if fileRegexp != nil && !fileRegexp.MatchString(entry.Path) {
 				extract = false
 			}
-			b.Reset()
-			if _, err := io.CopyN(b, dataFileGZ, 36); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
-				return err
-			}
-			var attrib FileAttributes
-			if err = attrib.Deserialize(b.Bytes()); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
-				return err
-			}
-			b.Reset()
+			attrib := entry.Attribs
+			flags := entry.Flags
+			dataLen := entry.DataLen
 
-			if _, err := io.CopyN(b, dataFileGZ, 8); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
-				return err
+			if attribs != nil {
+				if attrib.IsEmpty() {
+					delete(attribs, entry.Path)
+				} else {
+					attribs[entry.Path] = attrib
+				}
 			}
-			dataLen := binary.LittleEndian.Uint64(b.Bytes()[0:8])
-			b.Reset()
 
 			if attrib.IsEmpty() {
 				log.Printf("%q: deleting file", path)
 				err = os.Remove(path)
-				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					sr.Close()
 					return err
 				}
 				continue
@@ -243,13 +320,11 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 				}
 				err = syscall.Mkfifo(path, 0o0600)
 				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+					sr.Close()
 					return err
 				}
 				if err = os.Chmod(path, fileMode.Perm()); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+					sr.Close()
 					os.Remove(path)
 					return err
 				}
@@ -264,29 +339,35 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 				}
 				err = os.MkdirAll(path, fileMode)
 				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+					sr.Close()
 					return err
 				}
 				continue
 			case isSymlink(fileMode):
-				if _, err = io.CopyN(b, dataFileGZ, int64(dataLen)); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+				if _, err = io.CopyN(b, entry.Data, int64(dataLen)); err != nil {
+					sr.Close()
 					return err
 				}
 				if !extract {
 					continue
 				}
-				if st, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				if flags&entryDelta == 0 {
 					log.Printf("%q: new symlink -> %s", path, b.Bytes())
+					if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+						sr.Close()
+						return err
+					}
 					err = os.Symlink(b.String(), path)
 					if err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
+						sr.Close()
 						return err
 					}
 				} else {
+					st, err := os.Lstat(path)
+					if err != nil {
+						sr.Close()
+						return fmt.Errorf("%q: no basis for delta: %v", path, err)
+					}
 					log.Printf("%q: patching [symlink]", path)
 
 					reader := bytes.NewReader(b.Bytes())
@@ -294,63 +375,50 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 					if isSymlink(st.Mode()) {
 						currentDelta, err := os.Readlink(path)
 						if err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
+							sr.Close()
 							return err
 						}
 						basis := bytes.NewReader([]byte(currentDelta))
 						if err = librsync.Patch(basis, reader, target); err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
+							sr.Close()
 							return err
 						}
 					} else {
 						basis, err := os.Open(path)
 						if err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
+							sr.Close()
 							return err
 						}
 						if err = librsync.Patch(basis, reader, target); err != nil {
 							basis.Close()
-							dataFileGZ.Close()
-							pipeR.Close()
+							sr.Close()
 							return err
 						}
 						basis.Close()
 					}
 					if err = os.Remove(path); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
+						sr.Close()
 						return err
 					}
 					if err = os.Symlink(target.String(), path); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
+						sr.Close()
 						return err
 					}
 				}
 			default:
 				if !extract {
-					if _, err = io.CopyN(ioutil.Discard, dataFileGZ, int64(dataLen)); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						return err
-					}
 					continue
 				}
 				if fileRegexp != nil {
 					fileDir := filepath.Dir(path)
 					if _, err := os.Stat(fileDir); err != nil {
 						if !os.IsNotExist(err) {
-							dataFileGZ.Close()
-							pipeR.Close()
+							sr.Close()
 							return err
 						}
 						err = os.MkdirAll(fileDir, 0o0755)
 						if err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
+							sr.Close()
 							return err
 						}
 					}
@@ -358,15 +426,36 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 
 				tmpFile, err := os.OpenFile(path+".partial", os.O_CREATE|os.O_WRONLY, 0600)
 				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+					sr.Close()
 					return err
 				}
-				if _, err = os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				if flags&entryChunked != 0 {
+					log.Printf("%q: new file [chunked]", path)
+					if _, err = io.CopyN(b, entry.Data, int64(dataLen)); err != nil {
+						sr.Close()
+						tmpFile.Close()
+						os.Remove(tmpFile.Name())
+						return err
+					}
+					refs, err := ParseChunkRefs(b.Bytes())
+					if err != nil {
+						sr.Close()
+						tmpFile.Close()
+						os.Remove(tmpFile.Name())
+						return err
+					}
+					for _, ref := range refs {
+						if err = chunks.WriteTo(tmpFile, ref); err != nil {
+							sr.Close()
+							tmpFile.Close()
+							os.Remove(tmpFile.Name())
+							return err
+						}
+					}
+				} else if flags&entryDelta == 0 {
 					log.Printf("%q: new file", path)
-					if _, err = io.CopyN(tmpFile, dataFileGZ, int64(dataLen)); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
+					if _, err = io.CopyN(tmpFile, entry.Data, int64(dataLen)); err != nil {
+						sr.Close()
 						tmpFile.Close()
 						os.Remove(tmpFile.Name())
 						return err
@@ -375,9 +464,8 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 					log.Printf("%q: patching", path)
 					buf := new(bytes.Buffer)
 					buf.Grow(int(dataLen))
-					if _, err = io.CopyN(buf, dataFileGZ, int64(dataLen)); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
+					if _, err = io.CopyN(buf, entry.Data, int64(dataLen)); err != nil {
+						sr.Close()
 						tmpFile.Close()
 						os.Remove(tmpFile.Name())
 						return err
@@ -385,8 +473,7 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 
 					basis, err := os.Open(path)
 					if err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
+						sr.Close()
 						tmpFile.Close()
 						os.Remove(tmpFile.Name())
 						return err
@@ -395,8 +482,7 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 					reader := bytes.NewReader(buf.Bytes())
 					if err = librsync.Patch(basis, reader, tmpFile); err != nil {
 						basis.Close()
-						dataFileGZ.Close()
-						pipeR.Close()
+						sr.Close()
 						tmpFile.Close()
 						os.Remove(tmpFile.Name())
 						return err
@@ -404,21 +490,18 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 					basis.Close()
 				}
 				if err = tmpFile.Close(); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+					sr.Close()
 					os.Remove(tmpFile.Name())
 					return err
 				}
 				if err = os.Rename(tmpFile.Name(), path); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
+					sr.Close()
 					os.Remove(tmpFile.Name())
 					return err
 				}
 				if !isSymlink(fileMode) {
 					if err = os.Chmod(path, fileMode.Perm()); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
+						sr.Close()
 						os.Remove(path)
 						return err
 					}
@@ -428,17 +511,9 @@ func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDi
 				}
 			}
 		}
-		if err := eg.Wait(); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
+		if err = sr.Close(); err != nil {
 			return err
 		}
-		if err = dataFileGZ.Close(); err != nil {
-			pipeR.Close()
-			return err
-		}
-		pipeR.Close()
 	}
-	log.Printf("completed in %v", time.Since(startTime))
 	return nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), name) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", name)
+}
+
+// firstWeekday returns the start of the first day of the month of t that
+// falls on d.
+func firstWeekday(t time.Time, d time.Weekday) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return first.AddDate(0, 0, (int(d)-int(first.Weekday())+7)%7)
+}
+
+// due returns why the chain tracked by sc has to be replaced by a new level 0
+// at now, or an empty string when it can be continued.
+func (r *RotationConfig) due(sc *SignatureCache, now time.Time) string {
+	if sc.Len() == 0 {
+		return ""
+	}
+	if r.MaxAgeDays > 0 {
+		maxAge := time.Duration(r.MaxAgeDays) * 24 * time.Hour
+		if age := now.Sub(sc.timeStamp); age >= maxAge {
+			return fmt.Sprintf("chain is %v old", age.Truncate(time.Minute))
+		}
+	}
+	if len(r.MonthlyWeekday) != 0 {
+		// Runs do not have to happen on the day itself; the last such
+		// day up to now only needs to be after the start of the chain.
+		last := firstWeekday(now, r.weekday)
+		if last.After(now) {
+			last = firstWeekday(now.AddDate(0, -1, 1-now.Day()), r.weekday)
+		}
+		if sc.timeStamp.Before(last) {
+			return fmt.Sprintf("chain predates the first %v of the month (%v)",
+				r.weekday, last.Format("2006-01-02"))
+		}
+	}
+	if r.MaxIncrementPercent > 0 && sc.baseSize != 0 {
+		if sc.incrementSize*100 >= sc.baseSize*uint64(r.MaxIncrementPercent) {
+			return fmt.Sprintf("increments total %d bytes, %d%% of level 0",
+				sc.incrementSize, sc.incrementSize*100/sc.baseSize)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotationDue(t *testing.T) {
+	// Sunday 2020-03-01 is the first Sunday of March.
+	chainStart := time.Date(2020, 2, 20, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		rotation RotationConfig
+		now      time.Time
+		baseSize uint64
+		incSize  uint64
+		due      bool
+	}{
+		{"no policy", RotationConfig{}, chainStart.AddDate(1, 0, 0), 100, 1000, false},
+		{"young chain", RotationConfig{MaxAgeDays: 7}, chainStart.AddDate(0, 0, 6), 0, 0, false},
+		{"old chain", RotationConfig{MaxAgeDays: 7}, chainStart.AddDate(0, 0, 7), 0, 0, true},
+		{"before first sunday", RotationConfig{MonthlyWeekday: "sunday", weekday: time.Sunday},
+			time.Date(2020, 2, 29, 3, 0, 0, 0, time.UTC), 0, 0, false},
+		{"on first sunday", RotationConfig{MonthlyWeekday: "sunday", weekday: time.Sunday},
+			time.Date(2020, 3, 1, 3, 0, 0, 0, time.UTC), 0, 0, true},
+		{"missed first sunday", RotationConfig{MonthlyWeekday: "sunday", weekday: time.Sunday},
+			time.Date(2020, 3, 4, 3, 0, 0, 0, time.UTC), 0, 0, true},
+		{"first monday of last month", RotationConfig{MonthlyWeekday: "monday", weekday: time.Monday},
+			time.Date(2020, 3, 1, 3, 0, 0, 0, time.UTC), 0, 0, false},
+		{"small increments", RotationConfig{MaxIncrementPercent: 50}, chainStart, 1000, 499, false},
+		{"large increments", RotationConfig{MaxIncrementPercent: 50}, chainStart, 1000, 500, true},
+		{"combined", RotationConfig{MaxAgeDays: 30, MaxIncrementPercent: 50}, chainStart, 1000, 600, true},
+	}
+	for _, test := range tests {
+		sc := NewSignatureCache(ChainID{}, "host", chainStart, false)
+		sc.Add("/", Fingerprint{}, nil)
+		sc.baseSize = test.baseSize
+		sc.incrementSize = test.incSize
+		reason := test.rotation.due(sc, test.now)
+		if (reason != "") != test.due {
+			t.Errorf("%s: expected due %v, got %q", test.name, test.due, reason)
+		}
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	d, err := parseWeekday("Sunday")
+	if err != nil || d != time.Sunday {
+		t.Fatalf("got %v %v", d, err)
+	}
+	if _, err = parseWeekday("someday"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
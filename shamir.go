@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jrick/ss/stream"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// sharePrefix starts every secret key share.  A share is a single line so it
+// can be stored in a file or pasted:
+//
+//	multus-share:INDEX:THRESHOLD:FINGERPRINT:DATA
+//
+// FINGERPRINT is the base64 fingerprint of the split key, which identifies
+// shares of the same key, and DATA the base64 share of the secret key.
+const sharePrefix = "multus-share:"
+
+// maxShares is the number of shares a key can be split into, the size of the
+// field.
+const maxShares = 255
+
+// Share is one Shamir share of a secret key.
+type Share struct {
+	Index       byte
+	Threshold   byte
+	Fingerprint [fingerprintSize]byte
+	Data        []byte
+}
+
+// String encodes the share as a single line.
+func (s *Share) String() string {
+	return fmt.Sprintf("%s%d:%d:%s:%s", sharePrefix, s.Index, s.Threshold,
+		base64.StdEncoding.EncodeToString(s.Fingerprint[:]),
+		base64.StdEncoding.EncodeToString(s.Data))
+}
+
+// ParseShare decodes a share written by String.
+func ParseShare(line string) (*Share, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, sharePrefix) {
+		return nil, errors.New("not a multus share")
+	}
+	fields := strings.Split(line[len(sharePrefix):], ":")
+	if len(fields) != 4 {
+		return nil, errors.New("invalid share")
+	}
+	index, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil || index == 0 {
+		return nil, fmt.Errorf("invalid share index %q", fields[0])
+	}
+	threshold, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil || threshold < 2 {
+		return nil, fmt.Errorf("invalid share threshold %q", fields[1])
+	}
+	s := &Share{Index: byte(index), Threshold: byte(threshold)}
+	fp, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil || len(fp) != fingerprintSize {
+		return nil, errors.New("invalid share fingerprint")
+	}
+	copy(s.Fingerprint[:], fp)
+	s.Data, err = base64.StdEncoding.DecodeString(fields[3])
+	if err != nil || len(s.Data) != len(stream.SecretKey{}) {
+		return nil, errors.New("invalid share data")
+	}
+	return s, nil
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, in constant time.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ carry&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a != 0, a^254.
+func gfInv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = gfMul(gfMul(r, r), a)
+	}
+	return gfMul(r, r)
+}
+
+// splitKey splits sk into n shares of which any k recover it.
+func splitKey(sk *stream.SecretKey, n, k int) ([]*Share, error) {
+	if k < 2 || k > n || n > maxShares {
+		return nil, fmt.Errorf("cannot split into %d shares with threshold %d", n, k)
+	}
+	shares := make([]*Share, n)
+	fp := secretKeyFingerprint(sk)
+	for i := range shares {
+		shares[i] = &Share{
+			Index:       byte(i + 1),
+			Threshold:   byte(k),
+			Fingerprint: fp,
+			Data:        make([]byte, len(sk)),
+		}
+	}
+	// Every byte of the key is the constant term of a random polynomial
+	// of degree k-1, share i holds its values at x = i+1.
+	coeffs := make([]byte, k-1)
+	defer zero(coeffs)
+	for j, secret := range sk {
+		if _, err := rand.Read(coeffs); err != nil {
+			return nil, err
+		}
+		for _, s := range shares {
+			var y byte
+			for c := len(coeffs) - 1; c >= 0; c-- {
+				y = gfMul(y^coeffs[c], s.Index)
+			}
+			s.Data[j] = y ^ secret
+		}
+	}
+	return shares, nil
+}
+
+// combineShares recovers the secret key from at least threshold shares and
+// checks it against the fingerprint of the shares.
+func combineShares(shares []*Share) (*stream.SecretKey, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	first := shares[0]
+	if len(shares) < int(first.Threshold) {
+		return nil, fmt.Errorf("%d shares, %d needed", len(shares), first.Threshold)
+	}
+	shares = shares[:first.Threshold]
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if s.Threshold != first.Threshold || s.Fingerprint != first.Fingerprint {
+			return nil, errors.New("shares of different keys")
+		}
+		if seen[s.Index] {
+			return nil, fmt.Errorf("share %d given twice", s.Index)
+		}
+		seen[s.Index] = true
+	}
+	// Lagrange interpolation at x = 0.
+	basis := make([]byte, len(shares))
+	for i, si := range shares {
+		num, den := byte(1), byte(1)
+		for j, sj := range shares {
+			if i != j {
+				num = gfMul(num, sj.Index)
+				den = gfMul(den, sj.Index^si.Index)
+			}
+		}
+		basis[i] = gfMul(num, gfInv(den))
+	}
+	sk := new(stream.SecretKey)
+	for j := range sk {
+		var b byte
+		for i, s := range shares {
+			b ^= gfMul(s.Data[j], basis[i])
+		}
+		sk[j] = b
+	}
+	if secretKeyFingerprint(sk) != first.Fingerprint || !checkSecretKey(sk) {
+		zero(sk[:])
+		return nil, errors.New("shares do not combine to the secret key")
+	}
+	return sk, nil
+}
+
+// checkSecretKey reports whether sk decapsulates a key encapsulated to the
+// public key it embeds.  The fingerprint alone does not cover the secret
+// part of sk.
+func checkSecretKey(sk *stream.SecretKey) bool {
+	pk := new(stream.PublicKey)
+	copy(pk[:], sk[secretKeyPublicOffset:])
+	header, key, err := stream.Encapsulate(rand.Reader, pk)
+	if err != nil {
+		return false
+	}
+	h := &stream.Header{
+		Scheme:     stream.StreamlinedNTRUPrime4591761Scheme,
+		Ciphertext: new(stream.Ciphertext),
+	}
+	copy(h.Ciphertext[:], header[1:])
+	got, err := stream.Decapsulate(h, sk)
+	return err == nil && *got == *key
+}
+
+// writeShares writes each share to its own file prefix.N and returns the
+// file names.
+func writeShares(prefix string, shares []*Share) ([]string, error) {
+	files := make([]string, 0, len(shares))
+	for _, s := range shares {
+		file := fmt.Sprintf("%s.%d", prefix, s.Index)
+		fd, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return files, err
+		}
+		_, err = fmt.Fprintln(fd, s)
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// readShare parses input as a share or, failing that, as the name of a file
+// holding one.
+func readShare(input string) (*Share, error) {
+	if strings.HasPrefix(strings.TrimSpace(input), sharePrefix) {
+		return ParseShare(input)
+	}
+	b, err := ioutil.ReadFile(input)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(b)
+	s, err := ParseShare(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", input, err)
+	}
+	return s, nil
+}
+
+// readSecretKeyShares recovers the secret key from shares or share files
+// read from r, one per line, until the threshold is reached.  Lines from a
+// terminal are not echoed.
+func readSecretKeyShares(r *os.File) (*stream.SecretKey, error) {
+	tty := terminal.IsTerminal(int(r.Fd()))
+	var lines *bufio.Scanner
+	if !tty {
+		lines = bufio.NewScanner(r)
+		lines.Buffer(nil, 1<<16)
+	}
+	var shares []*Share
+	for len(shares) == 0 || len(shares) < int(shares[0].Threshold) {
+		var line []byte
+		if tty {
+			prompt := "share or share file"
+			if len(shares) != 0 {
+				prompt += fmt.Sprintf(" %d of %d", len(shares)+1, shares[0].Threshold)
+			}
+			fmt.Fprintf(os.Stderr, "%s: ", prompt)
+			b, err := terminal.ReadPassword(int(r.Fd()))
+			fmt.Fprint(os.Stderr, "\n")
+			if err != nil {
+				return nil, err
+			}
+			line = b
+		} else {
+			if !lines.Scan() {
+				if err := lines.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.ErrUnexpectedEOF
+			}
+			line = lines.Bytes()
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		s, err := readShare(string(line))
+		zero(line)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	defer func() {
+		for _, s := range shares {
+			zero(s.Data)
+		}
+	}()
+	return combineShares(shares)
+}
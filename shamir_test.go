@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("inverse of %d", a)
+		}
+		if gfMul(byte(a), 1) != byte(a) || gfMul(byte(a), 0) != 0 {
+			t.Fatalf("identities of %d", a)
+		}
+	}
+	// 0x53 and 0xca are inverses under the AES polynomial.
+	if gfMul(0x53, 0xca) != 1 || gfMul(0x57, 0x83) != 0xc1 {
+		t.Fatal("not the AES field")
+	}
+}
+
+// subsets calls fn with every k-subset of the indexes below n.
+func subsets(n, k int, fn func([]int)) {
+	set := make([]int, 0, k)
+	var walk func(i int)
+	walk = func(i int) {
+		if len(set) == k {
+			fn(set)
+			return
+		}
+		for ; i < n; i++ {
+			set = append(set, i)
+			walk(i + 1)
+			set = set[:len(set)-1]
+		}
+	}
+	walk(0)
+}
+
+func TestSplitCombine(t *testing.T) {
+	_, sk := testKeys(t)
+	_, sk2 := testKeys(t)
+	for _, test := range []struct{ n, k int }{{2, 2}, {3, 2}, {5, 3}, {6, 4}, {7, 7}, {8, 3}} {
+		shares, err := splitKey(sk, test.n, test.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != test.n {
+			t.Fatalf("%d of %d: %d shares", test.k, test.n, len(shares))
+		}
+		// Shares survive encoding and every k of them recover the key.
+		parsed := make([]*Share, len(shares))
+		for i, s := range shares {
+			if parsed[i], err = ParseShare(s.String()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		subsets(test.n, test.k, func(set []int) {
+			subset := make([]*Share, 0, len(set))
+			for _, i := range set {
+				subset = append(subset, parsed[i])
+			}
+			got, err := combineShares(subset)
+			if err != nil {
+				t.Fatalf("%d of %d, %v: %v", test.k, test.n, set, err)
+			}
+			if *got != *sk {
+				t.Fatalf("%d of %d, %v: key mismatch", test.k, test.n, set)
+			}
+		})
+
+		// k-1 shares are refused, and claiming a lower threshold
+		// interpolates another key.
+		if _, err = combineShares(shares[:test.k-1]); err == nil {
+			t.Fatalf("%d of %d: combined below the threshold", test.k, test.n)
+		}
+		if test.k > 2 {
+			var forged []*Share
+			for _, s := range shares[:test.k-1] {
+				f := *s
+				f.Threshold--
+				forged = append(forged, &f)
+			}
+			_, err = combineShares(forged)
+			if err == nil || !strings.Contains(err.Error(), "do not combine") {
+				t.Fatalf("%d of %d: %d shares recovered the key: %v", test.k, test.n, test.k-1, err)
+			}
+		}
+
+		// Duplicate indexes are rejected.
+		dup := append([]*Share{shares[0]}, shares[:test.k-1]...)
+		if _, err = combineShares(dup); err == nil || !strings.Contains(err.Error(), "given twice") {
+			t.Fatalf("%d of %d: duplicate share: %v", test.k, test.n, err)
+		}
+
+		// Shares of two keys are rejected.
+		other, err := splitKey(sk2, test.n, test.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mixed := append(append([]*Share{}, shares[:test.k-1]...), other[test.k-1])
+		if _, err = combineShares(mixed); err == nil || !strings.Contains(err.Error(), "different keys") {
+			t.Fatalf("%d of %d: shares of two keys: %v", test.k, test.n, err)
+		}
+	}
+
+	shares, err := splitKey(sk, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := *shares[2]
+	bad.Data = append([]byte(nil), bad.Data...)
+	bad.Data[0] ^= 1
+	if _, err = combineShares([]*Share{shares[0], shares[1], &bad}); err == nil {
+		t.Fatal("combined a corrupted share")
+	}
+	for _, test := range []struct{ n, k int }{{2, 3}, {3, 1}, {256, 2}} {
+		if _, err = splitKey(sk, test.n, test.k); err == nil {
+			t.Fatalf("split into %d shares with threshold %d", test.n, test.k)
+		}
+	}
+}
+
+func TestReadSecretKeyShares(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, sk := testKeys(t)
+	shares, err := splitKey(sk, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := writeShares(filepath.Join(dir, "share"), shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("%d share files", len(files))
+	}
+	if _, err = writeShares(filepath.Join(dir, "share"), shares); err == nil {
+		t.Fatal("share files overwritten")
+	}
+
+	read := func(input string) error {
+		name := filepath.Join(dir, "input")
+		if err := ioutil.WriteFile(name, []byte(input), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fd, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		got, err := readSecretKeyShares(fd)
+		if err == nil && *got != *sk {
+			t.Fatal("key mismatch")
+		}
+		return err
+	}
+	if err = read("\n" + files[2] + "\n" + shares[0].String() + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = read(files[1] + "\n" + files[1] + "\n"); err == nil {
+		t.Fatal("combined a share read twice")
+	}
+	if err = read(files[1] + "\n"); err == nil {
+		t.Fatal("combined a single share")
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local keeps a repository in a local directory.  Files are read-only and
+// owned by the backup group.  The directory is created by the first Create.
+type Local struct {
+	dir string
+	uid int
+	gid int
+}
+
+func NewLocal(dir string, uid, gid int) (*Local, error) {
+	return &Local{
+		dir: dir,
+		uid: uid,
+		gid: gid,
+	}, nil
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(name))
+}
+
+type localWriter struct {
+	*os.File
+	l    *Local
+	name string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	if err := os.Chmod(w.File.Name(), 0440); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	if err := os.Chown(w.File.Name(), w.l.uid, w.l.gid); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	if err := os.Rename(w.File.Name(), w.name); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// mkdir creates dir and its missing parents, handing each to the backup
+// group.
+func (l *Local) mkdir(dir string) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return err
+	}
+	if err := l.mkdir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0750); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return os.Chown(dir, l.uid, l.gid)
+}
+
+func (l *Local) Create(name string) (Writer, error) {
+	path := l.path(name)
+	if err := l.mkdir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path+".partial", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: fd, l: l, name: path}, nil
+}
+
+func (l *Local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *Local) Stat(name string) (FileInfo, error) {
+	st, err := os.Stat(l.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (l *Local) List(dir string) ([]FileInfo, error) {
+	infos, err := ioutil.ReadDir(l.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+func (l *Local) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *Local) Location() string {
+	return l.dir
+}
+
+func (l *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is the size of the parts of multipart uploads.  S3
+	// requires at least 5 MiB for every part but the last.
+	s3PartSize = 8 << 20
+	// s3Timeout bounds connection setup and the wait for a response.
+	// Bodies are streamed, so the transfer itself is not bounded.
+	s3Timeout = time.Minute
+)
+
+// S3 keeps a repository below a prefix of an S3-compatible bucket.  Requests
+// use path style addressing and AWS signature version 4.
+type S3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	partSize  int
+	// header is added to every upload, for example to set object lock
+	// retention.
+	header http.Header
+}
+
+func NewS3(cfg *Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage needs endpoint and bucket")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		client:    newS3Client(),
+		partSize:  s3PartSize,
+		header:    make(http.Header),
+	}, nil
+}
+
+// newS3Client returns a client giving up on servers that do not answer in
+// time.  A stall during a transfer is caught by the idle timer of do.
+func newS3Client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: s3Timeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   s3Timeout,
+			ResponseHeaderTimeout: s3Timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   4,
+		},
+	}
+}
+
+// idleReader resets timer with every read, so the request it belongs to is
+// only canceled when no data moves for s3Timeout.
+type idleReader struct {
+	io.Reader
+	timer *time.Timer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(s3Timeout)
+	return r.Reader.Read(p)
+}
+
+// s3Body is the body of a response.  Closing it releases the request.
+type s3Body struct {
+	idleReader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (b *s3Body) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+// SetUploadHeader adds a header to all later uploads.
+func (s *S3) SetUploadHeader(key, value string) {
+	s.header.Set(key, value)
+}
+
+// s3Escape escapes s as required for canonical requests.  Slashes are kept
+// unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// do sends a signed request for key, which is relative to the bucket, and
+// returns the response when it has a 2xx status.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	uri := "/" + s.bucket
+	if key != "" {
+		uri += "/" + key
+	}
+	escapedURI := path.Join(s3Escape(strings.TrimSuffix(s.endpoint.Path, "/"), false)) + s3Escape(uri, false)
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var queryParts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			queryParts = append(queryParts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	rawQuery := strings.Join(queryParts, "&")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(s3Timeout, cancel)
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint.Scheme+"://"+s.endpoint.Host+escapedURI, nil)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	if len(body) != 0 {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(&idleReader{Reader: bytes.NewReader(body), timer: timer}), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+	req.URL.RawQuery = rawQuery
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if len(body) != 0 {
+		// Required for uploads to buckets with object lock.
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	payloadHash := sha256.Sum256(body)
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// Sign the host and all x-amz and content headers.
+	signed := map[string]string{"host": s.endpoint.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || strings.HasPrefix(lk, "content-") {
+			signed[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{method, escapedURI, rawQuery, canonicalHeaders.String(),
+		signedHeaders, hex.EncodeToString(payloadHash[:])}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	resp.Body = &s3Body{
+		idleReader: idleReader{Reader: resp.Body, timer: timer},
+		body:       resp.Body,
+		cancel:     cancel,
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	xml.Unmarshal(b, &s3Err)
+	if resp.StatusCode == http.StatusNotFound && (s3Err.Code == "" || s3Err.Code == "NoSuchKey") {
+		return nil, &notExist{strings.TrimPrefix(key, s.prefix)}
+	}
+	if s3Err.Code == "" {
+		s3Err.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %v %v: %v %v", method, key, s3Err.Code, s3Err.Message)
+}
+
+type s3Writer struct {
+	s        *S3
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := w.s.partSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == w.s.partSize {
+			if err := w.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *s3Writer) uploadPart() error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, w.s.header, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.uploadID = result.UploadID
+	}
+	number := len(w.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}
+	resp, err := w.s.do(http.MethodPut, w.key, query, nil, w.buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPut, w.key, nil, w.s.header, w.buf)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if len(w.buf) != 0 {
+		if err := w.uploadPart(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer resp.Body.Close()
+	// Completion errors may come with a 200 status.
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		w.Abort()
+		return fmt.Errorf("s3 complete %v: %v %v", w.key, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.buf = nil
+	if w.uploadID == "" {
+		return nil
+	}
+	resp, err := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) Create(name string) (Writer, error) {
+	return &s3Writer{s: s, key: s.prefix + name}, nil
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.prefix+name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(name string) (FileInfo, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+name, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) List(dir string) ([]FileInfo, error) {
+	prefix := s.prefix
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		prefix += dir + "/"
+	}
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			files = append(files, FileInfo{
+				Name:    strings.TrimPrefix(c.Key, prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) Location() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+func (s *S3) Close() error {
+	return nil
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// sshTimeout bounds connection setup.
+	sshTimeout = 10 * time.Second
+	// sftpOldSuffix marks the previous version of a file while it is
+	// replaced.
+	sftpOldSuffix = ".old"
+)
+
+// SSHClientConfig returns a client configuration logging in as login with
+// the private key in identityFile and checking host keys against
+// knownHostsFile.
+func SSHClientConfig(login, identityFile, knownHostsFile string) (*ssh.ClientConfig, error) {
+	keyBytes, err := ioutil.ReadFile(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", identityFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            login,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshTimeout,
+	}, nil
+}
+
+// DialSSH connects to the SSH server at addr.
+func DialSSH(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	d := net.Dialer{Timeout: sshTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(sshTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// SFTP keeps a repository in a directory on an SFTP server.
+type SFTP struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	root   string
+}
+
+// DialSFTP connects to the server configured in cfg.
+func DialSFTP(cfg *Config) (*SFTP, error) {
+	if cfg.Host == "" || cfg.Path == "" {
+		return nil, fmt.Errorf("sftp storage needs host and path")
+	}
+	config, err := SSHClientConfig(cfg.Login, cfg.IdentityFile, cfg.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	client, err := DialSSH(context.Background(), net.JoinHostPort(cfg.Host, strconv.Itoa(port)), config)
+	if err != nil {
+		return nil, err
+	}
+	return NewSFTP(client, cfg.Path)
+}
+
+// NewSFTP returns a backend rooted at root on the server client is
+// connected to.  Closing the backend closes client.
+func NewSFTP(client *ssh.Client, root string) (*SFTP, error) {
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err = sc.MkdirAll(root); err != nil {
+		sc.Close()
+		client.Close()
+		return nil, err
+	}
+	return &SFTP{
+		ssh:    client,
+		client: sc,
+		root:   path.Clean(root),
+	}, nil
+}
+
+func (s *SFTP) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+type sftpWriter struct {
+	*sftp.File
+	s    *SFTP
+	name string
+}
+
+func (w *sftpWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		w.s.client.Remove(w.File.Name())
+		return err
+	}
+	err := w.s.client.PosixRename(w.File.Name(), w.name)
+	if err != nil {
+		err = w.s.replace(w.File.Name(), w.name)
+	}
+	if err != nil {
+		w.s.client.Remove(w.File.Name())
+		return err
+	}
+	return nil
+}
+
+// replace renames tmp to name on servers without the posix-rename
+// extension, which refuse to replace files.  The old file is moved aside
+// first and only removed once tmp took its place, so one of them is always
+// there for Open.
+func (s *SFTP) replace(tmp, name string) error {
+	old := name + sftpOldSuffix
+	_, err := s.client.Lstat(name)
+	if err == nil {
+		// An old file left by an interrupted replace is only removed
+		// while name is there.
+		s.client.Remove(old)
+		err = s.client.Rename(name, old)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = s.client.Rename(tmp, name); err != nil {
+		s.client.Rename(old, name)
+		return err
+	}
+	s.client.Remove(old)
+	return nil
+}
+
+func (w *sftpWriter) Abort() error {
+	w.File.Close()
+	return w.s.client.Remove(w.File.Name())
+}
+
+func (s *SFTP) Create(name string) (Writer, error) {
+	p := s.path(name)
+	if err := s.client.MkdirAll(path.Dir(p)); err != nil {
+		return nil, err
+	}
+	f, err := s.client.Create(p + ".partial")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{File: f, s: s, name: p}, nil
+}
+
+func (s *SFTP) Open(name string) (io.ReadCloser, error) {
+	f, err := s.client.Open(s.path(name))
+	if os.IsNotExist(err) {
+		// A replace may have been interrupted.
+		f, err = s.client.Open(s.path(name) + sftpOldSuffix)
+	}
+	if os.IsNotExist(err) {
+		return nil, &notExist{name}
+	}
+	return f, err
+}
+
+func (s *SFTP) Stat(name string) (FileInfo, error) {
+	st, err := s.client.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		st, err = s.client.Stat(s.path(name) + sftpOldSuffix)
+	}
+	if os.IsNotExist(err) {
+		return FileInfo{}, &notExist{name}
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (s *SFTP) List(dir string) ([]FileInfo, error) {
+	infos, err := s.client.ReadDir(s.path(dir))
+	if os.IsNotExist(err) {
+		return nil, &notExist{dir}
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+func (s *SFTP) Remove(name string) error {
+	s.client.Remove(s.path(name) + sftpOldSuffix)
+	err := s.client.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return &notExist{name}
+	}
+	return err
+}
+
+func (s *SFTP) Location() string {
+	return "sftp://" + s.ssh.RemoteAddr().String() + s.root
+}
+
+func (s *SFTP) Close() error {
+	err := s.client.Close()
+	if cerr := s.ssh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
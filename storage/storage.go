@@ -0,0 +1,123 @@
+// Package storage provides the backends a backup repository can be kept in:
+// a local directory, a directory on an SFTP server or an S3-compatible
+// bucket.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Backend stores the files of a repository.  Names are slash separated and
+// relative to the root of the repository.
+type Backend interface {
+	// Create returns a writer for name.  The file only appears once the
+	// writer is closed and replaces any file of the same name.
+	Create(name string) (Writer, error)
+	Open(name string) (io.ReadCloser, error)
+	// Stat returns an error wrapping os.ErrNotExist for missing files.
+	Stat(name string) (FileInfo, error)
+	// List returns the files directly below dir.  An empty dir lists the
+	// root of the repository.
+	List(dir string) ([]FileInfo, error)
+	Remove(name string) error
+	// Location describes the repository for log messages.
+	Location() string
+	Close() error
+}
+
+// Writer writes a new file.  Close makes the file visible and Abort discards
+// it.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// FileInfo describes a stored file.  Name is relative to the listed
+// directory for List and to the repository root for Stat.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Config selects and configures the backend holding a repository.
+type Config struct {
+	// Type is local, sftp or s3.
+	Type string
+
+	// Host, Port, Login, IdentityFile, KnownHostsFile and Path configure
+	// the sftp backend.
+	Host           string
+	Port           int
+	Login          string
+	IdentityFile   string
+	KnownHostsFile string
+	Path           string
+
+	// Endpoint, Region, Bucket, Prefix, AccessKey and SecretKey configure
+	// the s3 backend.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// IsLocal reports whether cfg selects the local backend.
+func (cfg *Config) IsLocal() bool {
+	return cfg.Type == "" || cfg.Type == "local"
+}
+
+// Parent returns the configuration of the directory or prefix containing the
+// repository of cfg.  Local repositories take the parent of their directory.
+func (cfg *Config) Parent() *Config {
+	parent := *cfg
+	if p := path.Dir(strings.Trim(cfg.Prefix, "/")); p != "." {
+		parent.Prefix = p
+	} else {
+		parent.Prefix = ""
+	}
+	if cfg.Path != "" {
+		parent.Path = path.Dir(path.Clean(cfg.Path))
+	}
+	return &parent
+}
+
+// Open returns the backend selected by cfg.  The local backend is rooted at
+// localDir and hands its files to uid and gid.
+func Open(cfg *Config, localDir string, uid, gid int) (Backend, error) {
+	switch {
+	case cfg.IsLocal():
+		return NewLocal(localDir, uid, gid)
+	case cfg.Type == "sftp":
+		return DialSFTP(cfg)
+	case cfg.Type == "s3":
+		return NewS3(cfg)
+	}
+	return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+}
+
+// notExist wraps err so errors.Is(err, os.ErrNotExist) holds.
+type notExist struct {
+	name string
+}
+
+func (e *notExist) Error() string {
+	return fmt.Sprintf("%v: %v", e.name, os.ErrNotExist)
+}
+
+func (e *notExist) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// IsNotExist reports whether err means a file does not exist.
+func IsNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
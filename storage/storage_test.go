@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// fakeS3 is a minimal in-memory S3 stand-in using path style requests.  It
+// checks the signature of every request against the secret key "sk".
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+	uploads map[string]map[int][]byte
+	nextID  int
+	parts   int
+	// failComplete makes the completion of multipart uploads fail with
+	// a 200 status, as S3 does for errors found late.
+	failComplete bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		headers: make(map[string]http.Header),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := checkSigV4(r, body, "ak", "sk"); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>%s</Message></Error>", err)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != "bucket" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<Error><Code>NoSuchBucket</Code></Error>")
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		prefix := q.Get("prefix")
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) && !strings.Contains(k[len(prefix):], "/") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, "<ListBucketResult>")
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+				k, len(f.objects[k]), time.Now().UTC().Format(time.RFC3339))
+		}
+		fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		f.headers[key] = r.Header.Clone()
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.uploads[q.Get("uploadId")][n] = body
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		var req struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.failComplete {
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>failed</Message></Error>")
+			return
+		}
+		var obj []byte
+		for i, p := range req.Parts {
+			if p.PartNumber != i+1 || p.ETag != fmt.Sprintf(`"%d"`, p.PartNumber) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			obj = append(obj, f.uploads[q.Get("uploadId")][p.PartNumber]...)
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		f.objects[key] = obj
+		fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.headers[key] = r.Header.Clone()
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			}
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(obj)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// sigV4Escape escapes s the way canonical requests need it.
+func sigV4Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// checkSigV4 verifies the AWS signature version 4 of r, which was sent with
+// body.
+func checkSigV4(r *http.Request, body []byte, accessKey, secretKey string) error {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	fields := make(map[string]string)
+	for _, f := range strings.Split(auth, ", ") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid authorization %q", auth)
+		}
+		fields[kv[0]] = kv[1]
+	}
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[0] != accessKey || cred[3] != "s3" || cred[4] != "aws4_request" {
+		return fmt.Errorf("invalid credential %q", fields["Credential"])
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	ts, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, cred[1]) || time.Since(ts) > 15*time.Minute {
+		return fmt.Errorf("invalid date %q", amzDate)
+	}
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return fmt.Errorf("payload hash mismatch")
+	}
+	if md := r.Header.Get("Content-MD5"); md != "" {
+		sum := md5.Sum(body)
+		if md != base64.StdEncoding.EncodeToString(sum[:]) {
+			return fmt.Errorf("content md5 mismatch")
+		}
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	signed := make(map[string]bool)
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		signed[h] = true
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	for k := range r.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") && !signed[lk] {
+			return fmt.Errorf("%v not signed", k)
+		}
+	}
+	if !signed["host"] {
+		return fmt.Errorf("host not signed")
+	}
+
+	var query []string
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			query = append(query, sigV4Escape(k)+"="+sigV4Escape(v))
+		}
+	}
+	sort.Strings(query)
+
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), strings.Join(query, "&"),
+		headers.String(), fields["SignedHeaders"], hex.EncodeToString(payloadHash[:])}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := strings.Join(cred[1:], "/")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + secretKey)
+	for _, s := range cred[1:] {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(fields["Signature"]), []byte(want)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func testBackend(t *testing.T, b Backend) {
+	t.Helper()
+
+	if _, err := b.Stat("a.gz.enc"); !IsNotExist(err) {
+		t.Fatalf("stat of missing file: %v", err)
+	}
+	if _, err := b.Open("a.gz.enc"); !IsNotExist(err) {
+		t.Fatalf("open of missing file: %v", err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	for _, name := range []string{"a.gz.enc", "chunks/ab/ab.enc"} {
+		w, err := b.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := b.Create("aborted.gz.enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err = w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := b.Stat("chunks/ab/ab.enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != int64(len(data)) {
+		t.Fatalf("size %d, expected %d", st.Size, len(data))
+	}
+	r, err := b.Open("a.gz.enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %d bytes: %v", len(got), err)
+	}
+	files, err := b.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "a.gz.enc" {
+		t.Fatalf("unexpected listing %+v", files)
+	}
+	files, err = b.List("chunks/ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "ab.enc" {
+		t.Fatalf("unexpected listing %+v", files)
+	}
+	if err = b.Remove("a.gz.enc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat("a.gz.enc"); !IsNotExist(err) {
+		t.Fatalf("stat of removed file: %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := NewLocal(dir, os.Geteuid(), os.Getegid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
+
+func TestS3(t *testing.T) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	b, err := NewS3(&Config{
+		Type:      "s3",
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		Prefix:    "/host1/",
+		AccessKey: "ak",
+		SecretKey: "sk",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Force multipart uploads for the test data.
+	b.partSize = 16 << 10
+	b.SetUploadHeader("X-Amz-Object-Lock-Mode", "GOVERNANCE")
+	testBackend(t, b)
+
+	if fake.parts != 11 {
+		t.Fatalf("%d parts uploaded, expected 11", fake.parts)
+	}
+	if len(fake.uploads) != 0 {
+		t.Fatalf("%d uploads left open", len(fake.uploads))
+	}
+	if _, ok := fake.objects["host1/chunks/ab/ab.enc"]; !ok {
+		t.Fatal("prefix not applied")
+	}
+	if fake.headers["host1/chunks/ab/ab.enc"].Get("X-Amz-Object-Lock-Mode") != "GOVERNANCE" {
+		t.Fatal("upload header not sent")
+	}
+
+	// Names that need escaping are signed as sent.
+	name := "dir/a b+c=d~e.gz.enc"
+	w, err := b.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["host1/"+name]; !ok {
+		t.Fatalf("%q not stored", name)
+	}
+	if files, err := b.List("dir"); err != nil || len(files) != 1 || files[0].Name != "a b+c=d~e.gz.enc" {
+		t.Fatalf("unexpected listing %+v: %v", files, err)
+	}
+
+	// Failed completions abort the upload.
+	fake.failComplete = true
+	w, err = b.Create("failed.gz.enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, 40<<10))
+	if err = w.Close(); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("expected a completion error, got %v", err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Fatal("failed upload left open")
+	}
+}
+
+func TestS3WrongKey(t *testing.T) {
+	srv := httptest.NewServer(newFakeS3())
+	defer srv.Close()
+
+	b, err := NewS3(&Config{
+		Type:      "s3",
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		AccessKey: "ak",
+		SecretKey: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Stat("a.gz.enc")
+	if err == nil || IsNotExist(err) {
+		t.Fatalf("expected a signature error, got %v", err)
+	}
+	w, _ := b.Create("a.gz.enc")
+	w.Write([]byte("data"))
+	if err = w.Close(); err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("expected a signature error, got %v", err)
+	}
+}
+
+// testSFTP returns an SFTP backend for dir served in-process.
+func testSFTP(t *testing.T, dir string) *SFTP {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	srv, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		srv.Close()
+	})
+	return &SFTP{client: client, root: dir}
+}
+
+func TestSFTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := testSFTP(t, dir)
+	testBackend(t, b)
+
+	// Replacing without posix-rename keeps the old file until the new
+	// one is in place.
+	write := func(name, data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		r, err := b.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	write("sig.cache", "old")
+	write("sig.cache.partial", "new")
+	if err = b.replace(filepath.Join(dir, "sig.cache.partial"), filepath.Join(dir, "sig.cache")); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("sig.cache"); got != "new" {
+		t.Fatalf("read %q after replace", got)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sig.cache"+sftpOldSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("old file kept: %v", err)
+	}
+
+	// A replace interrupted after moving the old file aside.
+	os.Rename(filepath.Join(dir, "sig.cache"), filepath.Join(dir, "sig.cache"+sftpOldSuffix))
+	if got := read("sig.cache"); got != "new" {
+		t.Fatalf("read %q after interrupted replace", got)
+	}
+	write("sig.cache.partial", "newer")
+	if err = b.replace(filepath.Join(dir, "sig.cache.partial"), filepath.Join(dir, "sig.cache")); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("sig.cache"); got != "newer" {
+		t.Fatalf("read %q after replace", got)
+	}
+	if err = b.Remove("sig.cache"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Stat("sig.cache"); !IsNotExist(err) {
+		t.Fatalf("stat of removed file: %v", err)
+	}
+}
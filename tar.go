@@ -0,0 +1,421 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jrick/ss/stream"
+	"github.com/silvasur/golibrsync/librsync"
+)
+
+// chainSource is the final state of a path in a chain: its attributes and,
+// for files and symlinks, the increment holding the last full entry and the
+// deltas that apply on top of it.
+type chainSource struct {
+	Attribs FileAttributes
+	// Base indexes the chain, -1 for paths without data.
+	Base   int
+	Deltas []deltaRef
+}
+
+// deltaRef locates a delta in the deltas of a chainPlan.
+type deltaRef struct {
+	Offset int64
+	Len    int64
+}
+
+// chainPlan is the final state of the paths of a chain.
+type chainPlan struct {
+	Sources map[string]*chainSource
+	// deltas holds the deltas of all sources, staged in a temporary file
+	// once they outgrow memory.
+	deltas *fileContent
+}
+
+// Close releases the deltas of the plan.
+func (p *chainPlan) Close() error {
+	return p.deltas.Close()
+}
+
+// chainEntry is a path in the final state of a chain.
+type chainEntry struct {
+	Path    string
+	Attribs FileAttributes
+	// Size is the length of the content of a regular file, which Content
+	// writes.
+	Size    int64
+	Content func(io.Writer) error
+	// Link is the target of a symlink.
+	Link string
+
+	// patched is the content of a file with deltas, released once the
+	// entry was handled.
+	patched *fileContent
+}
+
+// openIncrement opens the snapshot of inst and checks that it belongs to the
+// chain.
+func openIncrement(secretKey *stream.SecretKey, repo *repository, inst *IncrementalFile) (*SnapshotReader, error) {
+	sr, err := OpenSnapshot(secretKey, repo.store, inst.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if inst.ChainID != sr.Header.ChainID || sr.Header.Increment != inst.Increment {
+		sr.Close()
+		return nil, fmt.Errorf("%q inconsistency: got:%v.%d expected:%v.%d", inst.Filename,
+			sr.Header.ChainID, sr.Header.Increment, inst.ChainID, inst.Increment)
+	}
+	return sr, nil
+}
+
+// planChain reads the increments of chain and returns the final state of the
+// paths matching fileRegexp.  Deltas are staged with the plan, so nothing is
+// written to the destination while planning.  Deltas that outgrow memory
+// are staged in the temporary directory of repo.
+func planChain(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chain IncrementalFiles,
+	fileRegexp *regexp.Regexp) (*chainPlan, error) {
+
+	deltas, err := newFileContent(repo.tempDir, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &chainPlan{Sources: make(map[string]*chainSource), deltas: deltas}
+	if err = p.read(ctx, secretKey, repo, chain, fileRegexp); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *chainPlan) read(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chain IncrementalFiles,
+	fileRegexp *regexp.Regexp) error {
+
+	plan := p.Sources
+	for i := range chain {
+		sr, err := openIncrement(secretKey, repo, &chain[i])
+		if err != nil {
+			return err
+		}
+		for {
+			if ctx.Err() != nil {
+				sr.Close()
+				return ctx.Err()
+			}
+			entry, err := sr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				sr.Close()
+				return err
+			}
+			if fileRegexp != nil && !fileRegexp.MatchString(entry.Path) {
+				continue
+			}
+			attrib := entry.Attribs
+			if attrib.IsEmpty() {
+				delete(plan, entry.Path)
+				continue
+			}
+			fileMode := os.FileMode(attrib.Mode)
+			if !fileMode.IsRegular() && !isSymlink(fileMode) {
+				plan[entry.Path] = &chainSource{Attribs: attrib, Base: -1}
+				continue
+			}
+			if entry.Flags&entryDelta == 0 {
+				plan[entry.Path] = &chainSource{Attribs: attrib, Base: i}
+				continue
+			}
+			src := plan[entry.Path]
+			if src == nil || src.Base < 0 {
+				sr.Close()
+				return fmt.Errorf("%q: no basis for delta", entry.Path)
+			}
+			delta := deltaRef{Offset: p.deltas.Size(), Len: int64(entry.DataLen)}
+			if _, err = io.CopyN(p.deltas, entry.Data, delta.Len); err != nil {
+				sr.Close()
+				return err
+			}
+			src.Attribs = attrib
+			src.Deltas = append(src.Deltas, delta)
+		}
+		if err = sr.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkChain calls fn for every path in plan, directories and other paths
+// without data first, in path order, then files and symlinks in the order of
+// the increments holding them.  Content is read from the increments as fn
+// consumes it; only files with deltas are patched beforehand, one at a time,
+// in the temporary directory of repo when they outgrow memory.
+func walkChain(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chain IncrementalFiles,
+	cp *chainPlan, fn func(*chainEntry) error) error {
+
+	plan := cp.Sources
+	var paths []string
+	bases := make(map[int]bool)
+	for path, src := range plan {
+		if src.Base < 0 {
+			paths = append(paths, path)
+		} else {
+			bases[src.Base] = true
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := fn(&chainEntry{Path: path, Attribs: plan[path].Attribs}); err != nil {
+			return err
+		}
+	}
+
+	chunks := repo.chunkReader(secretKey)
+	for i := range chain {
+		if !bases[i] {
+			continue
+		}
+		sr, err := openIncrement(secretKey, repo, &chain[i])
+		if err != nil {
+			return err
+		}
+		for {
+			if ctx.Err() != nil {
+				sr.Close()
+				return ctx.Err()
+			}
+			entry, err := sr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				sr.Close()
+				return err
+			}
+			src := plan[entry.Path]
+			if src == nil || src.Base != i || entry.Flags&entryDelta != 0 || entry.Attribs.IsEmpty() {
+				continue
+			}
+			ce, err := readChainEntry(entry, src, chunks, cp.deltas, repo.tempDir)
+			if err == nil {
+				err = fn(ce)
+				if ce.patched != nil {
+					ce.patched.Close()
+				}
+			}
+			if err != nil {
+				sr.Close()
+				return fmt.Errorf("%q: %v", entry.Path, err)
+			}
+		}
+		if err = sr.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChainEntry returns the final state of the file or symlink whose full
+// entry is entry.  Deltas are read from deltas and files with deltas are
+// patched in tempDir when they outgrow memory.
+func readChainEntry(entry *SnapshotEntry, src *chainSource, chunks *chunkReader,
+	deltas io.ReaderAt, tempDir string) (*chainEntry, error) {
+
+	ce := &chainEntry{Path: entry.Path, Attribs: src.Attribs}
+	var refs []ChunkRef
+	if entry.Flags&entryChunked != 0 {
+		b := make([]byte, entry.DataLen)
+		if _, err := io.ReadFull(entry.Data, b); err != nil {
+			return nil, err
+		}
+		var err error
+		if refs, err = ParseChunkRefs(b); err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			ce.Size += int64(ref.Len)
+		}
+		ce.Content = func(w io.Writer) error {
+			for _, ref := range refs {
+				if err := chunks.WriteTo(w, ref); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	} else {
+		ce.Size = int64(entry.DataLen)
+		ce.Content = func(w io.Writer) error {
+			_, err := io.Copy(w, entry.Data)
+			return err
+		}
+	}
+
+	if len(src.Deltas) != 0 || isSymlink(os.FileMode(src.Attribs.Mode)) {
+		content, err := newFileContent(tempDir, ce.Size)
+		if err != nil {
+			return nil, err
+		}
+		if err = ce.Content(content); err != nil {
+			content.Close()
+			return nil, err
+		}
+		for _, delta := range src.Deltas {
+			var target *fileContent
+			target, err = newFileContent(tempDir, src.Attribs.Size)
+			if err == nil {
+				err = librsync.Patch(content, io.NewSectionReader(deltas, delta.Offset, delta.Len), target)
+				if err != nil {
+					target.Close()
+				}
+			}
+			content.Close()
+			if err != nil {
+				return nil, err
+			}
+			content = target
+		}
+		if isSymlink(os.FileMode(src.Attribs.Mode)) {
+			ce.Link = content.String()
+			ce.Size = 0
+			ce.Content = nil
+			content.Close()
+			return ce, nil
+		}
+		ce.Size = content.Size()
+		ce.Content = func(w io.Writer) error {
+			_, err := io.Copy(w, io.NewSectionReader(content, 0, content.Size()))
+			return err
+		}
+		ce.patched = content
+	}
+	return ce, nil
+}
+
+// tarHeader returns the tar header of ce.  Sockets have none.
+func tarHeader(ce *chainEntry) (*tar.Header, error) {
+	fileMode := os.FileMode(ce.Attribs.Mode)
+	mode := int64(fileMode.Perm())
+	if fileMode&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if fileMode&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if fileMode&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	name := strings.TrimPrefix(ce.Path, "/")
+	if name == "" {
+		name = "."
+	}
+	// PAX keeps sub-second modification times.
+	hdr := &tar.Header{
+		Format:  tar.FormatPAX,
+		Name:    name,
+		Mode:    mode,
+		Uid:     int(ce.Attribs.UID),
+		Gid:     int(ce.Attribs.GID),
+		ModTime: time.Unix(0, ce.Attribs.MTim),
+	}
+	switch {
+	case isSocket(fileMode):
+		return nil, nil
+	case isCharDevice(fileMode):
+		hdr.Typeflag = tar.TypeChar
+	case isDevice(fileMode):
+		hdr.Typeflag = tar.TypeBlock
+	case isNamedPipe(fileMode):
+		hdr.Typeflag = tar.TypeFifo
+	case isDir(fileMode):
+		hdr.Typeflag = tar.TypeDir
+		if name != "." {
+			hdr.Name += "/"
+		}
+	case isSymlink(fileMode):
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = ce.Link
+	case fileMode.IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = ce.Size
+	default:
+		return nil, fmt.Errorf("unsupported mode %v", fileMode)
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		hdr.Devmajor = int64(major(ce.Attribs.RDev))
+		hdr.Devminor = int64(minor(ce.Attribs.RDev))
+	}
+	return hdr, nil
+}
+
+// writeTar writes the final state of chain as a tar stream to w.
+func writeTar(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chain IncrementalFiles,
+	w io.Writer, fileRegexp *regexp.Regexp) error {
+
+	plan, err := planChain(ctx, secretKey, repo, chain, fileRegexp)
+	if err != nil {
+		return err
+	}
+	defer plan.Close()
+	tw := tar.NewWriter(w)
+	err = walkChain(ctx, secretKey, repo, chain, plan, func(ce *chainEntry) error {
+		hdr, err := tarHeader(ce)
+		if err != nil {
+			return err
+		}
+		if hdr == nil {
+			log.Printf("%q: unsupported file", ce.Path)
+			return nil
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		return ce.Content(tw)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeFile writes the content of the only regular file of chain matching
+// fileRegexp to w.
+func writeFile(ctx context.Context, secretKey *stream.SecretKey, repo *repository, chain IncrementalFiles,
+	w io.Writer, fileRegexp *regexp.Regexp) error {
+
+	plan, err := planChain(ctx, secretKey, repo, chain, fileRegexp)
+	if err != nil {
+		return err
+	}
+	defer plan.Close()
+	var files []string
+	for path, src := range plan.Sources {
+		if os.FileMode(src.Attribs.Mode).IsRegular() {
+			files = append(files, path)
+		} else {
+			delete(plan.Sources, path)
+		}
+	}
+	switch len(files) {
+	case 0:
+		return fmt.Errorf("no file matches %v", fileRegexp)
+	case 1:
+	default:
+		sort.Strings(files)
+		return fmt.Errorf("%d files match %v: %v", len(files), fileRegexp, strings.Join(files, ", "))
+	}
+	return walkChain(ctx, secretKey, repo, chain, plan, func(ce *chainEntry) error {
+		return ce.Content(w)
+	})
+}
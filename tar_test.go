@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jrick/ss/stream"
+)
+
+func TestTarHeader(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	attribs := func(mode os.FileMode, rdev uint64) FileAttributes {
+		return FileAttributes{Mode: uint32(mode), UID: 1234, GID: 5678, MTim: mtime.UnixNano(), RDev: rdev}
+	}
+	tests := []struct {
+		name string
+		ce   chainEntry
+		want tar.Header
+	}{
+		{
+			name: "file",
+			ce:   chainEntry{Path: "/a/file", Attribs: attribs(0640, 0), Size: 10},
+			want: tar.Header{Typeflag: tar.TypeReg, Name: "a/file", Mode: 0640, Size: 10},
+		},
+		{
+			name: "setuid file",
+			ce:   chainEntry{Path: "/a/suid", Attribs: attribs(0755|os.ModeSetuid|os.ModeSetgid, 0)},
+			want: tar.Header{Typeflag: tar.TypeReg, Name: "a/suid", Mode: 06755},
+		},
+		{
+			name: "sticky directory",
+			ce:   chainEntry{Path: "/tmp", Attribs: attribs(0777|os.ModeDir|os.ModeSticky, 0)},
+			want: tar.Header{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 01777},
+		},
+		{
+			name: "root",
+			ce:   chainEntry{Path: "/", Attribs: attribs(0755|os.ModeDir, 0)},
+			want: tar.Header{Typeflag: tar.TypeDir, Name: ".", Mode: 0755},
+		},
+		{
+			name: "symlink",
+			ce:   chainEntry{Path: "/a/link", Attribs: attribs(0777|os.ModeSymlink, 0), Link: "../target"},
+			want: tar.Header{Typeflag: tar.TypeSymlink, Name: "a/link", Mode: 0777, Linkname: "../target"},
+		},
+		{
+			name: "character device",
+			ce:   chainEntry{Path: "/dev/null", Attribs: attribs(0666|os.ModeDevice|os.ModeCharDevice, makedev(1, 3))},
+			want: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		},
+		{
+			name: "block device",
+			ce:   chainEntry{Path: "/dev/sdb1", Attribs: attribs(0660|os.ModeDevice, makedev(8, 300))},
+			want: tar.Header{Typeflag: tar.TypeBlock, Name: "dev/sdb1", Mode: 0660, Devmajor: 8, Devminor: 300},
+		},
+		{
+			name: "fifo",
+			ce:   chainEntry{Path: "/run/fifo", Attribs: attribs(0600|os.ModeNamedPipe, 0)},
+			want: tar.Header{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0600},
+		},
+	}
+	for _, test := range tests {
+		hdr, err := tarHeader(&test.ce)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		want := test.want
+		want.Format = tar.FormatPAX
+		want.Uid, want.Gid = 1234, 5678
+		want.ModTime = time.Unix(0, mtime.UnixNano())
+		if hdr.Typeflag != want.Typeflag || hdr.Name != want.Name || hdr.Mode != want.Mode ||
+			hdr.Size != want.Size || hdr.Linkname != want.Linkname || hdr.Uid != want.Uid ||
+			hdr.Gid != want.Gid || !hdr.ModTime.Equal(want.ModTime) || hdr.Format != want.Format ||
+			hdr.Devmajor != want.Devmajor || hdr.Devminor != want.Devminor {
+			t.Fatalf("%v: header %+v, want %+v", test.name, hdr, want)
+		}
+	}
+
+	socket := chainEntry{Path: "/run/socket", Attribs: attribs(0600|os.ModeSocket, 0)}
+	if hdr, err := tarHeader(&socket); hdr != nil || err != nil {
+		t.Fatalf("socket: %+v %v", hdr, err)
+	}
+}
+
+// testTree backs up a tree with a delta level and returns the source
+// directory, the backup directory and the secret key.  Run as root, the tree
+// holds devices and files of other owners.
+func testTree(t *testing.T, dir string, dedup bool) (string, string, *stream.SecretKey) {
+	t.Helper()
+
+	srcDir := filepath.Join(dir, "src")
+	backupDir := filepath.Join(dir, "backup")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	pk, sk := testKeys(t)
+	cfg := testConfig(t, backupDir, srcDir)
+	if dedup {
+		cfg.Backup.Dedup = true
+		cfg.Backup.ChunkKeyFile = filepath.Join(dir, "chunk.key")
+	}
+	basis := testData(t, 1<<17)
+	files := map[string][]byte{
+		"changed":      basis,
+		"unchanged":    []byte("unchanged"),
+		"deleted":      []byte("deleted"),
+		"sub/big":      testData(t, 1<<20),
+		"sub/text.txt": bytes.Repeat([]byte("compressible text\n"), 1<<14),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("unchanged", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(srcDir, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(srcDir, "sub"), 0750|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(srcDir, "sub/big"), 0750|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(filepath.Join(srcDir, "unchanged"), 1234, 5678); err != nil {
+			t.Fatal(err)
+		}
+		err := syscall.Mknod(filepath.Join(srcDir, "null"), syscall.S_IFCHR|0666, int(makedev(1, 3)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = syscall.Mknod(filepath.Join(srcDir, "sub/disk"), syscall.S_IFBLK|0660, int(makedev(8, 300)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	if err := backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	newData := append(append([]byte{}, basis[:1<<16]...), []byte("inserted")...)
+	newData = append(newData, basis[1<<16:]...)
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "changed"), newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(srcDir, "link"))
+	if err := os.Symlink("changed", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(srcDir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backup(ctx, []*stream.PublicKey{pk}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return srcDir, backupDir, sk
+}
+
+// checkTar compares the tar stream in b with the tree at srcDir.
+func checkTar(t *testing.T, b []byte, srcDir string) {
+	t.Helper()
+
+	tr := tar.NewReader(bytes.NewReader(b))
+	seen := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		path := "/" + strings.TrimSuffix(hdr.Name, "/")
+		seen[path] = true
+		if hdr.Typeflag == tar.TypeDir && strings.HasPrefix(srcDir, path+"/") {
+			// Ancestors added by imports.
+			continue
+		}
+		st, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		sys := st.Sys().(*syscall.Stat_t)
+		mode := int64(st.Mode().Perm())
+		for bit, flag := range map[os.FileMode]int64{os.ModeSetuid: 04000, os.ModeSetgid: 02000, os.ModeSticky: 01000} {
+			if st.Mode()&bit != 0 {
+				mode |= flag
+			}
+		}
+		if hdr.Mode != mode || hdr.Uid != int(sys.Uid) || hdr.Gid != int(sys.Gid) ||
+			!hdr.ModTime.Equal(st.ModTime()) {
+			t.Fatalf("%v: attributes %+v, want %v %v", path, hdr, st.Mode(), st.ModTime())
+		}
+		switch {
+		case st.Mode().IsRegular():
+			data, _ := ioutil.ReadAll(tr)
+			want, _ := ioutil.ReadFile(path)
+			if hdr.Typeflag != tar.TypeReg || !bytes.Equal(data, want) {
+				t.Fatalf("%v: content mismatch", path)
+			}
+		case st.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			if hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != target {
+				t.Fatalf("%v: link %q, want %q", path, hdr.Linkname, target)
+			}
+		case st.IsDir():
+			if hdr.Typeflag != tar.TypeDir {
+				t.Fatalf("%v: not a directory", path)
+			}
+		case st.Mode()&os.ModeNamedPipe != 0:
+			if hdr.Typeflag != tar.TypeFifo {
+				t.Fatalf("%v: not a fifo", path)
+			}
+		case st.Mode()&os.ModeDevice != 0:
+			typ := byte(tar.TypeBlock)
+			if st.Mode()&os.ModeCharDevice != 0 {
+				typ = tar.TypeChar
+			}
+			rdev := uint64(sys.Rdev)
+			if hdr.Typeflag != typ || hdr.Devmajor != int64(major(rdev)) || hdr.Devminor != int64(minor(rdev)) {
+				t.Fatalf("%v: device %+v", path, hdr)
+			}
+		}
+	}
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !seen[path] {
+			t.Errorf("%v: missing", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreTar(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "multus")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcDir, backupDir, sk := testTree(t, dir, dedup)
+		ctx := context.Background()
+		var out bytes.Buffer
+		if err = restoreStream(ctx, sk, testRepo(t, backupDir), &out, nil, -1, false); err != nil {
+			t.Fatal(err)
+		}
+		checkTar(t, out.Bytes(), srcDir)
+
+		out.Reset()
+		re := regexp.MustCompile("/changed$")
+		if err = restoreStream(ctx, sk, testRepo(t, backupDir), &out, re, -1, true); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := ioutil.ReadFile(filepath.Join(srcDir, "changed"))
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Fatal("stdout content mismatch")
+		}
+		// Level 0 still holds the original content.
+		out.Reset()
+		if err = restoreStream(ctx, sk, testRepo(t, backupDir), &out, re, 0, true); err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() != 1<<17 {
+			t.Fatalf("level 0: %d bytes", out.Len())
+		}
+		err = restoreStream(ctx, sk, testRepo(t, backupDir), &out, regexp.MustCompile("changed|unchanged"), -1, true)
+		if err == nil || !strings.Contains(err.Error(), "2 files match") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+}
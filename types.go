@@ -1,24 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"sort"
 	"syscall"
 	"time"
 
+	"github.com/companyzero/multus/format"
+	"github.com/companyzero/multus/storage"
 	"github.com/jrick/ss/stream"
-	"github.com/silvasur/golibrsync/librsync"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -47,19 +49,29 @@ func (s Signature) NewReader() *bytes.Reader {
 	return bytes.NewReader(s)
 }
 
+// Fingerprint is a cryptographic hash of a file's attributes and content.  It
+// is only used to detect changes and is never fed to librsync.
+type Fingerprint [sha256.Size]byte
+
+// SignatureEntry is a single sig.cache record.  The fingerprint detects
+// changes while the signature is the librsync block signature of the file
+// data the next delta is computed against.
 type SignatureEntry struct {
-	path      string
-	signature Signature
+	path        string
+	fingerprint Fingerprint
+	signature   Signature
 }
 
 func (s *SignatureEntry) Serialize() []byte {
 	var offset int
-	buf := make([]byte, 2+len(s.path)+8+len(s.signature))
+	buf := make([]byte, 2+len(s.path)+sha256.Size+8+len(s.signature))
 
 	binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(len(s.path)))
 	offset += 2
 	copy(buf[offset:], s.path)
 	offset += len(s.path)
+	copy(buf[offset:offset+sha256.Size], s.fingerprint[:])
+	offset += sha256.Size
 	binary.LittleEndian.PutUint64(buf[offset:offset+8], uint64(len(s.signature)))
 	offset += 8
 	copy(buf[offset:], s.signature)
@@ -67,39 +79,60 @@ func (s *SignatureEntry) Serialize() []byte {
 	return buf
 }
 
-func NewSignatureEntry(path string, signature Signature) *SignatureEntry {
+func NewSignatureEntry(path string, fingerprint Fingerprint, signature Signature) *SignatureEntry {
 	return &SignatureEntry{
-		path:      path,
-		signature: signature,
+		path:        path,
+		fingerprint: fingerprint,
+		signature:   signature,
 	}
 }
 
+// ChainID identifies a chain.
+type ChainID = format.ChainID
+
+// newChainID returns a random chain id.
+func newChainID() (ChainID, error) {
+	var id ChainID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
 type SignatureCache struct {
-	version    uint16
-	instance   uint16
-	hostname   string
-	timeStamp  time.Time
-	signatures map[string]Signature
+	version   uint16
+	instance  uint16
+	chainID   ChainID
+	hostname  string
+	timeStamp time.Time
+	// differential chains compute every level against level 0, so the
+	// entries are only updated by level 0.
+	differential bool
+	// baseSize is the number of bytes written by level 0.  incrementSize
+	// is the sum of all later levels of an incremental chain and the size
+	// of the latest level of a differential one.
+	baseSize      uint64
+	incrementSize uint64
+	entries       map[string]*SignatureEntry
 }
 
 func (sc *SignatureCache) Paths() map[string]struct{} {
-	paths := make(map[string]struct{}, len(sc.signatures))
-	for path := range sc.signatures {
+	paths := make(map[string]struct{}, len(sc.entries))
+	for path := range sc.entries {
 		paths[path] = struct{}{}
 	}
 	return paths
 }
 
-func (sc *SignatureCache) Add(path string, signature Signature) {
-	sc.signatures[path] = signature
+func (sc *SignatureCache) Add(path string, fingerprint Fingerprint, signature Signature) {
+	sc.entries[path] = NewSignatureEntry(path, fingerprint, signature)
 }
 
 func (sc *SignatureCache) Delete(path string) {
-	delete(sc.signatures, path)
+	delete(sc.entries, path)
 }
 
-func (sc *SignatureCache) Get(path string) Signature {
-	return sc.signatures[path]
+// Get returns the cache entry for path or nil when the path is unknown.
+func (sc *SignatureCache) Get(path string) *SignatureEntry {
+	return sc.entries[path]
 }
 
 func (sc *SignatureCache) Instance() uint16 {
@@ -107,11 +140,11 @@ func (sc *SignatureCache) Instance() uint16 {
 }
 
 func (sc *SignatureCache) Len() int {
-	return len(sc.signatures)
+	return len(sc.entries)
 }
 
 func (sc *SignatureCache) Write(fd io.Writer) error {
-	buf := make([]byte, 2+2+1+len(sc.hostname)+8+8)
+	buf := make([]byte, 2+2+1+len(sc.hostname)+8+16+1+8+8+8)
 
 	offset := 0
 	binary.LittleEndian.PutUint16(buf[offset:offset+2], sc.version)
@@ -124,27 +157,92 @@ func (sc *SignatureCache) Write(fd io.Writer) error {
 	offset += len(sc.hostname)
 	binary.LittleEndian.PutUint64(buf[offset:offset+8], uint64(sc.timeStamp.Unix()))
 	offset += 8
-	binary.LittleEndian.PutUint64(buf[offset:offset+8], uint64(len(sc.signatures)))
+	copy(buf[offset:offset+16], sc.chainID[:])
+	offset += 16
+	if sc.differential {
+		buf[offset] = 1
+	}
+	offset++
+	binary.LittleEndian.PutUint64(buf[offset:offset+8], sc.baseSize)
+	offset += 8
+	binary.LittleEndian.PutUint64(buf[offset:offset+8], sc.incrementSize)
+	offset += 8
+	binary.LittleEndian.PutUint64(buf[offset:offset+8], uint64(len(sc.entries)))
 
 	if _, err := fd.Write(buf); err != nil {
 		return err
 	}
-	for path, sig := range sc.signatures {
-		if _, err := fd.Write(NewSignatureEntry(path, sig).Serialize()); err != nil {
+	for _, entry := range sc.entries {
+		if _, err := fd.Write(entry.Serialize()); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// WriteFile atomically replaces sigfile with the cache.
+func (sc *SignatureCache) WriteFile(sigfile string) error {
+	sigFD, err := os.OpenFile(sigfile+".partial", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o0640)
+	if err != nil {
+		return err
+	}
+	if err = sc.Write(sigFD); err != nil {
+		sigFD.Close()
+		os.Remove(sigFD.Name())
+		return err
+	}
+	if err = sigFD.Close(); err != nil {
+		os.Remove(sigFD.Name())
+		return err
+	}
+	if err = os.Rename(sigFD.Name(), sigfile); err != nil {
+		os.Remove(sigFD.Name())
+		return err
+	}
+	return nil
+}
+
+// Upload writes a copy of the cache to the sig.cache file of store.
+func (sc *SignatureCache) Upload(store storage.Backend) error {
+	w, err := store.Create("sig.cache")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if err = sc.Write(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// NewSignatureCache returns an empty cache for the chain id.
+func NewSignatureCache(id ChainID, hostname string, timeStamp time.Time, differential bool) *SignatureCache {
+	return &SignatureCache{
+		entries:      make(map[string]*SignatureEntry),
+		version:      FormatVersion,
+		chainID:      id,
+		hostname:     hostname,
+		timeStamp:    timeStamp,
+		differential: differential,
+	}
+}
+
 func LoadSignatureCache(sigfile string, maxIntervals uint16) (*SignatureCache, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
 	SC := SignatureCache{
-		signatures: make(map[string]Signature, 204800),
-		version:    FormatVersion,
+		entries: make(map[string]*SignatureEntry, 204800),
+		version: FormatVersion,
+	}
+	// A new chain is started unless sigfile continues one.
+	if SC.chainID, err = newChainID(); err != nil {
+		return nil, err
 	}
 	buf, err := ioutil.ReadFile(sigfile)
 	if err != nil {
@@ -155,17 +253,39 @@ func LoadSignatureCache(sigfile string, maxIntervals uint16) (*SignatureCache, e
 		}
 		return nil, err
 	}
-	if len(buf) < 14 {
+	if len(buf) == 0 {
 		SC.hostname = hostname
 		SC.timeStamp = time.Now()
 		return &SC, nil
 	}
 
 	offset := 0
+	// avail reports whether n more bytes follow offset.
+	avail := func(n uint64) bool {
+		return n <= uint64(len(buf)-offset)
+	}
+	truncated := fmt.Errorf("%q: truncated signature cache", sigfile)
+	if !avail(2) {
+		return nil, truncated
+	}
 	SC.version = binary.LittleEndian.Uint16(buf[offset : offset+2])
 	offset += 2
+	if SC.version != FormatVersion {
+		log.Printf("%q: format version %d, starting a new chain",
+			sigfile, SC.version)
+		SC.version = FormatVersion
+		SC.hostname = hostname
+		SC.timeStamp = time.Now()
+		return &SC, nil
+	}
+	if !avail(2 + 1) {
+		return nil, truncated
+	}
 	SC.instance = binary.LittleEndian.Uint16(buf[offset : offset+2])
-	if SC.instance+1 > maxIntervals {
+	if maxIntervals == 0 {
+		maxIntervals = ^uint16(0)
+	}
+	if SC.instance >= maxIntervals {
 		SC.version = FormatVersion
 		SC.instance = 0
 		SC.hostname = hostname
@@ -175,25 +295,51 @@ func LoadSignatureCache(sigfile string, maxIntervals uint16) (*SignatureCache, e
 	offset += 2
 	hostLen := int(buf[offset])
 	offset++
+	if !avail(uint64(hostLen) + 8 + 16 + 1 + 8 + 8 + 8) {
+		return nil, truncated
+	}
 	SC.hostname = string(buf[offset : offset+hostLen])
 	offset += hostLen
 	SC.timeStamp = time.Unix(int64(binary.LittleEndian.Uint64(buf[offset:offset+8])), 0)
 	offset += 8
+	copy(SC.chainID[:], buf[offset:offset+16])
+	offset += 16
+	SC.differential = buf[offset] != 0
+	offset++
+	SC.baseSize = binary.LittleEndian.Uint64(buf[offset : offset+8])
+	offset += 8
+	SC.incrementSize = binary.LittleEndian.Uint64(buf[offset : offset+8])
+	offset += 8
 	numSigs := binary.LittleEndian.Uint64(buf[offset : offset+8])
 	offset += 8
 	log.Printf("instance:%d numSigs:%d", SC.instance, numSigs)
-	for i := 0; i < int(numSigs); i++ {
+	for i := uint64(0); i < numSigs; i++ {
+		if !avail(2) {
+			return nil, truncated
+		}
 		pathLen := binary.LittleEndian.Uint16(buf[offset : offset+2])
 		offset += 2
+		if !avail(uint64(pathLen) + sha256.Size + 8) {
+			return nil, truncated
+		}
 		path := string(buf[offset : offset+int(pathLen)])
 		offset += int(pathLen)
+		var fingerprint Fingerprint
+		copy(fingerprint[:], buf[offset:offset+sha256.Size])
+		offset += sha256.Size
 		sigLen := binary.LittleEndian.Uint64(buf[offset : offset+8])
 		offset += 8
-		signature := make([]byte, sigLen)
-		copy(signature, buf[offset:offset+int(sigLen)])
-		offset += int(sigLen)
+		if !avail(sigLen) {
+			return nil, truncated
+		}
+		var signature Signature
+		if sigLen != 0 {
+			signature = make([]byte, sigLen)
+			copy(signature, buf[offset:offset+int(sigLen)])
+			offset += int(sigLen)
+		}
 
-		SC.Add(path, signature)
+		SC.Add(path, fingerprint, signature)
 	}
 	return &SC, nil
 }
@@ -238,29 +384,6 @@ func (f FileAttributes) Serialize() []byte {
 	return buf[:]
 }
 
-var (
-	fSig = new(bytes.Buffer)
-)
-
-func init() {
-	fSig.Grow(48)
-}
-
-func (f FileAttributes) Signature() ([]byte, error) {
-	fbuf := f.Serialize()
-
-	bufReader := bytes.NewReader(fbuf)
-	fSig.Reset()
-	err := librsync.CreateSignature(bufReader, fSig)
-	if err != nil {
-		return nil, err
-	}
-	buf := make([]byte, fSig.Len())
-	copy(buf, fSig.Bytes())
-
-	return buf, nil
-}
-
 type Metadata struct {
 	Path    string
 	Attribs FileAttributes
@@ -284,10 +407,6 @@ func (m *Metadata) Serialize() []byte {
 	return buf
 }
 
-func (m *Metadata) Signature() (Signature, error) {
-	return m.Attribs.Signature()
-}
-
 func NewMetadata(filepath string) (*Metadata, error) {
 	stat, err := os.Lstat(filepath)
 	if err != nil {
@@ -314,232 +433,243 @@ func NewMetadata(filepath string) (*Metadata, error) {
 }
 
 type Snapshot struct {
-	instance     uint16
-	uid          int
-	gid          int
-	fd           *os.File
-	gz           *gzip.Writer
-	pipeR        *io.PipeReader
-	pipeW        *io.PipeWriter
-	eg           *errgroup.Group
-	bytesWritten int64
-	err          error
-}
-
-func GenSignature(md *Metadata, dataReader io.ReadSeeker) (Signature, error) {
-	attribSig, err := md.Signature()
-	if err != nil {
-		return nil, err
-	}
+	header      SnapshotHeader
+	name        string
+	w           storage.Writer
+	out         *countWriter
+	hash        hash.Hash
+	compression Compression
+	body        *countWriter
+	blocks      *blockWriter
+	cw          resetWriteCloser
+	sample      []byte
+	pipeR       *io.PipeReader
+	pipeW       *io.PipeWriter
+	eg          *errgroup.Group
+	err         error
+}
+
+// Entry flags recorded in front of the data length of every snapshot record.
+const (
+	// entryDelta marks the record data as a librsync delta against the
+	// data restored by the previous level.
+	entryDelta = 1 << iota
 
+	// entryCompressed marks the record data as compressed with the
+	// snapshot codec and framed in blocks.
+	entryCompressed
+
+	// entryChunked marks the record data as a list of references into
+	// the chunk repository instead of the file content.
+	entryChunked
+)
+
+// GenFingerprint returns the hash of the file attributes and, when dataReader
+// is not nil, its content.  The reader is returned to its original offset.
+func GenFingerprint(md *Metadata, dataReader io.ReadSeeker) (Fingerprint, error) {
+	var fingerprint Fingerprint
+
+	h := sha256.New()
+	h.Write(md.Attribs.Serialize())
 	if dataReader != nil {
-		dataSignature, err := signatureFromReader(dataReader)
+		savedOffset, err := dataReader.Seek(0, io.SeekCurrent)
 		if err != nil {
-			return nil, err
+			return fingerprint, err
 		}
-
-		// signature of both attribs and data
-		si := append(attribSig, dataSignature...)
-		finalSig, err := signatureFromReader(bytes.NewReader(si))
-		if err != nil {
-			return nil, err
+		if _, err = io.Copy(h, dataReader); err != nil {
+			return fingerprint, err
+		}
+		if _, err = dataReader.Seek(savedOffset, io.SeekStart); err != nil {
+			return fingerprint, err
 		}
-		return finalSig, nil
 	}
-	return attribSig, nil
+	copy(fingerprint[:], h.Sum(nil))
+
+	return fingerprint, nil
 }
 
-func (s *Snapshot) Add(md *Metadata, dataReader io.ReadSeeker, dataLen int64) (Signature, error) {
+func (s *Snapshot) Add(md *Metadata, flags byte, dataReader io.Reader, dataLen int64) error {
 	if s.err != nil {
-		return nil, s.err
+		return s.err
 	}
-	numBytes, err := s.gz.Write(md.Serialize())
-	s.bytesWritten += int64(numBytes)
-	if err != nil {
-		s.err = err
-		return nil, err
+	if dataReader != nil && s.compression != CompressionNone {
+		sample := s.sample
+		if dataLen < int64(len(sample)) {
+			sample = sample[:dataLen]
+		}
+		n, err := io.ReadFull(dataReader, sample)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			s.err = err
+			return err
+		}
+		sample = sample[:n]
+		if isCompressible(md.Path, sample) {
+			flags |= entryCompressed
+		}
+		dataReader = io.MultiReader(bytes.NewReader(sample), dataReader)
 	}
-	attribSig, err := md.Signature()
-	if err != nil {
+
+	if _, err := s.body.Write(md.Serialize()); err != nil {
 		s.err = err
-		return nil, err
+		return err
 	}
 
-	var dataLenBytes [8]byte
-	binary.LittleEndian.PutUint64(dataLenBytes[:], uint64(dataLen))
-	numBytes, err = s.gz.Write(dataLenBytes[:])
-	s.bytesWritten += int64(numBytes)
-	if err != nil {
+	var dataLenBytes [1 + 8]byte
+	dataLenBytes[0] = flags
+	binary.LittleEndian.PutUint64(dataLenBytes[1:], uint64(dataLen))
+	if _, err := s.body.Write(dataLenBytes[:]); err != nil {
 		s.err = err
-		return nil, err
+		return err
 	}
 
 	if dataReader != nil {
-		dataSignature, err := signatureFromReader(dataReader)
-		if err != nil {
-			s.err = err
-			return nil, err
-		}
-
-		// signature of both attribs and data
-		si := append(attribSig, dataSignature...)
-		finalSig, err := signatureFromReader(bytes.NewReader(si))
-		if err != nil {
-			s.err = err
-			return nil, err
+		var numBytes int64
+		var err error
+		if flags&entryCompressed != 0 {
+			s.blocks.Reset(s.body)
+			s.cw.Reset(s.blocks)
+			numBytes, err = io.CopyN(s.cw, dataReader, dataLen)
+			if err == nil {
+				err = s.cw.Close()
+			}
+			if err == nil {
+				err = s.blocks.Close()
+			}
+		} else {
+			numBytes, err = io.CopyN(s.body, dataReader, dataLen)
 		}
-
-		numBytes, err := io.CopyN(s.gz, dataReader, dataLen)
-		s.bytesWritten += numBytes
 		if err != nil {
 			s.err = err
-			return nil, err
+			return err
 		}
 
 		if numBytes != dataLen {
 			log.Printf("WARN: %q changed size during write: %d != %d",
 				md.Path, dataLen, numBytes)
 		}
-
-		return finalSig, nil
 	}
-	return attribSig, nil
+	return nil
 }
 
+// Close finishes the snapshot and makes it visible in the repository.
 func (s *Snapshot) Close() error {
-	if err := s.gz.Flush(); err != nil {
-		s.err = err
-		s.gz.Close()
-		s.fd.Close()
-		return err
-	}
-	if err := s.gz.Close(); err != nil {
-		s.err = err
-		s.fd.Close()
-		return err
-	}
 	if err := s.pipeW.Close(); err != nil {
 		s.err = err
-		s.fd.Close()
+		s.w.Abort()
 		return err
 	}
 	if err := s.eg.Wait(); err != nil {
 		s.err = err
-		s.fd.Close()
+		s.w.Abort()
 		return err
 	}
 	if err := s.pipeR.Close(); err != nil {
 		s.err = err
-		s.fd.Close()
-		return err
-	}
-	if err := s.fd.Close(); err != nil {
-		s.err = err
+		s.w.Abort()
 		return err
 	}
-	if err := os.Chmod(s.fd.Name(), 0440); err != nil {
-		s.err = err
-		return err
-	}
-	if err := os.Chown(s.fd.Name(), s.uid, s.gid); err != nil {
+	if err := s.w.Close(); err != nil {
 		s.err = err
 		return err
 	}
 	return nil
 }
 
+// Abort discards the snapshot.
+func (s *Snapshot) Abort() {
+	s.pipeW.CloseWithError(errSnapshotAborted)
+	s.eg.Wait()
+	s.pipeR.Close()
+	s.w.Abort()
+}
+
+// Manifest describes the closed snapshot.
+func (s *Snapshot) Manifest() *format.Manifest {
+	m := &format.Manifest{
+		Version:      s.header.Version,
+		Hostname:     s.header.Hostname,
+		Timestamp:    s.header.Timestamp,
+		ChainID:      s.header.ChainID,
+		Increment:    s.header.Increment,
+		Differential: s.header.Differential,
+		Size:         s.out.n,
+		Created:      time.Now(),
+	}
+	copy(m.SHA256[:], s.hash.Sum(nil))
+	return m
+}
+
+// Name returns the name of the snapshot in the repository.
 func (s *Snapshot) Name() string {
-	return s.fd.Name()
+	return s.name
 }
 
 func (s *Snapshot) BytesWritten() int64 {
-	return s.bytesWritten
+	return s.body.n
 }
 
-// SnapshotList returns a sorted list of files based on increment version.
-func SnapshotList(secretKey *stream.SecretKey, dir string) (IncrementalFiles, error) {
+// headerReadSize bounds the ciphertext read for a snapshot header: the
+// sealed stream version and the first chunk, which holds the header.
+const headerReadSize = 4 + 16 + 1<<16 + 16
+
+// readSnapshotHeader decrypts the header of the snapshot in r without reading
+// the rest of the file.
+func readSnapshotHeader(secretKey *stream.SecretKey, r io.Reader) (*SnapshotHeader, error) {
+	header, err := readStreamHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	symKey, err := header.key(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	var plain bytes.Buffer
+	err = stream.Decrypt(&plain, io.LimitReader(r, headerReadSize), header.Bytes, symKey)
+	if err != nil {
+		return nil, err
+	}
+	return ReadSnapshotHeader(&plain)
+}
+
+// SnapshotList returns a sorted list of the increments in store based on
+// increment version.
+func SnapshotList(secretKey *stream.SecretKey, store storage.Backend) (IncrementalFiles, error) {
 	// Look for existing instances
-	instanceFiles, err := ioutil.ReadDir(dir)
+	instanceFiles, err := store.List("")
 	if err != nil {
 		return nil, err
 	}
 
 	var incrementalFiles IncrementalFiles
 	for _, file := range instanceFiles {
-		if filepath.Ext(file.Name()) != ".enc" {
+		if !format.IsIncrement(file.Name) {
 			continue
 		}
-		fileName := filepath.Join(dir, file.Name())
-		fd, err := os.Open(fileName)
-		if err != nil {
-			return nil, err
-		}
-
-		header, err := stream.ReadHeader(fd)
+		fileName := file.Name
+		fd, err := store.Open(fileName)
 		if err != nil {
-			fd.Close()
 			return nil, err
 		}
-		symKey, err := stream.Decapsulate(header, secretKey)
+		snapHeader, err := readSnapshotHeader(secretKey, fd)
+		fd.Close()
 		if err != nil {
-			fd.Close()
-			return nil, err
+			return nil, fmt.Errorf("%q: %v", fileName, err)
 		}
-
-		pipeR, pipeW := io.Pipe()
-		eg, _ := errgroup.WithContext(context.Background())
-		eg.Go(func() error {
-			gzR, err := gzip.NewReader(pipeR)
-			if err != nil {
-				return err
-			}
-			defer gzR.Close()
-			b := new(bytes.Buffer)
-			if _, err = io.CopyN(b, gzR, 3); err != nil {
-				return err
-			}
-			hostLen := int64(b.Bytes()[2])
-			if _, err = io.CopyN(b, gzR, hostLen+8+2); err != nil {
-				return err
-			}
-			if _, err = io.Copy(ioutil.Discard, pipeR); err != nil {
-				return err
-			}
-			var iFile IncrementalFile
-			offset := int64(3)
-			iFile.Hostname = string(b.Bytes()[offset : offset+hostLen])
-			offset += hostLen
-			iFile.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(b.Bytes()[offset:offset+8])), 0)
-			offset += 8
-			iFile.Increment = binary.LittleEndian.Uint16(b.Bytes()[offset : offset+2])
-			iFile.Filename = fileName
-			incrementalFiles = append(incrementalFiles, iFile)
-			return nil
+		incrementalFiles = append(incrementalFiles, IncrementalFile{
+			ChainID:      snapHeader.ChainID,
+			Hostname:     snapHeader.Hostname,
+			Timestamp:    snapHeader.Timestamp,
+			Increment:    snapHeader.Increment,
+			Differential: snapHeader.Differential,
+			Filename:     fileName,
 		})
-		err = stream.Decrypt(pipeW, fd, header.Bytes, symKey)
-		if err != nil {
-			pipeW.Close()
-			pipeR.Close()
-			fd.Close()
-			return nil, err
-		}
-		pipeW.Close()
-		err = eg.Wait()
-		pipeR.Close()
-		if err != nil {
-			fd.Close()
-			return nil, err
-		}
-		if err = fd.Close(); err != nil {
-			return nil, err
-		}
 	}
 
-	check := make(map[string]IncrementalFiles)
+	check := make(map[ChainID]IncrementalFiles)
 	for _, incFile := range incrementalFiles {
-		checkid, exists := check[incFile.Hostname+incFile.Timestamp.String()]
+		checkid, exists := check[incFile.ChainID]
 		if !exists {
-			check[incFile.Hostname+incFile.Timestamp.String()] = append(check[incFile.Hostname+incFile.Timestamp.String()], incFile)
+			check[incFile.ChainID] = append(check[incFile.ChainID], incFile)
 			continue
 		}
 		for _, inc := range checkid {
@@ -548,7 +678,7 @@ func SnapshotList(secretKey *stream.SecretKey, dir string) (IncrementalFiles, er
 					inc.Increment, incFile.Filename, inc.Filename)
 			}
 		}
-		check[incFile.Hostname+incFile.Timestamp.String()] = append(check[incFile.Hostname+incFile.Timestamp.String()], incFile)
+		check[incFile.ChainID] = append(check[incFile.ChainID], incFile)
 	}
 	sort.Sort(incrementalFiles)
 
@@ -556,10 +686,12 @@ func SnapshotList(secretKey *stream.SecretKey, dir string) (IncrementalFiles, er
 }
 
 type IncrementalFile struct {
-	Hostname  string
-	Timestamp time.Time
-	Increment uint16
-	Filename  string
+	ChainID      ChainID
+	Hostname     string
+	Timestamp    time.Time
+	Increment    uint16
+	Differential bool
+	Filename     string
 }
 
 type IncrementalFiles []IncrementalFile
@@ -576,68 +708,358 @@ func (i IncrementalFiles) Swap(a, b int) {
 	i[a], i[b] = i[b], i[a]
 }
 
-func NewSnapshot(pubKey *stream.PublicKey, uid, gid, gzLevel int, dataDir, hostname string,
-	timeStamp time.Time, instance uint16, version uint16) (*Snapshot, error) {
+// SnapshotHeader is the prefix of every decrypted snapshot.  It describes the
+// chain the snapshot belongs to and the codec used for compressed entries.
+type SnapshotHeader struct {
+	Version      uint16
+	Compression  Compression
+	Differential bool
+	ChainID      ChainID
+	Hostname     string
+	Timestamp    time.Time
+	Increment    uint16
+}
 
-	header, symKey, err := stream.Encapsulate(rand.Reader, pubKey)
-	if err != nil {
+func (h *SnapshotHeader) Serialize() []byte {
+	hostLen := len(h.Hostname)
+	b := make([]byte, 2+1+1+16+1+hostLen+8+2)
+
+	offset := 0
+	binary.LittleEndian.PutUint16(b[offset:offset+2], h.Version)
+	offset += 2
+	b[offset] = byte(h.Compression)
+	offset++
+	if h.Differential {
+		b[offset] = 1
+	}
+	offset++
+	copy(b[offset:offset+16], h.ChainID[:])
+	offset += 16
+	b[offset] = byte(hostLen)
+	offset++
+	copy(b[offset:offset+hostLen], []byte(h.Hostname))
+	offset += hostLen
+	binary.LittleEndian.PutUint64(b[offset:offset+8], uint64(h.Timestamp.Unix()))
+	offset += 8
+	binary.LittleEndian.PutUint16(b[offset:offset+2], h.Increment)
+
+	return b
+}
+
+// ReadSnapshotHeader reads a snapshot header from r, leaving r positioned at
+// the first entry.
+func ReadSnapshotHeader(r io.Reader) (*SnapshotHeader, error) {
+	var b [2 + 1 + 1 + 16 + 1]byte
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return nil, err
+	}
+	h := SnapshotHeader{
+		Version:      binary.LittleEndian.Uint16(b[0:2]),
+		Compression:  Compression(b[2]),
+		Differential: b[3] != 0,
+	}
+	if h.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported format version %d", h.Version)
+	}
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return nil, err
+	}
+	copy(h.ChainID[:], b[4:20])
+	buf := make([]byte, int(b[20])+8+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
 	}
+	offset := int(b[20])
+	h.Hostname = string(buf[:offset])
+	h.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(buf[offset:offset+8])), 0)
+	offset += 8
+	h.Increment = binary.LittleEndian.Uint16(buf[offset : offset+2])
 
-	d := fmt.Sprintf("%d%02d%02d%02d%02d", timeStamp.Year(), timeStamp.Month(), timeStamp.Day(), timeStamp.Hour(), timeStamp.Minute())
-	filename := filepath.Join(dataDir, fmt.Sprintf("%s-%s.%d.gz.enc", d, hostname, instance))
-	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0600)
+	return &h, nil
+}
+
+// SnapshotEntry is a single record read from a snapshot.  Data yields the
+// uncompressed record data and is only valid until the next call to
+// SnapshotReader.Next.
+type SnapshotEntry struct {
+	Metadata
+	Flags   byte
+	DataLen uint64
+	Data    io.Reader
+	// Offset is where the record starts in the decrypted snapshot, which
+	// NextAt seeks to.
+	Offset int64
+}
+
+// entryDataReader reads exactly remaining bytes and reports a short entry as
+// io.ErrUnexpectedEOF.
+type entryDataReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *entryDataReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// SnapshotReader decrypts a snapshot and iterates over its entries.
+type SnapshotReader struct {
+	Header *SnapshotHeader
+	fd     io.ReadCloser
+	pipeR  *io.PipeReader
+	eg     *errgroup.Group
+	plain  *countReader
+	body   *bufio.Reader
+	blocks blockReader
+	dec    io.ReadCloser
+	entry  *SnapshotEntry
+}
+
+// OpenSnapshot starts decrypting filename in store and reads its header.
+func OpenSnapshot(secretKey *stream.SecretKey, store storage.Backend, filename string) (*SnapshotReader, error) {
+	fd, err := store.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	header, err := readStreamHeader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	symKey, err := header.key(secretKey)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
 
 	pipeR, pipeW := io.Pipe()
 	eg, _ := errgroup.WithContext(context.Background())
 	eg.Go(func() error {
-		return stream.Encrypt(fd, pipeR, header, symKey)
+		err := stream.Decrypt(pipeW, fd, header.Bytes, symKey)
+		pipeW.CloseWithError(err)
+		return err
 	})
-	gz, err := gzip.NewWriterLevel(pipeW, gzLevel)
+	sr := &SnapshotReader{
+		fd:    fd,
+		pipeR: pipeR,
+		eg:    eg,
+		plain: &countReader{r: pipeR},
+	}
+	sr.body = bufio.NewReaderSize(sr.plain, maxBlockSize)
+	sr.Header, err = ReadSnapshotHeader(sr.body)
 	if err != nil {
-		pipeW.Close()
-		pipeR.Close()
-		fd.Close()
-		os.Remove(fd.Name())
+		sr.Close()
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Next returns the next entry or io.EOF once all entries have been read.  Any
+// data left unread from the previous entry is discarded.
+func (sr *SnapshotReader) Next() (*SnapshotEntry, error) {
+	if err := sr.skip(); err != nil {
 		return nil, err
 	}
+	offset := sr.offset()
 
-	hostLen := len(hostname)
-	b := make([]byte, 2+1+hostLen+8+2)
+	var b [2]byte
+	if _, err := io.ReadFull(sr.body, b[:]); err != nil {
+		return nil, err
+	}
+	pathLen := int(binary.LittleEndian.Uint16(b[:]))
+	buf := make([]byte, pathLen+36+1+8)
+	if _, err := io.ReadFull(sr.body, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
 
-	offset := 0
-	binary.LittleEndian.PutUint16(b[offset:offset+2], version)
-	offset += 2
-	b[offset] = byte(hostLen)
-	offset++
-	copy(b[offset:offset+hostLen], []byte(hostname))
-	offset += hostLen
-	binary.LittleEndian.PutUint64(b[offset:offset+8], uint64(timeStamp.Unix()))
-	offset += 8
-	binary.LittleEndian.PutUint16(b[offset:offset+2], instance)
+	var entry SnapshotEntry
+	entry.Offset = offset
+	entry.Path = string(buf[:pathLen])
+	if err := entry.Attribs.Deserialize(buf[pathLen : pathLen+36]); err != nil {
+		return nil, err
+	}
+	entry.Flags = buf[pathLen+36]
+	entry.DataLen = binary.LittleEndian.Uint64(buf[pathLen+37:])
+
+	data := io.Reader(sr.body)
+	if entry.Flags&entryCompressed != 0 {
+		sr.blocks.Reset(sr.body)
+		dec, err := newDecompressor(&sr.blocks, sr.Header.Compression)
+		if err != nil {
+			return nil, err
+		}
+		sr.dec = dec
+		data = dec
+	}
+	entry.Data = &entryDataReader{r: data, remaining: int64(entry.DataLen)}
+	sr.entry = &entry
+
+	return &entry, nil
+}
+
+// NextAt returns the entry at offset, which must not be before the end of the
+// current entry.  The decrypted stream cannot seek, so the records up to
+// offset are read and discarded.
+func (sr *SnapshotReader) NextAt(offset int64) (*SnapshotEntry, error) {
+	if err := sr.skip(); err != nil {
+		return nil, err
+	}
+	if offset < sr.offset() {
+		return nil, fmt.Errorf("offset %d already read", offset)
+	}
+	if _, err := io.CopyN(ioutil.Discard, sr.body, offset-sr.offset()); err != nil {
+		return nil, err
+	}
+	return sr.Next()
+}
+
+// offset returns the number of decrypted bytes consumed.
+func (sr *SnapshotReader) offset() int64 {
+	return sr.plain.n - int64(sr.body.Buffered())
+}
+
+// skip discards what is left of the current entry, including the end of a
+// compressed stream and its block terminator.
+func (sr *SnapshotReader) skip() error {
+	if sr.entry == nil {
+		return nil
+	}
+	entry := sr.entry
+	sr.entry = nil
+	if _, err := io.Copy(ioutil.Discard, entry.Data); err != nil {
+		return err
+	}
+	if sr.dec == nil {
+		return nil
+	}
+	// The stream is authenticated by the decryption, so the codec trailer
+	// is skipped along with the block framing instead of being verified.
+	sr.dec.Close()
+	sr.dec = nil
+	_, err := io.Copy(ioutil.Discard, &sr.blocks)
+	return err
+}
+
+// Close stops decrypting and releases the snapshot.  It returns any
+// decryption error, so a snapshot that was read to the end has only been
+// authenticated once Close returns nil.
+func (sr *SnapshotReader) Close() error {
+	if sr.dec != nil {
+		sr.dec.Close()
+		sr.dec = nil
+	}
+	sr.pipeR.Close()
+	err := sr.eg.Wait()
+	sr.fd.Close()
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = nil
+	}
+	return err
+}
+
+// snapshotFileName returns the name of the increment of the chain id started
+// by hostname at timeStamp.  The timestamp only orders the names, the chain id
+// keeps chains started in the same minute apart.  The extension names the
+// codec the increment is compressed with.
+func snapshotFileName(id ChainID, hostname string, timeStamp time.Time, instance uint16, compression Compression) string {
+	d := fmt.Sprintf("%d%02d%02d%02d%02d", timeStamp.Year(), timeStamp.Month(), timeStamp.Day(), timeStamp.Hour(), timeStamp.Minute())
+	return fmt.Sprintf("%s-%s.%v.%d%s", d, hostname, id, instance, format.IncrementExt(compression.Ext()))
+}
+
+// errSnapshotAborted stops the encryption of an aborted snapshot.
+var errSnapshotAborted = errors.New("snapshot aborted")
 
-	numBytes, err := gz.Write(b)
+// NewSnapshot starts writing an increment to store.  It refuses to replace
+// an existing increment.
+func NewSnapshot(pubKeys []*stream.PublicKey, store storage.Backend, compression Compression, level, threads int,
+	chainID ChainID, hostname string, timeStamp time.Time, instance uint16, differential bool, version uint16) (*Snapshot, error) {
+
+	header, symKey, err := encapsulate(pubKeys)
 	if err != nil {
-		gz.Close()
-		pipeW.Close()
+		return nil, err
+	}
+
+	name := snapshotFileName(chainID, hostname, timeStamp, instance, compression)
+	_, err = store.Stat(name)
+	if err == nil {
+		return nil, fmt.Errorf("%v: %w", name, os.ErrExist)
+	}
+	if !storage.IsNotExist(err) {
+		return nil, err
+	}
+	w, err := store.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	out := &countWriter{w: io.MultiWriter(w, h)}
+	pipeR, pipeW := io.Pipe()
+	eg, _ := errgroup.WithContext(context.Background())
+	eg.Go(func() error {
+		err := header.encrypt(out, pipeR, symKey)
+		if err != nil {
+			// Unblock writers when the upload fails.
+			pipeR.CloseWithError(err)
+		}
+		return err
+	})
+
+	snapHeader := SnapshotHeader{
+		Version:      version,
+		Compression:  compression,
+		Differential: differential,
+		ChainID:      chainID,
+		Hostname:     hostname,
+		Timestamp:    timeStamp,
+		Increment:    instance,
+	}
+	body := &countWriter{w: pipeW}
+	if _, err = body.Write(snapHeader.Serialize()); err != nil {
+		pipeW.CloseWithError(errSnapshotAborted)
+		eg.Wait()
 		pipeR.Close()
-		fd.Close()
-		os.Remove(fd.Name())
+		w.Abort()
+		return nil, err
+	}
+
+	blocks := newBlockWriter(body)
+	cw, err := newCompressor(blocks, compression, level, threads)
+	if err != nil {
+		pipeW.CloseWithError(errSnapshotAborted)
+		eg.Wait()
+		pipeR.Close()
+		w.Abort()
 		return nil, err
 	}
 
 	return &Snapshot{
-		instance:     instance,
-		uid:          uid,
-		gid:          gid,
-		fd:           fd,
-		gz:           gz,
-		pipeW:        pipeW,
-		pipeR:        pipeR,
-		eg:           eg,
-		bytesWritten: int64(numBytes),
+		header:      snapHeader,
+		name:        name,
+		w:           w,
+		out:         out,
+		hash:        h,
+		compression: compression,
+		body:        body,
+		blocks:      blocks,
+		cw:          cw,
+		sample:      make([]byte, probeSize),
+		pipeW:       pipeW,
+		pipeR:       pipeR,
+		eg:          eg,
 	}, nil
 }
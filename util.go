@@ -40,6 +40,10 @@ func minor(rdev uint64) uint64 {
 	return (rdev & 0xff) | ((rdev & 0xffff0000) >> 8)
 }
 
+func makedev(major, minor uint64) uint64 {
+	return (major&0xff)<<8 | minor&0xff | (minor&^0xff)<<8
+}
+
 var (
 	sigS = new(bytes.Buffer)
 )